@@ -25,15 +25,32 @@ func main() {
 
 	config.LoadConfig()
 	types.LoadStore()
+	if config.Config.Election.Key == "" {
+		dot.ResetDrains("interrupted by dot restart")
+		dot.ResumeRollouts()
+	}
 
+	go dot.Elector.Run()
 	go dot.LeviHub.CheckAlive()
 	go dot.LeviHub.Run()
+	go dot.Reconciler.Run()
+	go dot.HealthChecker.Run()
 
 	http.Handle("/", apiserver.RestAPIServer)
 	http.HandleFunc("/ws", dot.ServeWS)
 	http.HandleFunc("/log", dot.ServeLogWS)
 
-	err := http.ListenAndServe(config.Config.Bind, nil)
+	var err error
+	if config.Config.TLS.Cert != "" {
+		tlsConfig, e := dot.ServerTLSConfig()
+		if e != nil {
+			Logger.Assert(e, "tls")
+		}
+		server := &http.Server{Addr: config.Config.Bind, TLSConfig: tlsConfig}
+		err = server.ListenAndServeTLS(config.Config.TLS.Cert, config.Config.TLS.Key)
+	} else {
+		err = http.ListenAndServe(config.Config.Bind, nil)
+	}
 	if err != nil {
 		Logger.Assert(err, "http")
 	}
@@ -52,6 +52,74 @@ CREATE TABLE `application` (
 ) ENGINE=InnoDB AUTO_INCREMENT=354 DEFAULT CHARSET=utf8;
 /*!40101 SET character_set_client = @saved_cs_client */;
 
+--
+-- Table structure for table `audit`
+--
+
+DROP TABLE IF EXISTS `audit`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `audit` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `user` varchar(255) NOT NULL,
+  `action` varchar(255) NOT NULL,
+  `path` varchar(255) NOT NULL,
+  `app_name` varchar(255) NOT NULL DEFAULT '',
+  `version` varchar(255) NOT NULL DEFAULT '',
+  `params` longtext NOT NULL,
+  `task_ids` varchar(255) NOT NULL DEFAULT '',
+  `outcome` varchar(255) NOT NULL,
+  `message` varchar(255) NOT NULL DEFAULT '',
+  `created` datetime NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `user` (`user`),
+  KEY `app_name` (`app_name`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `canary`
+--
+
+DROP TABLE IF EXISTS `canary`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `canary` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `app_name` varchar(255) NOT NULL,
+  `sub_app` varchar(255) NOT NULL DEFAULT '',
+  `stable` varchar(255) NOT NULL,
+  `canary` varchar(255) NOT NULL,
+  `weight` int(11) NOT NULL,
+  `status` varchar(255) NOT NULL,
+  `created` datetime NOT NULL,
+  `updated` datetime NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `app_sub_app` (`app_name`,`sub_app`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `certificate`
+--
+
+DROP TABLE IF EXISTS `certificate`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `certificate` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `domain` varchar(255) NOT NULL,
+  `cert` text NOT NULL,
+  `key` text NOT NULL,
+  `source` varchar(255) NOT NULL,
+  `expires` datetime NOT NULL,
+  `created` datetime NOT NULL,
+  `updated` datetime NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `domain` (`domain`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
 --
 -- Table structure for table `container`
 --
@@ -67,6 +135,17 @@ CREATE TABLE `container` (
   `host_id` int(11) NOT NULL,
   `app_name` varchar(255) NOT NULL DEFAULT '',
   `version` varchar(255) NOT NULL,
+  `entrypoint` varchar(255) NOT NULL DEFAULT '',
+  `env` varchar(255) NOT NULL DEFAULT 'prod',
+  `health` varchar(255) NOT NULL DEFAULT '',
+  `health_failures` int(11) NOT NULL DEFAULT '0',
+  `health_message` varchar(255) NOT NULL DEFAULT '',
+  `health_checked` datetime DEFAULT NULL,
+  `created` datetime NOT NULL,
+  `stopping` tinyint(1) NOT NULL DEFAULT '0',
+  `memory` int(11) NOT NULL DEFAULT '0',
+  `cpu_share` int(11) NOT NULL DEFAULT '0',
+  `restarts` int(11) NOT NULL DEFAULT '0',
   PRIMARY KEY (`id`),
   KEY `container_container_id` (`container_id`),
   KEY `hav` (`host_id`,`app_name`,`version`),
@@ -74,6 +153,133 @@ CREATE TABLE `container` (
 ) ENGINE=InnoDB AUTO_INCREMENT=635 DEFAULT CHARSET=utf8;
 /*!40101 SET character_set_client = @saved_cs_client */;
 
+--
+-- Table structure for table `container_port`
+--
+
+DROP TABLE IF EXISTS `container_port`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `container_port` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `container_id` varchar(255) NOT NULL,
+  `name` varchar(255) NOT NULL,
+  `port` int(11) NOT NULL,
+  `bind` int(11) NOT NULL,
+  `protocol` varchar(16) NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `container_id_name` (`container_id`,`name`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `core`
+--
+
+DROP TABLE IF EXISTS `core`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `core` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `host_id` int(11) NOT NULL,
+  `core` int(11) NOT NULL,
+  `exclusive` tinyint(1) NOT NULL DEFAULT '0',
+  `job_id` int(11) NOT NULL DEFAULT '0',
+  `container_id` varchar(255) NOT NULL DEFAULT '',
+  PRIMARY KEY (`id`),
+  KEY `host_id` (`host_id`),
+  KEY `job_id` (`job_id`),
+  KEY `container_id` (`container_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `deployment`
+--
+
+DROP TABLE IF EXISTS `deployment`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `deployment` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `app_name` varchar(255) NOT NULL,
+  `version` varchar(255) NOT NULL,
+  `sub_app` varchar(255) NOT NULL DEFAULT '',
+  `replicas` int(11) NOT NULL DEFAULT '0',
+  `daemons` int(11) NOT NULL DEFAULT '0',
+  `env` varchar(255) NOT NULL DEFAULT 'prod',
+  `created` datetime NOT NULL,
+  `updated` datetime NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `app_sub_app_env` (`app_name`,`sub_app`,`env`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `domain`
+--
+
+DROP TABLE IF EXISTS `domain`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `domain` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `name` varchar(255) NOT NULL,
+  `app_name` varchar(255) NOT NULL,
+  `sub_app` varchar(255) NOT NULL DEFAULT '',
+  `created` datetime NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `name` (`name`),
+  KEY `idx_app` (`app_name`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `env_var`
+--
+
+DROP TABLE IF EXISTS `env_var`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `env_var` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `app_name` varchar(255) NOT NULL,
+  `env` varchar(255) NOT NULL DEFAULT '',
+  `name` varchar(255) NOT NULL,
+  `value` text NOT NULL,
+  `secret` tinyint(1) NOT NULL DEFAULT '0',
+  `ref` varchar(255) NOT NULL DEFAULT '',
+  `created` datetime NOT NULL,
+  `updated` datetime NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `app_env_name` (`app_name`,`env`,`name`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `event`
+--
+
+DROP TABLE IF EXISTS `event`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `event` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `app_name` varchar(255) NOT NULL,
+  `version` varchar(255) NOT NULL,
+  `sub_app` varchar(255) NOT NULL DEFAULT '',
+  `host_id` int(11) NOT NULL,
+  `container_id` varchar(255) NOT NULL,
+  `kind` varchar(255) NOT NULL,
+  `exit_code` int(11) NOT NULL,
+  `action` varchar(255) NOT NULL,
+  `message` varchar(255) NOT NULL DEFAULT '',
+  `created` datetime NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `app_version_action` (`app_name`,`version`,`sub_app`,`action`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
 --
 -- Table structure for table `host`
 --
@@ -86,6 +292,17 @@ CREATE TABLE `host` (
   `ip` varchar(255) NOT NULL,
   `name` varchar(255) NOT NULL,
   `status` tinyint(3) NOT NULL DEFAULT '0',
+  `cores` int(11) NOT NULL DEFAULT '0',
+  `memory` bigint(20) NOT NULL DEFAULT '0',
+  `disk` bigint(20) NOT NULL DEFAULT '0',
+  `docker` varchar(255) NOT NULL DEFAULT '',
+  `kernel` varchar(255) NOT NULL DEFAULT '',
+  `labels` text NOT NULL,
+  `reported` datetime DEFAULT NULL,
+  `user_labels` text NOT NULL,
+  `cordoned` tinyint(1) NOT NULL DEFAULT '0',
+  `drain` varchar(255) NOT NULL DEFAULT '',
+  `drain_message` varchar(255) NOT NULL DEFAULT '',
   PRIMARY KEY (`id`),
   UNIQUE KEY `ip` (`ip`)
 ) ENGINE=InnoDB AUTO_INCREMENT=9 DEFAULT CHARSET=utf8;
@@ -106,6 +323,7 @@ CREATE TABLE `job` (
   `succ` int(11) NOT NULL,
   `kind` int(11) NOT NULL,
   `result` varchar(255) NOT NULL,
+  `ingress` varchar(1024) NOT NULL DEFAULT '',
   `created` datetime NOT NULL,
   `finished` datetime NOT NULL,
   PRIMARY KEY (`id`),
@@ -113,6 +331,27 @@ CREATE TABLE `job` (
 ) ENGINE=InnoDB AUTO_INCREMENT=210 DEFAULT CHARSET=utf8;
 /*!40101 SET character_set_client = @saved_cs_client */;
 
+--
+-- Table structure for table `listener`
+--
+
+DROP TABLE IF EXISTS `listener`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `listener` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `app_name` varchar(255) NOT NULL,
+  `sub_app` varchar(255) NOT NULL DEFAULT '',
+  `env` varchar(255) NOT NULL,
+  `protocol` varchar(16) NOT NULL,
+  `port` int(11) NOT NULL,
+  `created` datetime NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `port` (`port`),
+  UNIQUE KEY `app_sub_app_env` (`app_name`,`sub_app`,`env`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
 --
 -- Table structure for table `port`
 --
@@ -129,6 +368,63 @@ CREATE TABLE `port` (
 ) ENGINE=InnoDB AUTO_INCREMENT=679 DEFAULT CHARSET=utf8;
 /*!40101 SET character_set_client = @saved_cs_client */;
 
+--
+-- Table structure for table `queued_task`
+--
+
+DROP TABLE IF EXISTS `queued_task`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `queued_task` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `job_id` int(11) NOT NULL,
+  `host` varchar(255) NOT NULL,
+  `uuid` varchar(255) NOT NULL DEFAULT '',
+  `type` int(11) NOT NULL,
+  `status` int(11) NOT NULL,
+  `container` varchar(255) NOT NULL DEFAULT '',
+  `content` longtext NOT NULL,
+  `created` datetime NOT NULL,
+  `updated` datetime NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `job_id` (`job_id`),
+  KEY `host_status` (`host`,`status`),
+  KEY `uuid` (`uuid`),
+  KEY `container` (`container`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `rollout`
+--
+
+DROP TABLE IF EXISTS `rollout`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `rollout` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `app_name` varchar(255) NOT NULL,
+  `from_version` varchar(255) NOT NULL,
+  `to_version` varchar(255) NOT NULL,
+  `status` varchar(255) NOT NULL,
+  `batch_size` int(11) NOT NULL,
+  `pause` int(11) NOT NULL,
+  `health` varchar(255) NOT NULL DEFAULT '',
+  `health_path` varchar(255) NOT NULL DEFAULT '',
+  `timeout` int(11) NOT NULL,
+  `total` int(11) NOT NULL,
+  `upgraded` int(11) NOT NULL DEFAULT '0',
+  `batch` int(11) NOT NULL DEFAULT '0',
+  `task_ids` longtext NOT NULL,
+  `steps` longtext NOT NULL,
+  `message` varchar(255) NOT NULL DEFAULT '',
+  `created` datetime NOT NULL,
+  `updated` datetime NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `app_name` (`app_name`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
 --
 -- Table structure for table `user`
 --
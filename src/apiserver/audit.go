@@ -0,0 +1,106 @@
+package apiserver
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"types"
+	"utils"
+)
+
+// 这些字段的值不记
+var secretWords = []string{"password", "passwd", "secret", "token", "dsn", "key"}
+
+func redact(form url.Values) string {
+	params := map[string]interface{}{}
+	// 设置 secret 环境变量的时候 value 也不记
+	secret := form.Get("secret") == "true"
+	for key, values := range form {
+		// pat 把路由里的参数也塞进来了, 已经记在 path 里
+		if strings.HasPrefix(key, ":") {
+			continue
+		}
+		lower := strings.ToLower(key)
+		if secret && lower == "value" {
+			values = []string{"******"}
+		}
+		for _, word := range secretWords {
+			if strings.Contains(lower, word) {
+				values = []string{"******"}
+				break
+			}
+		}
+		if len(values) == 1 {
+			params[key] = values[0]
+		} else {
+			params[key] = values
+		}
+	}
+	r, _ := utils.JSONEncode(params)
+	return r
+}
+
+// 从 handler 的返回里拿结果和任务 id
+func auditResult(result interface{}) (string, string, string) {
+	outcome := types.AUDIT_OK
+	if s, ok := result.(StatusJSON); ok {
+		switch s.Status {
+		case 401:
+			outcome = types.AUDIT_UNAUTHORIZED
+		case 403:
+			outcome = types.AUDIT_FORBIDDEN
+		default:
+			outcome = types.AUDIT_FAIL
+		}
+		result = s.Body
+	}
+	j, ok := result.(JSON)
+	if !ok {
+		return outcome, "", ""
+	}
+	if r, _ := j["r"].(int); r != 0 && outcome == types.AUDIT_OK {
+		outcome = types.AUDIT_FAIL
+	}
+	message := ""
+	if msg, exists := j["msg"]; exists {
+		message = fmt.Sprint(msg)
+	}
+	ids := []string{}
+	if id, exists := j["task_id"]; exists {
+		ids = append(ids, fmt.Sprint(id))
+	}
+	if taskIds, ok := j["task_ids"].([]int); ok {
+		for _, id := range taskIds {
+			ids = append(ids, fmt.Sprint(id))
+		}
+	}
+	return outcome, message, strings.Join(ids, ",")
+}
+
+// 写操作都过一遍, 认证失败的也要记
+func AuditWrapper(action string, f func(*Request) interface{}) func(*Request) interface{} {
+	return func(req *Request) interface{} {
+		result := f(req)
+		outcome, message, taskIDs := auditResult(result)
+		appname := req.URL.Query().Get(":app")
+		if appname == "" {
+			appname = req.URL.Query().Get(":projectname")
+		}
+		a := &types.Audit{
+			User:    req.User,
+			Action:  action,
+			Path:    req.URL.Path,
+			AppName: appname,
+			Version: req.URL.Query().Get(":version"),
+			Params:  redact(req.Form),
+			TaskIDs: taskIDs,
+			Outcome: outcome,
+			Message: message,
+		}
+		if types.NewAudit(a) == nil {
+			utils.Logger.Info("audit not inserted: ", action, " ", req.URL.Path)
+		}
+		return result
+	}
+}
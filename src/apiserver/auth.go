@@ -0,0 +1,113 @@
+package apiserver
+
+import (
+	"crypto/hmac"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"config"
+	"types"
+	"utils"
+)
+
+const signatureWindow = 5 * time.Minute
+
+var (
+	NoCredential     = errors.New("no credential")
+	InvalidToken     = errors.New("invalid token")
+	InvalidSignature = errors.New("invalid signature")
+	ExpiredSignature = errors.New("signature expired")
+)
+
+// 需要返回非 200 的时候用这个
+type StatusJSON struct {
+	Status int
+	Body   JSON
+}
+
+func Unauthorized(err error) StatusJSON {
+	return StatusJSON{401, JSON{"r": 1, "msg": err.Error()}}
+}
+
+func Forbidden(msg string) StatusJSON {
+	return StatusJSON{403, JSON{"r": 1, "msg": msg}}
+}
+
+// 没打开 auth 的时候还是 NBEBot
+// 打开了之后要么带 NBE-Token, 是配置里的 token
+// 要么带 NBE-User, NBE-Timestamp, NBE-Signature, 是前面的 proxy 用 secret 签的
+// signature = hex(hmac-sha256(secret, "user|timestamp"))
+func authenticate(r *http.Request) (string, error) {
+	if !config.Config.Auth.Enable {
+		return "NBEBot", nil
+	}
+	if token := r.Header.Get("NBE-Token"); token != "" {
+		user, exists := config.Config.Auth.Tokens[token]
+		if !exists {
+			return "", InvalidToken
+		}
+		return user, nil
+	}
+	user := r.Header.Get("NBE-User")
+	if user == "" {
+		return "", NoCredential
+	}
+	if config.Config.Auth.Secret == "" {
+		return "", InvalidSignature
+	}
+	ts := r.Header.Get("NBE-Timestamp")
+	sent, err := hex.DecodeString(r.Header.Get("NBE-Signature"))
+	if err != nil || !hmac.Equal(sent, utils.HMACSign(config.Config.Auth.Secret, user, ts)) {
+		return "", InvalidSignature
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return "", InvalidSignature
+	}
+	if d := time.Since(time.Unix(unix, 0)); d > signatureWindow || d < -signatureWindow {
+		return "", ExpiredSignature
+	}
+	return user, nil
+}
+
+// 写操作要先登录, 如果能找到 app 还要是 app 的 release manager
+func AuthWrapper(f func(*Request) interface{}) func(*Request) interface{} {
+	return func(req *Request) interface{} {
+		if req.AuthError != nil {
+			return Unauthorized(req.AuthError)
+		}
+		if types.IsAdmin(req.User) {
+			return f(req)
+		}
+		name := req.URL.Query().Get(":app")
+		if name == "" {
+			// 注册版本的路由用的是 :projectname
+			name = req.URL.Query().Get(":projectname")
+		}
+		if cid := req.URL.Query().Get(":cid"); name == "" && cid != "" {
+			if c := types.GetContainerByCid(cid); c != nil {
+				name = c.AppName
+			}
+		}
+		if name != "" {
+			if app := types.GetApplication(name); app != nil && !app.IsManager(req.User) {
+				return Forbidden(fmt.Sprintf("%s is not release manager of %s", req.User, name))
+			}
+		}
+		return f(req)
+	}
+}
+
+// 机器相关的操作只有 admin 能做, 没打开 auth 的时候不管
+func AdminWrapper(f func(*Request) interface{}) func(*Request) interface{} {
+	return func(req *Request) interface{} {
+		if config.Config.Auth.Enable && !types.IsAdmin(req.User) {
+			return Forbidden(fmt.Sprintf("%s is not admin", req.User))
+		}
+		return f(req)
+	}
+}
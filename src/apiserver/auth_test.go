@@ -0,0 +1,73 @@
+package apiserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"config"
+)
+
+func TestAuthenticate(t *testing.T) {
+	saved := config.Config.Auth
+	defer func() { config.Config.Auth = saved }()
+	config.Config.Auth = config.AuthConfig{
+		Enable: true,
+		Secret: "s3cret",
+		Tokens: map[string]string{"tok": "alice"},
+	}
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Add(-2*signatureWindow).Unix(), 10)
+	sign := func(secret, user, ts string) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(user + "|" + ts))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+
+	cases := []struct {
+		name    string
+		headers map[string]string
+		user    string
+		err     error
+	}{
+		{"no credential", nil, "", NoCredential},
+		{"token", map[string]string{"NBE-Token": "tok"}, "alice", nil},
+		{"bad token", map[string]string{"NBE-Token": "nope"}, "", InvalidToken},
+		{"signature", map[string]string{"NBE-User": "bob", "NBE-Timestamp": now, "NBE-Signature": sign("s3cret", "bob", now)}, "bob", nil},
+		{"wrong secret", map[string]string{"NBE-User": "bob", "NBE-Timestamp": now, "NBE-Signature": sign("other", "bob", now)}, "", InvalidSignature},
+		{"other user", map[string]string{"NBE-User": "eve", "NBE-Timestamp": now, "NBE-Signature": sign("s3cret", "bob", now)}, "", InvalidSignature},
+		{"not hex", map[string]string{"NBE-User": "bob", "NBE-Timestamp": now, "NBE-Signature": "zz"}, "", InvalidSignature},
+		{"bad timestamp", map[string]string{"NBE-User": "bob", "NBE-Timestamp": "x", "NBE-Signature": sign("s3cret", "bob", "x")}, "", InvalidSignature},
+		{"expired", map[string]string{"NBE-User": "bob", "NBE-Timestamp": old, "NBE-Signature": sign("s3cret", "bob", old)}, "", ExpiredSignature},
+	}
+	for _, c := range cases {
+		r, _ := http.NewRequest("GET", "/", nil)
+		for k, v := range c.headers {
+			r.Header.Set(k, v)
+		}
+		user, err := authenticate(r)
+		if user != c.user || err != c.err {
+			t.Errorf("%s: authenticate = %q, %v, want %q, %v", c.name, user, err, c.user, c.err)
+		}
+	}
+
+	// 没配 secret 的时候签名一律不认
+	config.Config.Auth.Secret = ""
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("NBE-User", "bob")
+	r.Header.Set("NBE-Timestamp", now)
+	r.Header.Set("NBE-Signature", sign("", "bob", now))
+	if _, err := authenticate(r); err != InvalidSignature {
+		t.Errorf("empty secret: err = %v, want %v", err, InvalidSignature)
+	}
+
+	config.Config.Auth.Enable = false
+	if user, err := authenticate(r); user != "NBEBot" || err != nil {
+		t.Errorf("auth disabled: authenticate = %q, %v", user, err)
+	}
+}
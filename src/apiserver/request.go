@@ -8,9 +8,10 @@ import (
 
 type Request struct {
 	http.Request
-	Start int
-	Limit int
-	User  string
+	Start     int
+	Limit     int
+	User      string
+	AuthError error
 }
 
 // parse start, limit for data
@@ -18,13 +19,11 @@ func (r *Request) Init() {
 	r.ParseForm()
 	r.Start = utils.Atoi(r.Form.Get("start"), 0)
 	r.Limit = utils.Atoi(r.Form.Get("limit"), 20)
-	// 先删掉这个, 暂时没有接
-	// r.User = r.Header.Get("NBE-User")
-	r.User = "NBEBot"
+	r.User, r.AuthError = authenticate(&r.Request)
 }
 
 func NewRequest(r *http.Request) *Request {
-	req := &Request{*r, 0, 20, ""}
+	req := &Request{*r, 0, 20, "", nil}
 	req.Init()
 	return req
 }
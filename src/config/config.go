@@ -27,6 +27,22 @@ type TaskConfig struct {
 	Memory    int
 	CpuShare  int
 	CpuSet    string
+	// use_cpu_set 打开的时候每个容器绑几个核, 是不是独占
+	Cores          int
+	ExclusiveCores bool `yaml:"exclusive_cores"`
+	// app.yaml 里 resources 能写的上限, 0 表示不限制
+	MaxMemory   int   `yaml:"max_memory"`
+	MaxCpuShare int   `yaml:"max_cpushare"`
+	MaxCores    int   `yaml:"max_cores"`
+	MaxDisk     int64 `yaml:"max_disk"`
+	// 删容器之前从 nginx 摘掉之后等几秒, SIGTERM 之后等几秒再 kill
+	StopDrain int `yaml:"stop_drain"`
+	StopGrace int `yaml:"stop_grace"`
+	// 容器挂了重启之前等几秒, 同一个容器每挂一次翻倍, 最多等 max 秒
+	RestartBackoff    int `yaml:"restart_backoff"`
+	RestartBackoffMax int `yaml:"restart_backoff_max"`
+	// 任务队列里做完了的记录留几个小时, 默认 72
+	QueueRetention int `yaml:"queue_retention"`
 }
 
 type NginxConfig struct {
@@ -43,6 +59,26 @@ type NginxConfig struct {
 	ServerTemplate  string `yaml:"server_template"`
 	LocalServerDir  string `yaml:"local_server_dir"`
 	RemoteServerDir string `yaml:"remote_server_dir"`
+
+	// 改了的配置先放在这里和 conf 一起 nginx -t, 过了才换上去, 不写就是临时目录
+	StagingDir string `yaml:"staging_dir"`
+	// app 的证书写在这里, nginx 那边也是这个目录
+	CertDir string `yaml:"cert_dir"`
+
+	// tcp/udp 的 app 写在 stream 里, conf 要在 stream {} 里 include 这个目录
+	StreamTemplate  string `yaml:"stream_template"`
+	LocalStreamDir  string `yaml:"local_stream_dir"`
+	RemoteStreamDir string `yaml:"remote_stream_dir"`
+	// tcp/udp/grpc 的 app 在 master nginx 上对外的端口从这里分
+	ListenPorts PortRange `yaml:"listen_ports"`
+
+	// server_name 是 app.podname.domain, 不写就是 hunantv.com
+	Domain string
+}
+
+type PortRange struct {
+	Min int
+	Max int
 }
 
 type InfluxdbConfig struct {
@@ -52,6 +88,73 @@ type InfluxdbConfig struct {
 	Password string
 }
 
+// levi 没报容量的机器按这个算
+// memory 和 task.memory 单位一样, 0 表示不限制
+type SchedulerConfig struct {
+	Strategy string
+	Cores    int
+	Memory   int
+}
+
+// 多久看一次要不要做健康检查, 秒
+type HealthConfig struct {
+	Interval int
+}
+
+// 单位都是秒
+type ReconcileConfig struct {
+	Interval int
+	Timeout  int
+}
+
+// tokens 是 token: user
+// secret 是前面的 proxy 签 NBE-User 用的
+type AuthConfig struct {
+	Enable bool
+	Secret string
+	Tokens map[string]string
+	Admins []string
+}
+
+// dot 自己的证书, ca 用来验 levi 的客户端证书
+type TLSConfig struct {
+	Cert string
+	Key  string
+	CA   string
+}
+
+// levi 连上来的时候要么带 ca 签的客户端证书, 要么带 secret 签的 token
+type LeviAuthConfig struct {
+	Enable bool
+	Secret string
+}
+
+// prod/test 之外的环境, 用接口也可以建
+// domain 不写 server_name 就是 app.name.podname.nginx.domain
+type EnvironmentConfig struct {
+	Name   string
+	Domain string
+}
+
+// 加密 app 环境变量里 secret 的 key, base64 的 32 字节
+type SecretsConfig struct {
+	Key string
+}
+
+// 本地的 ACME 替身, 用这个 ca 给 app 的域名签证书, 不写 ca 就签自签名的
+// days 是证书的有效天数, 默认 90
+type AcmeConfig struct {
+	CA    string
+	CAKey string `yaml:"ca_key"`
+	Days  int
+}
+
+type ElectionConfig struct {
+	Key       string
+	TTL       int
+	Advertise string
+}
+
 type DotConfig struct {
 	Bind       string
 	Pidfile    string
@@ -64,12 +167,25 @@ type DotConfig struct {
 	PodName    string `yaml:"podname"`
 	UseCPUSet  bool   `yaml:"use_cpu_set"`
 
-	Db       DbConfig
-	Dbmgr    DbConfig
-	Etcd     EtcdConfig
-	Task     TaskConfig
-	Nginx    NginxConfig
-	Influxdb InfluxdbConfig
+	Db        DbConfig
+	Dbmgr     DbConfig
+	Etcd      EtcdConfig
+	Task      TaskConfig
+	Nginx     NginxConfig
+	Influxdb  InfluxdbConfig
+	Election  ElectionConfig
+	Scheduler SchedulerConfig
+	Reconcile ReconcileConfig
+	Health    HealthConfig
+	Auth      AuthConfig
+	TLS       TLSConfig
+	LeviAuth  LeviAuthConfig `yaml:"levi_auth"`
+	Secrets   SecretsConfig
+	Acme      AcmeConfig
+
+	Environments []EnvironmentConfig
+	// nginx 或者 fake
+	Ingress string
 }
 
 var Config = DotConfig{}
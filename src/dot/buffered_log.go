@@ -110,6 +110,9 @@ func ServeLogWS(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", 405)
 		return
 	}
+	if redirectToLeader(w, r) {
+		return
+	}
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		Logger.Info(err)
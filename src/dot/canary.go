@@ -0,0 +1,103 @@
+package dot
+
+import (
+	"errors"
+	"time"
+
+	"types"
+	. "utils"
+)
+
+// 流量全切到 canary, 然后把老版本的容器升级成 canary 的版本, 容器数不变
+// 有 deployment 的时候改 deployment 的版本, 让 reconciler 去升级
+// canary 只管 prod 环境
+func PromoteCanary(canary *types.Canary) ([]int, error) {
+	av := types.GetVersion(canary.AppName, canary.Canary)
+	if av == nil {
+		return nil, errors.New("canary version not found")
+	}
+	canary.SetStatus(types.CANARY_PROMOTING, 100)
+	defer LeviHub.RefreshNginx(av.ID, canary.SubApp)
+	stable := func(c *types.Container) bool { return c.Version != canary.Canary }
+	go finishCanary(canary, av.ID, stable)
+
+	if d := types.GetDeployment(canary.AppName, canary.SubApp, types.ENV_PROD); d != nil {
+		if types.SetDeployment(av, canary.SubApp, types.ENV_PROD, d.Replicas, d.Daemons) == nil {
+			return nil, errors.New("save deployment failed")
+		}
+		Reconciler.Trigger()
+		return []int{}, nil
+	}
+	// 和 update 一样, 新的起来了再删老的
+	return dispatchWeb(canary, stable, func(c *types.Container) *types.Task {
+		return types.UpdateContainerTask(c, av)
+	})
+}
+
+// 流量全切回 stable, 然后删掉 canary 的容器
+func AbortCanary(canary *types.Canary) ([]int, error) {
+	av := types.GetVersion(canary.AppName, canary.Stable)
+	if av == nil {
+		return nil, errors.New("stable version not found")
+	}
+	canary.SetStatus(types.CANARY_ABORTING, 0)
+	defer LeviHub.RefreshNginx(av.ID, canary.SubApp)
+	fresh := func(c *types.Container) bool { return c.Version == canary.Canary }
+	go finishCanary(canary, av.ID, fresh)
+	return dispatchWeb(canary, fresh, types.RemoveContainerTask)
+}
+
+// 被摘掉的那边都删完了 canary 才算结束, 删掉之后再刷一次 nginx 把 weight 去掉
+// 这期间又设了新的 canary 就不管了
+func finishCanary(canary *types.Canary, avID int, match func(*types.Container) bool) {
+	deadline := time.Now().Add(Reconciler.timeout())
+	for len(webContainers(canary, match)) > 0 {
+		if time.Now().After(deadline) {
+			Logger.Info("canary ", canary.AppName, " ", canary.Status, " timeout")
+			return
+		}
+		time.Sleep(time.Second)
+	}
+	c := types.GetCanary(canary.AppName, canary.SubApp)
+	if c == nil || c.Canary != canary.Canary || c.Status != canary.Status {
+		return
+	}
+	c.Delete()
+	LeviHub.RefreshNginx(avID, canary.SubApp)
+}
+
+func webContainers(canary *types.Canary, match func(*types.Container) bool) []*types.Container {
+	cs := []*types.Container{}
+	app := types.GetApplication(canary.AppName)
+	if app == nil {
+		return cs
+	}
+	for _, c := range app.Containers() {
+		if c.SubApp == canary.SubApp && c.Env == types.ENV_PROD && c.Port != 0 && match(c) {
+			cs = append(cs, c)
+		}
+	}
+	return cs
+}
+
+// 只动有端口的, daemon 不接流量不管
+func dispatchWeb(canary *types.Canary, match func(*types.Container) bool, newTask func(*types.Container) *types.Task) ([]int, error) {
+	var err error
+	taskIds := []int{}
+	if types.GetApplication(canary.AppName) == nil {
+		return taskIds, errors.New("app not found")
+	}
+	for _, c := range webContainers(canary, match) {
+		host := c.Host()
+		task := newTask(c)
+		if host == nil || task == nil {
+			err = errors.New("task created error")
+			continue
+		}
+		taskIds = append(taskIds, task.ID)
+		if e := LeviHub.Dispatch(host.IP, task); e != nil {
+			err = e
+		}
+	}
+	return taskIds, err
+}
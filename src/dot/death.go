@@ -0,0 +1,87 @@
+package dot
+
+import (
+	"fmt"
+	"time"
+
+	"scheduler"
+	"types"
+	. "utils"
+)
+
+// levi 报上来容器挂了
+// 删掉记录释放端口, 刷 nginx, 然后按照 app.yaml 里的 restart 决定要不要再起一个
+// 每次都记一条 event
+func onContainerDie(host *types.Host, c *types.Container, exitCode int) {
+	// remove/update 任务自己弄死的
+	if types.IsContainerRemoving(c.ContainerID) {
+		Logger.Debug("container ", c.ContainerID, " is being removed, ignore")
+		return
+	}
+	av := c.AppVersion()
+	if av == nil {
+		c.Delete()
+		types.NewEvent(c, types.EVENT_DIE, exitCode, types.ACTION_REMOVED, "version not found")
+		return
+	}
+	// 测试容器跑完了就是会死的, doTest 会处理
+	if job := types.GetJobByAppAndRet(av, c.ContainerID); job != nil && job.Kind == types.TESTAPPLICATION {
+		return
+	}
+
+	appyaml, err := av.GetSubAppYaml(c.SubApp)
+	c.Delete()
+	LeviHub.done <- &NInfo{av.ID, c.SubApp, nil}
+
+	// 一直挂的容器越等越久, 跑得比下一次要等的还久就从头算, max_retries 也一样
+	restarts := c.Restarts
+	if time.Since(c.Created) > types.RestartBackoff(restarts+1) {
+		restarts = 0
+	}
+	action, message := types.ACTION_REMOVED, ""
+	switch {
+	case types.GetDeployment(c.AppName, c.SubApp, c.Env) != nil:
+		// deployment 管着的让 reconciler 去补
+		action = types.ACTION_RECONCILED
+		Reconciler.Trigger()
+	case err != nil:
+		message = err.Error()
+	case appyaml.Restart.ShouldRestart(exitCode, restarts):
+		delay := types.RestartBackoff(restarts)
+		action, message = types.ACTION_RESTARTED, fmt.Sprintf("restart in %s", delay)
+		// dot 在这期间重启了的话就不会再起了
+		time.AfterFunc(delay, func() {
+			if !Elector.IsLeader() {
+				return
+			}
+			if err := restartContainer(av, host, appyaml, c, restarts+1); err != nil {
+				Logger.Info("restart container ", c.ContainerID, " of ", c.AppName, " error: ", err)
+			}
+		})
+	default:
+		message = "restart policy: " + appyaml.Restart.Policy
+	}
+	Logger.Info("container ", c.ContainerID, " of ", c.AppName, " died, ", action, " ", message)
+	types.NewEvent(c, types.EVENT_DIE, exitCode, action, message)
+}
+
+// 原来的机器还连着并且没有 cordon 就放原来的机器上, 不然让 scheduler 重新选
+func restartContainer(av *types.AppVersion, host *types.Host, appyaml *types.AppYaml, c *types.Container, restarts int) error {
+	entrypoint, err := c.GetEntrypoint(appyaml)
+	if err != nil {
+		return err
+	}
+	if !LeviHub.HasLevi(host.IP) || host.Cordoned {
+		ps, err := scheduler.Schedule(1, "", "", !entrypoint.Daemon, appyaml.Resources.For(entrypoint.Name))
+		if err != nil {
+			return err
+		}
+		host = ps[0].Host
+	}
+	task, err := types.AddContainerTask(av, host, appyaml, entrypoint, c.Env)
+	if err != nil {
+		return err
+	}
+	task.Restarts = restarts
+	return LeviHub.Dispatch(host.IP, task)
+}
@@ -0,0 +1,219 @@
+package dot
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"scheduler"
+	"types"
+	. "utils"
+)
+
+// 这个进程里正在跑的 drain
+// 库里的 draining 在 dot 重启之后就没人管了, 以这个为准
+var drains = struct {
+	sync.Mutex
+	hosts map[int]bool
+}{hosts: map[int]bool{}}
+
+func IsDraining(hostID int) bool {
+	drains.Lock()
+	defer drains.Unlock()
+	return drains.hosts[hostID]
+}
+
+// 把一台机器上的容器都挪走
+// 先 cordon, 然后一个 app 一个 app 地挪, 挪完了标成 drained
+// minAvailable 是每个 app 至少要留几个能用的容器, 到了下限就先起新的再删老的
+func StartDrain(host *types.Host, minAvailable, timeout int) error {
+	if minAvailable < 0 {
+		return errors.New("min_available must not be negative")
+	}
+	if timeout <= 0 {
+		timeout = defaultRolloutTimeout
+	}
+	drains.Lock()
+	if drains.hosts[host.ID] {
+		drains.Unlock()
+		return errors.New("host is draining")
+	}
+	drains.hosts[host.ID] = true
+	drains.Unlock()
+	host.Cordon(true)
+	host.SetDrain(types.HOST_DRAINING, "")
+	go runDrain(host, minAvailable, time.Duration(timeout)*time.Second)
+	return nil
+}
+
+func runDrain(host *types.Host, minAvailable int, timeout time.Duration) {
+	defer func() {
+		drains.Lock()
+		delete(drains.hosts, host.ID)
+		drains.Unlock()
+	}()
+	groups := map[string][]*types.Container{}
+	keys := []string{}
+	for _, c := range host.Containers() {
+		key := fmt.Sprintf("%s:%s:%s:%s:%s:%v", c.AppName, c.Version, c.SubApp, c.Env, c.Entrypoint, c.IdentID != "")
+		if _, exists := groups[key]; !exists {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], c)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		// 不是 leader 了就停下, 状态留着给新的 leader 去标
+		if !Elector.IsLeader() {
+			Logger.Info("drain ", host.IP, " stopped before ", key, ": ", NotLeader)
+			return
+		}
+		if err := drainGroup(host, groups[key], minAvailable, timeout); err != nil {
+			Logger.Info("drain ", host.IP, " ", key, " failed: ", err)
+			host.SetDrain(types.HOST_DRAIN_FAILED, fmt.Sprintf("%s: %s", key, err))
+			return
+		}
+	}
+	host.SetDrain(types.HOST_DRAINED, "")
+}
+
+// dot 重启或者换了 leader 的时候没跑完的 drain 都算失败, 要的话重新 drain 一次
+// reason 写进 drain_message
+func ResetDrains(reason string) {
+	for _, host := range types.GetDrainingHosts() {
+		if !IsDraining(host.ID) {
+			host.SetDrain(types.HOST_DRAIN_FAILED, reason)
+		}
+	}
+}
+
+// 同一个 app/version/sub app/环境/entrypoint 的容器
+func drainGroup(host *types.Host, cs []*types.Container, minAvailable int, timeout time.Duration) error {
+	av := cs[0].AppVersion()
+	if av == nil {
+		// 版本都没了, 直接删
+		return removeAll(host, cs, timeout)
+	}
+	// 测试容器跑完了自己会删
+	if job := types.GetJobByAppAndRet(av, cs[0].ContainerID); job != nil && job.Kind == types.TESTAPPLICATION {
+		return nil
+	}
+	appyaml, err := av.GetSubAppYaml(cs[0].SubApp)
+	if err != nil {
+		return err
+	}
+	entrypoint, err := cs[0].GetEntrypoint(appyaml)
+	if err != nil {
+		return err
+	}
+
+	for len(cs) > 0 {
+		n := available(cs[0]) - minAvailable
+		if n < 1 {
+			// 已经到下限了, 先起一个新的再删老的
+			if err := addReplicas(av, appyaml, entrypoint, cs[0].Env, 1, timeout); err != nil {
+				return err
+			}
+			if err := removeAll(host, cs[:1], timeout); err != nil {
+				return err
+			}
+			cs = cs[1:]
+			continue
+		}
+		if n > len(cs) {
+			n = len(cs)
+		}
+		if err := removeAll(host, cs[:n], timeout); err != nil {
+			return err
+		}
+		if err := addReplicas(av, appyaml, entrypoint, cs[0].Env, n, timeout); err != nil {
+			return err
+		}
+		cs = cs[n:]
+	}
+	return nil
+}
+
+// 在线机器上和 like 一样的容器还有几个
+func available(like *types.Container) int {
+	av := like.AppVersion()
+	if av == nil {
+		return 0
+	}
+	count := 0
+	for _, c := range av.Containers() {
+		if c.SubApp != like.SubApp || c.Env != like.Env || c.Entrypoint != like.Entrypoint || (c.IdentID != "") != (like.IdentID != "") {
+			continue
+		}
+		if h := c.Host(); h != nil && h.Status == 0 {
+			count = count + 1
+		}
+	}
+	return count
+}
+
+// 让 scheduler 找 n 个地方起新容器, 等它们都起来
+// cordon 过的机器 scheduler 不会选
+func addReplicas(av *types.AppVersion, appyaml *types.AppYaml, entrypoint *types.Entrypoint, env string, n int, timeout time.Duration) error {
+	ps, err := scheduler.Schedule(n, "", "", !entrypoint.Daemon, appyaml.Resources.For(entrypoint.Name))
+	if err != nil {
+		return err
+	}
+	type sent struct {
+		host *types.Host
+		task *types.Task
+	}
+	tasks := []*sent{}
+	for i := 0; i < n; i = i + 1 {
+		host := ps[i].Host
+		task, err := types.AddContainerTask(av, host, appyaml, entrypoint, env)
+		if err != nil {
+			return err
+		}
+		if err := LeviHub.Dispatch(host.IP, task); err != nil {
+			return err
+		}
+		tasks = append(tasks, &sent{host, task})
+	}
+	for _, s := range tasks {
+		if _, err := waitContainer(s.host, av, s.task, timeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 发 remove 任务, 等 levi 都回了
+func removeAll(host *types.Host, cs []*types.Container, timeout time.Duration) error {
+	ids := []int{}
+	for _, c := range cs {
+		task := types.RemoveContainerTask(c)
+		if task == nil {
+			return errors.New("task created error")
+		}
+		if err := LeviHub.Dispatch(host.IP, task); err != nil {
+			return err
+		}
+		ids = append(ids, task.ID)
+	}
+	deadline := time.Now().Add(timeout)
+	for _, id := range ids {
+		for {
+			job := types.GetJob(id)
+			if job != nil && job.Status == types.DONE {
+				if job.Succ == types.FAIL {
+					return fmt.Errorf("task %d failed: %s", id, job.Result)
+				}
+				break
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("task %d timeout", id)
+			}
+			time.Sleep(time.Second)
+		}
+	}
+	return nil
+}
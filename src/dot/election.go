@@ -0,0 +1,153 @@
+package dot
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"time"
+
+	"config"
+	"types"
+	. "utils"
+)
+
+const defaultElectionTTL = 10
+
+var Elector = &Election{}
+
+// 多个 dot 同时跑的时候通过 etcd 选一个 leader
+// 只有 leader 接 levi, 重启 nginx, 写 DNS
+// 没有配置 election.key 的时候就是原来的单点模式, 自己永远是 leader
+type Election struct {
+	sync.RWMutex
+	leader   string
+	isLeader bool
+}
+
+func (self *Election) enabled() bool {
+	return config.Config.Election.Key != ""
+}
+
+func (self *Election) ttl() uint64 {
+	if config.Config.Election.TTL <= 0 {
+		return defaultElectionTTL
+	}
+	return uint64(config.Config.Election.TTL)
+}
+
+// 自己的地址, 别的 dot 会把写请求和 levi 转到这里
+func (self *Election) id() string {
+	if config.Config.Election.Advertise != "" {
+		return config.Config.Election.Advertise
+	}
+	return config.Config.Bind
+}
+
+func (self *Election) IsLeader() bool {
+	if !self.enabled() {
+		return true
+	}
+	self.RLock()
+	defer self.RUnlock()
+	return self.isLeader
+}
+
+func (self *Election) Leader() string {
+	if !self.enabled() {
+		return self.id()
+	}
+	self.RLock()
+	defer self.RUnlock()
+	return self.leader
+}
+
+func (self *Election) set(isLeader bool, leader string) {
+	self.Lock()
+	was := self.isLeader
+	self.isLeader = isLeader
+	self.leader = leader
+	self.Unlock()
+
+	if was == isLeader {
+		return
+	}
+	if isLeader {
+		Logger.Info("became leader")
+		ResetDrains("interrupted by leader change")
+		ResumeRollouts()
+		return
+	}
+	// 不是 leader 了, 断开所有 levi, 让它们去连新的 leader
+	Logger.Info("lost leadership, new leader is ", leader)
+	LeviHub.DropLevis()
+}
+
+func (self *Election) Run() {
+	if !self.enabled() {
+		return
+	}
+	key, id, ttl := config.Config.Election.Key, self.id(), self.ttl()
+	for !LeviHub.finished {
+		isLeader, err := types.CampaignLeader(key, id, ttl)
+		if err != nil {
+			Logger.Info("campaign leader error: ", err)
+		}
+		leader := id
+		if !isLeader {
+			leader = types.GetLeader(key)
+		}
+		self.set(isLeader, leader)
+		time.Sleep(time.Second * time.Duration(ttl) / 3)
+	}
+	if self.IsLeader() {
+		types.ResignLeader(key, id)
+	}
+}
+
+// 不是 leader 的时候把 websocket 请求重定向到 leader 上
+// 返回 true 说明已经处理掉了
+func redirectToLeader(w http.ResponseWriter, r *http.Request) bool {
+	if Elector.IsLeader() {
+		return false
+	}
+	leader := Elector.Leader()
+	if leader == "" {
+		http.Error(w, "No leader elected", 503)
+		return true
+	}
+	w.Header().Set("X-Dot-Leader", leader)
+	scheme := "ws"
+	if config.Config.TLS.Cert != "" {
+		scheme = "wss"
+	}
+	http.Redirect(w, r, scheme+"://"+leader+r.URL.RequestURI(), 307)
+	return true
+}
+
+// 配了证书的话 dot 之间也走 https, 对面的证书用系统的和 tls.ca 里的验
+func LeaderProxy(leader string) *httputil.ReverseProxy {
+	if config.Config.TLS.Cert == "" {
+		return httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: leader})
+	}
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "https", Host: leader})
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if ca := config.Config.TLS.CA; ca != "" {
+		if pem, err := ioutil.ReadFile(ca); err == nil {
+			pool.AppendCertsFromPEM(pem)
+		} else {
+			Logger.Info("read tls ca error: ", err)
+		}
+	}
+	proxy.Transport = &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+	}
+	return proxy
+}
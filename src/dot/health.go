@@ -0,0 +1,162 @@
+package dot
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"config"
+	"types"
+	. "utils"
+)
+
+const (
+	defaultHealthInterval = 5
+	// levi 能在容器里跑 cmd 健康检查
+	CAPABILITY_HEALTH = "health"
+)
+
+var HealthChecker = &Health{}
+
+// 定时对配了 health 的容器做 http/tcp 检查, cmd 的等 levi 报
+// 状态变了就刷 nginx, 只有 healthy 的容器进 upstream
+type Health struct{}
+
+func (self *Health) interval() time.Duration {
+	if config.Config.Health.Interval <= 0 {
+		return defaultHealthInterval * time.Second
+	}
+	return time.Duration(config.Config.Health.Interval) * time.Second
+}
+
+func (self *Health) Run() {
+	for !LeviHub.finished {
+		time.Sleep(self.interval())
+		if !Elector.IsLeader() {
+			continue
+		}
+		self.check()
+	}
+}
+
+func (self *Health) check() {
+	yamls := map[string]*types.AppYaml{}
+	appyamlOf := func(c *types.Container) *types.AppYaml {
+		key := fmt.Sprintf("%s:%s:%s", c.AppName, c.Version, c.SubApp)
+		if appyaml, exists := yamls[key]; exists {
+			return appyaml
+		}
+		var appyaml *types.AppYaml
+		if av := c.AppVersion(); av != nil {
+			appyaml, _ = av.GetSubAppYaml(c.SubApp)
+		}
+		yamls[key] = appyaml
+		return appyaml
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range types.GetHealthCheckedContainers() {
+		host := c.Host()
+		if host == nil || host.Status != 0 || types.IsContainerRemoving(c.ContainerID) {
+			continue
+		}
+		appyaml := appyamlOf(c)
+		if appyaml == nil {
+			continue
+		}
+		entrypoint, err := c.GetEntrypoint(appyaml)
+		if err != nil {
+			continue
+		}
+		h := appyaml.HealthFor(entrypoint)
+		if h == nil || time.Since(c.HealthChecked) < h.GetInterval() {
+			continue
+		}
+		if h.Type == types.HEALTH_CMD {
+			// 老的 levi 跑不了, 当它是好的
+			if levi := LeviHub.Levi(host.IP); levi != nil && !levi.Can(CAPABILITY_HEALTH) {
+				onHealth(host, appyaml, c, h, nil)
+			}
+			continue
+		}
+		wg.Add(1)
+		go func(host *types.Host, appyaml *types.AppYaml, c *types.Container, h *types.HealthCheck) {
+			defer wg.Done()
+			err := probe(h.Type, host.IP, c.Port, h.Path, h.GetTimeout())
+			onHealth(host, appyaml, c, h, err)
+		}(host, appyaml, c, h)
+	}
+	wg.Wait()
+}
+
+// levi 报上来的 cmd 检查结果
+func doHealth(host *types.Host, report *types.HealthReport) {
+	c := types.GetContainerByCid(report.Container)
+	if c == nil || c.Health == "" {
+		return
+	}
+	av := c.AppVersion()
+	if av == nil {
+		return
+	}
+	appyaml, err := av.GetSubAppYaml(c.SubApp)
+	if err != nil {
+		return
+	}
+	entrypoint, err := c.GetEntrypoint(appyaml)
+	if err != nil {
+		return
+	}
+	h := appyaml.HealthFor(entrypoint)
+	if h == nil {
+		return
+	}
+	if !report.Healthy {
+		err = errors.New(report.Message)
+	}
+	onHealth(host, appyaml, c, h, err)
+}
+
+// 状态变了刷 nginx, 变成 unhealthy 的记 event, 要 replace 的换一个
+func onHealth(host *types.Host, appyaml *types.AppYaml, c *types.Container, h *types.HealthCheck, err error) {
+	if !c.CheckedHealth(h, err) {
+		return
+	}
+	av := c.AppVersion()
+	if av != nil {
+		LeviHub.RefreshNginx(av.ID, c.SubApp)
+	}
+	if c.Health != types.HEALTH_UNHEALTHY {
+		return
+	}
+
+	action, message := types.ACTION_IGNORED, c.HealthMessage
+	if h.Replace {
+		if err := replaceContainer(av, host, appyaml, c); err != nil {
+			message = err.Error()
+		} else {
+			action = types.ACTION_REPLACED
+		}
+	}
+	Logger.Info("container ", c.ContainerID, " of ", c.AppName, " is unhealthy, ", action, " ", message)
+	types.NewEvent(c, types.EVENT_UNHEALTHY, -1, action, message)
+}
+
+// deployment 管着的删了让 reconciler 补, 不然先起一个新的再删
+func replaceContainer(av *types.AppVersion, host *types.Host, appyaml *types.AppYaml, c *types.Container) error {
+	if av != nil && types.GetDeployment(c.AppName, c.SubApp, c.Env) == nil {
+		if err := restartContainer(av, host, appyaml, c, c.Restarts); err != nil {
+			return err
+		}
+	}
+	task := types.RemoveContainerTask(c)
+	if task == nil {
+		return errors.New("task created error")
+	}
+	if err := LeviHub.Dispatch(host.IP, task); err != nil {
+		return err
+	}
+	Reconciler.Trigger()
+	return nil
+}
@@ -6,25 +6,42 @@ import (
 	"types"
 )
 
-func DeployApplicationHelper(av *types.AppVersion, hosts []*types.Host, appyaml *types.AppYaml, daemon bool) ([]int, error) {
+// 只看 env 环境里跑 entrypoint 的容器, 别的入口和环境的不动
+// 同一台机器出现几次就起几个, 已有的容器只升级一次
+func DeployApplicationHelper(av *types.AppVersion, hosts []*types.Host, appyaml *types.AppYaml, entrypoint *types.Entrypoint, env string) ([]int, error) {
 	var err error
 	taskIds := []int{}
+	seen := map[int]bool{}
 	for _, host := range hosts {
 		if host == nil {
 			continue
 		}
-		cs := types.GetContainerByHostAndAppVersion(host, av)
+		if seen[host.ID] {
+			if task, e := types.AddContainerTask(av, host, appyaml, entrypoint, env); e == nil {
+				taskIds = append(taskIds, task.ID)
+				err = LeviHub.Dispatch(host.IP, task)
+			} else {
+				err = e
+			}
+			continue
+		}
+		seen[host.ID] = true
+		cs := []*types.Container{}
+		for _, c := range types.GetContainerByHostAndAppVersionAndEnv(host, av, env) {
+			if e, _ := c.GetEntrypoint(appyaml); e != nil && e.Name == entrypoint.Name {
+				cs = append(cs, c)
+			}
+		}
 		if len(cs) == 0 {
-			task := types.AddContainerTask(av, host, appyaml, daemon, []string{})
-			if task != nil {
+			if task, e := types.AddContainerTask(av, host, appyaml, entrypoint, env); e == nil {
 				taskIds = append(taskIds, task.ID)
 				err = LeviHub.Dispatch(host.IP, task)
 			} else {
-				err = errors.New("task created error")
+				err = e
 			}
 		} else {
 			for _, c := range cs {
-				task := types.UpdateContainerTask(c, av, "")
+				task := types.UpdateContainerTask(c, av)
 				if task != nil {
 					taskIds = append(taskIds, task.ID)
 					err = LeviHub.Dispatch(host.IP, task)
@@ -52,7 +69,7 @@ func RemoveApplicationFromHostHelper(av *types.AppVersion, host *types.Host) ([]
 	return taskIds, err
 }
 
-func UpdateApplicationHelper(from, to *types.AppVersion, hosts []*types.Host, coreMap map[string]string) ([]int, error) {
+func UpdateApplicationHelper(from, to *types.AppVersion, hosts []*types.Host) ([]int, error) {
 	var err error
 	taskIds := []int{}
 	for _, host := range hosts {
@@ -62,11 +79,7 @@ func UpdateApplicationHelper(from, to *types.AppVersion, hosts []*types.Host, co
 		oldContainers := types.GetContainerByHostAndAppVersion(host, from)
 		if len(oldContainers) > 0 {
 			for _, c := range oldContainers {
-				cores, exists := coreMap[c.ContainerID]
-				if !exists {
-					cores = ""
-				}
-				task := types.UpdateContainerTask(c, to, cores)
+				task := types.UpdateContainerTask(c, to)
 				if task != nil {
 					taskIds = append(taskIds, task.ID)
 					err = LeviHub.Dispatch(host.IP, task)
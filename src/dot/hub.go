@@ -3,11 +3,12 @@ package dot
 import (
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
-	"os/exec"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -20,6 +21,10 @@ import (
 const (
 	checkAliveDuration = 60 * time.Second
 	maxMessageSize     = 1024 * 1024
+	// update 的时候最多等新容器多久再删老的
+	replaceTimeout = 300 * time.Second
+	// 升级成 websocket 之后才发现重复连接, 用 4000 以上的关闭码带上 409
+	closeConflict = 4409
 )
 
 var (
@@ -38,35 +43,49 @@ type Connection struct {
 	port int
 }
 
+// Jobs 是触发这次刷新的任务, nginx 出错的时候报给它们
 type NInfo struct {
 	ID     int
 	SubApp string
+	Jobs   []int
 }
 
 type Hub struct {
+	// 管着 levis 和 lastCheckTime
+	sync.RWMutex
 	levis         map[string]*Levi
 	lastCheckTime map[string]time.Time
 	apps          map[int][]string
+	jobs          map[int][]int
 	done          chan *NInfo
 	immediate     chan bool
 	size          int
 	finished      bool
+	ingress       Ingress
+	lastReload    *ReloadResult
 }
 
 // Hub methods
 func (self *Hub) CheckAlive() {
 	for !self.finished {
+		self.RLock()
+		stale := []string{}
 		for host, last := range self.lastCheckTime {
-			duration := time.Since(last)
 			// 如果一个连接不再存在, 那么删掉这个连接
-			if duration.Seconds() > float64(checkAliveDuration) {
-				Logger.Info(" disconnected: ", host)
-				self.RemoveLevi(host)
+			if duration := time.Since(last); duration.Seconds() > float64(checkAliveDuration) {
+				stale = append(stale, host)
 			}
 		}
-		for host, levi := range self.levis {
-			levi.conn.Ping([]byte(host))
-			Logger.Info(" check alive: ", host)
+		levis := self.all()
+		self.RUnlock()
+
+		for _, host := range stale {
+			Logger.Info(" disconnected: ", host)
+			self.RemoveLevi(host)
+		}
+		for _, levi := range levis {
+			levi.conn.Ping([]byte(levi.host))
+			Logger.Info(" check alive: ", levi.host)
 		}
 		time.Sleep(checkAliveDuration)
 	}
@@ -76,7 +95,7 @@ func (self *Hub) Run() {
 	for !self.finished {
 		select {
 		case nInfo := <-self.done:
-			self.apps[nInfo.ID] = append(self.apps[nInfo.ID], nInfo.SubApp)
+			self.collect(nInfo)
 			if len(self.apps) >= self.size {
 				Logger.Info("restart nginx on full")
 				self.RestartNginx()
@@ -87,6 +106,10 @@ func (self *Hub) Run() {
 				self.RestartNginx()
 			}
 		case <-self.immediate:
+			// 先把已经排着的收进来, select 不保证先收 done
+			for len(self.done) > 0 {
+				self.collect(<-self.done)
+			}
 			if len(self.apps) != 0 {
 				Logger.Info("restart nginx immediately")
 				self.RestartNginx()
@@ -95,7 +118,26 @@ func (self *Hub) Run() {
 	}
 }
 
+func (self *Hub) collect(nInfo *NInfo) {
+	self.apps[nInfo.ID] = append(self.apps[nInfo.ID], nInfo.SubApp)
+	self.jobs[nInfo.ID] = append(self.jobs[nInfo.ID], nInfo.Jobs...)
+}
+
+// 把攒下来的 app 的 upstream/server 都更新一遍, 然后 reload 一次
+// 结果记在 LastReload 里
 func (self *Hub) RestartNginx() {
+	// 只有 leader 才能动 nginx 和 DNS
+	if !Elector.IsLeader() {
+		self.apps = map[int][]string{}
+		self.jobs = map[int][]int{}
+		return
+	}
+	ingress := self.Ingress()
+	result := &ReloadResult{Time: time.Now(), Names: []string{}, Errors: map[string]string{}}
+	// 每个版本出的错, 最后报给它的任务
+	failures := map[int][]string{}
+	// 每个 name 是哪些版本刷的
+	owners := map[string][]int{}
 	for avID, subnames := range self.apps {
 		av := types.GetVersionByID(avID)
 		if av == nil {
@@ -106,132 +148,480 @@ func (self *Hub) RestartNginx() {
 			continue
 		}
 
-		cg := map[string][]*types.Container{}
+		// 按 app/sub app 和环境分
+		cg := map[string]map[string][]*types.Container{}
 		for _, c := range app.Containers() {
-			if c.SubApp == "" {
-				cg[c.AppName] = append(cg[c.AppName], c)
-			} else {
-				cg[c.SubApp] = append(cg[c.SubApp], c)
+			name := c.AppName
+			if c.SubApp != "" {
+				name = c.SubApp
+			}
+			if cg[name] == nil {
+				cg[name] = map[string][]*types.Container{}
 			}
+			cg[name][c.Env] = append(cg[name][c.Env], c)
 		}
 
-		for _, subname := range subnames {
+		for _, subname := range withRouteOwner(av, subnames) {
 			appname := subname
 			if appname == "" {
 				appname = app.Name
 			}
-
-			localUD := path.Join(config.Config.Nginx.LocalUpDir, fmt.Sprintf("%s.upstream.conf", appname))
-			localSD := path.Join(config.Config.Nginx.LocalServerDir, fmt.Sprintf("%s.server.conf", appname))
-			remoteUD := path.Join(config.Config.Nginx.RemoteUpDir, fmt.Sprintf("%s.upstream.conf", appname))
-			remoteSD := path.Join(config.Config.Nginx.RemoteServerDir, fmt.Sprintf("%s.server.conf", appname))
-
-			cs, exists := cg[appname]
-			if !exists {
-				// 删
-				EnsureFileAbsent(localUD)
-				EnsureFileAbsent(localSD)
-				if err := exec.Command("res", "nginx_clean", remoteUD).Run(); err != nil {
-					Logger.Info("res", "nginx_clean", remoteUD)
-					Logger.Info(err)
+			for _, env := range types.GetEnvironments() {
+				name, err := applyIngress(ingress, app, av, appname, subname, env, cg[appname][env.Name])
+				if name == "" {
+					continue
 				}
-				if err := exec.Command("res", "nginx_clean", remoteSD).Run(); err != nil {
-					Logger.Info("res", "nginx_clean", remoteSD)
-					Logger.Info(err)
+				result.Names = append(result.Names, name)
+				owners[name] = append(owners[name], avID)
+				if err != nil {
+					Logger.Info("ingress ", name, " error: ", err)
+					result.Errors[name] = err.Error()
+					failures[avID] = append(failures[avID], name+": "+err.Error())
 				}
-				continue
 			}
+		}
 
-			ups := []string{}
-			for _, c := range cs {
-				if c.Port == 0 {
-					continue
+		app.CreateDNS()
+		if err := app.PublishServices(); err != nil {
+			Logger.Info("publish services of ", app.Name, " error: ", err)
+		}
+	}
+	retry := false
+	if err := ingress.Reload(); err != nil {
+		Logger.Info("Restart nginx failed", err)
+		if errs, ok := err.(ReloadErrors); ok {
+			// 只有这些 name 没换上去
+			for name, e := range errs {
+				result.Errors[name] = e
+				for _, avID := range owners[name] {
+					failures[avID] = append(failures[avID], name+": "+e)
 				}
-				ups = append(ups, fmt.Sprintf("%s:%v", c.Host().IP, c.Port))
-			}
-
-			// create upstream
-			if err := UpstreamConf(appname, ups, config.Config.Nginx.UpstreamTemplate, localUD); err != nil {
-				Logger.Info("failed to create upstream for", appname)
-				continue
 			}
-			if err := exec.Command("res", "nginx_reload", localUD, remoteUD).Run(); err != nil {
-				Logger.Info("res", "nginx_reload", localUD, remoteUD)
-				Logger.Info(err)
+		} else {
+			result.Error = err.Error()
+			// 这一轮的改动都没生效, 下一轮再刷一次
+			retry = true
+			for avID, _ := range self.apps {
+				failures[avID] = append(failures[avID], err.Error())
 			}
+		}
+	}
+	for avID, errs := range failures {
+		types.FailJobsOnIngress(self.jobs[avID], strings.Join(errs, "; "))
+	}
+	result.OK = result.Error == "" && len(result.Errors) == 0
+	self.setLastReload(result)
+	if !retry {
+		self.apps = map[int][]string{}
+	}
+	self.jobs = map[int][]int{}
+}
+
+// 一个 app/sub app 在一个环境里的 upstream 和 server, 这个环境里一个容器都没有了才删掉, 端口和域名也一起放掉
+// prod 的 upstream 名字还是 app 名, 别的环境是 app.环境
+// 返回改了的 name, 什么都没动就是空的
+func applyIngress(ingress Ingress, app *types.Application, av *types.AppVersion, appname, subname string, env *types.Environment, cs []*types.Container) (string, error) {
+	name := env.UpstreamName(appname)
+
+	if len(cs) == 0 {
+		// 别的环境大多没有容器, 本来就没有配置的不用去清
+		if env.Name != types.ENV_PROD && !ingress.Exists(name) {
+			return "", nil
+		}
+		if env.Name == types.ENV_PROD {
+			types.ReleaseDomains(app.Name, subname, nil)
+		}
+		types.ReleaseListener(app.Name, subname, env.Name)
+		return name, ingress.Delete(name)
+	}
+
+	// canary 只在 prod
+	var canary *types.Canary
+	if env.Name == types.ENV_PROD {
+		canary = types.GetCanary(app.Name, subname)
+	}
+	// 容器都还在起或者都不 healthy, nginx 的 upstream 不能是空的, 先留着上一次的配置
+	ups := upstreamServers(canary, cs, hostIPs())
+	if len(ups) == 0 {
+		return "", nil
+	}
+
+	appyaml, err := av.GetSubAppYaml(subname)
+	if err != nil {
+		appyaml = &types.AppYaml{}
+	}
+	protocol := appyaml.GetProtocol()
+	listen := 0
+	if types.NeedsListener(protocol) {
+		l, err := types.AllocateListener(app.Name, subname, env.Name, protocol)
+		if err != nil {
+			return name, err
+		}
+		listen = l.Port
+	} else {
+		types.ReleaseListener(app.Name, subname, env.Name)
+	}
+
+	// tcp/udp 不要 server, 也没有域名
+	if protocol == types.PROTOCOL_TCP || protocol == types.PROTOCOL_UDP {
+		if env.Name == types.ENV_PROD {
+			types.ReleaseDomains(app.Name, subname, nil)
+		}
+		return name, ingress.ApplyStream(&Stream{
+			Name:     name,
+			App:      appname,
+			Env:      env.Name,
+			Protocol: protocol,
+			Listen:   listen,
+			Servers:  ups,
+		})
+	}
+
+	server := &Server{
+		Name:        name,
+		App:         appname,
+		Env:         env.Name,
+		Protocol:    protocol,
+		Listen:      listen,
+		ServerName:  env.ServerName(appname),
+		ServerNames: []string{env.ServerName(appname)},
+		PodName:     config.Config.PodName,
+		Static:      path.Join("/", av.StaticPath()),
+		Path:        path.Join(config.Config.Nginx.Staticdir, fmt.Sprintf("/%s/%s/", av.Name, av.Version)),
+	}
+	return name, applyServer(ingress, server, ups, func(server *Server) error {
+		return withDomains(ingress, server, app, av, subname, env, appyaml)
+	})
+}
+
+// 容器先换上, 域名和证书有问题只报错, server 还用上一次的
+func applyServer(ingress Ingress, server *Server, ups []*UpstreamServer, domains func(*Server) error) error {
+	if err := ingress.ApplyUpstream(&Upstream{Name: server.Name, Servers: ups}); err != nil {
+		return err
+	}
+	if err := domains(server); err != nil {
+		return err
+	}
+	return ingress.ApplyServer(server)
+}
 
-			// create server
-			if err := ServerConf(appname, config.Config.PodName, path.Join("/", av.StaticPath()),
-				path.Join(config.Config.Nginx.Staticdir, fmt.Sprintf("/%s/%s/", av.Name, av.Version)),
-				config.Config.Nginx.ServerTemplate, localSD); err != nil {
-				Logger.Info("failed to create server for", appname)
+// app.yaml 里的 domains 只给 prod, routes 和 tls 每个环境都有
+// 转给的 sub app 在这个环境里还没有 upstream 的先不加, 它起来了会再刷一次; 不是 http 的不能转
+func withDomains(ingress Ingress, server *Server, app *types.Application, av *types.AppVersion, subname string, env *types.Environment, appyaml *types.AppYaml) error {
+	if env.Name == types.ENV_PROD {
+		if err := types.ClaimDomains(app.Name, subname, appyaml.Domains); err != nil {
+			return err
+		}
+		server.ServerNames = append(server.ServerNames, appyaml.Domains...)
+	}
+
+	for _, route := range appyaml.Routes {
+		upstream := env.UpstreamName(route.App)
+		if sub, err := av.GetSubAppYaml(route.App); err == nil && sub.GetProtocol() != types.PROTOCOL_HTTP {
+			Logger.Info("route ", route.Path, " of ", server.Name, " skipped, ", route.App, " is ", sub.GetProtocol())
+			continue
+		}
+		if !ingress.Exists(upstream) {
+			Logger.Info("route ", route.Path, " of ", server.Name, " skipped, no upstream ", upstream)
+			continue
+		}
+		server.Routes = append(server.Routes, &Route{Path: route.Path, Name: upstream, App: route.App})
+	}
+
+	if !appyaml.TLS.Enabled {
+		return nil
+	}
+	// 自己声明的域名一定要有能用的证书, 默认的有就上
+	for i, name := range server.ServerNames {
+		cert := types.CertificateFor(name)
+		if cert == nil || cert.Expired() {
+			if i == 0 {
 				continue
 			}
-			if err := exec.Command("res", "nginx_reload", localSD, remoteSD).Run(); err != nil {
-				Logger.Info("res", "nginx_reload", localSD, remoteSD)
-				Logger.Info(err)
+			return fmt.Errorf("no valid certificate for %s", name)
+		}
+		key, err := cert.KeyPEM()
+		if err != nil {
+			return err
+		}
+		server.TLS = append(server.TLS, &TLS{Name: name, Domain: cert.Domain, Cert: []byte(cert.Cert), Key: []byte(key)})
+	}
+	server.Redirect = appyaml.TLS.Redirect
+	return nil
+}
+
+// 主 app 的 routes 转给 sub app, sub app 的 upstream 先弄好再弄主 app
+// 刷了被转给的 sub app 也要刷一下主 app
+func withRouteOwner(av *types.AppVersion, subnames []string) []string {
+	seen := map[string]bool{}
+	r := []string{}
+	main := false
+	for _, subname := range subnames {
+		if subname == "" {
+			main = true
+		} else if !seen[subname] {
+			seen[subname] = true
+			r = append(r, subname)
+		}
+	}
+	if !main {
+		if appyaml, err := av.GetAppYaml(); err == nil {
+			for _, route := range appyaml.Routes {
+				if seen[route.App] {
+					main = true
+					break
+				}
 			}
 		}
+	}
+	if main {
+		r = append(r, "")
+	}
+	return r
+}
 
-		app.CreateDNS()
+// 容器所在机器的 IP, 同一台机器只查一次, 机器没了是空的
+func hostIPs() func(*types.Container) string {
+	ips := map[int]string{}
+	return func(c *types.Container) string {
+		if ip, exists := ips[c.HostID]; exists {
+			return ip
+		}
+		ip := ""
+		if host := c.Host(); host != nil {
+			ip = host.IP
+		}
+		ips[c.HostID] = ip
+		return ip
 	}
-	cmd := exec.Command("nginx", "-s", "reload")
-	if err := cmd.Run(); err != nil {
-		Logger.Info("Restart nginx failed", err)
+}
+
+// 有 canary 的时候按照权重分流量, 权重是 0 的容器不放进去
+func upstreamServers(canary *types.Canary, cs []*types.Container, hostIP func(*types.Container) string) []*UpstreamServer {
+	stable, fresh := []*types.Container{}, []*types.Container{}
+	addrs := map[*types.Container]string{}
+	for _, c := range cs {
+		// 配了健康检查的过了才放进去
+		if c.Port == 0 || !c.Healthy() {
+			continue
+		}
+		ip := hostIP(c)
+		if ip == "" {
+			continue
+		}
+		addrs[c] = fmt.Sprintf("%s:%v", ip, c.Port)
+		if canary != nil && c.Version == canary.Canary {
+			fresh = append(fresh, c)
+		} else {
+			stable = append(stable, c)
+		}
+	}
+
+	if canary == nil {
+		ups := []*UpstreamServer{}
+		for _, c := range stable {
+			ups = append(ups, &UpstreamServer{Addr: addrs[c]})
+		}
+		return ups
+	}
+
+	ups := []*UpstreamServer{}
+	sw, cw := canary.Weights(len(stable), len(fresh))
+	for _, g := range []struct {
+		cs     []*types.Container
+		weight int
+	}{{stable, sw}, {fresh, cw}} {
+		if g.weight == 0 {
+			continue
+		}
+		for _, c := range g.cs {
+			ups = append(ups, &UpstreamServer{Addr: addrs[c], Weight: g.weight})
+		}
+	}
+	return ups
+}
+
+// 马上刷一下某个 app/sub app 的 nginx
+func (self *Hub) RefreshNginx(avID int, subApp string) {
+	self.done <- &NInfo{avID, subApp, nil}
+	self.flush()
+}
+
+// 已经有一个在等就算了, 不要卡住调用的人
+func (self *Hub) flush() {
+	select {
+	case self.immediate <- true:
+	default:
 	}
-	self.apps = map[int][]string{}
 }
 
-func (self *Hub) AddLevi(levi *Levi) {
+// 要在锁里调
+func (self *Hub) all() []*Levi {
+	levis := make([]*Levi, 0, len(self.levis))
+	for _, levi := range self.levis {
+		levis = append(levis, levi)
+	}
+	return levis
+}
+
+func (self *Hub) Levi(host string) *Levi {
+	self.RLock()
+	defer self.RUnlock()
+	return self.levis[host]
+}
+
+func (self *Hub) HasLevi(host string) bool {
+	return self.Levi(host) != nil
+}
+
+// 已经有连接了就不加, 返回 false
+func (self *Hub) AddLevi(levi *Levi) bool {
+	self.Lock()
+	defer self.Unlock()
 	host := levi.host
+	if _, exists := self.levis[host]; exists {
+		return false
+	}
 	self.levis[host] = levi
 	self.lastCheckTime[host] = time.Now()
+	return true
 }
 
 func (self *Hub) RemoveLevi(host string) {
+	self.Lock()
 	levi, ok := self.levis[host]
+	delete(self.levis, host)
+	delete(self.lastCheckTime, host)
+	self.Unlock()
 	if !ok || levi == nil {
 		return
 	}
 	if h := types.GetHostByIP(host); h != nil {
 		h.Offline()
 	}
-	delete(self.levis, host)
-	delete(self.lastCheckTime, host)
+}
+
+func (self *Hub) touch(host string) {
+	self.Lock()
+	defer self.Unlock()
+	if _, ok := self.levis[host]; ok {
+		self.lastCheckTime[host] = time.Now()
+	}
+}
+
+// 只断开连接, levi 会自己重连
+func (self *Hub) DropLevis() {
+	self.RLock()
+	levis := self.all()
+	self.RUnlock()
+	for _, levi := range levis {
+		levi.conn.CloseConnection()
+	}
 }
 
 func (self *Hub) Close() {
-	for _, levi := range self.levis {
+	self.RLock()
+	levis := self.all()
+	self.RUnlock()
+	for _, levi := range levis {
 		levi.Close()
 	}
 	self.finished = true
 }
 
 func (self *Hub) Dispatch(host string, task *types.Task) error {
-	levi, ok := self.levis[host]
 	if task == nil {
 		return errors.New("task is nil")
 	}
-	if !ok || levi == nil {
+	levi := self.Levi(host)
+	if levi == nil {
 		if job := types.GetJob(task.ID); job != nil {
 			job.Done(types.FAIL, "failed cuz no levi alive")
 		}
+		if h := types.GetHostByIP(host); h != nil {
+			types.ReleaseTask(h, task)
+		}
 		return errors.New(fmt.Sprintf("%s levi not exists", host))
 	}
-	levi.inTask <- task
-	if task != nil && (task.Type == types.TESTAPPLICATION || task.Type == types.BUILDIMAGE) {
+	if err := types.EnqueueTask(host, task); err != nil {
+		Logger.Info("enqueue task error: ", err)
+	}
+	if task.Type == types.REMOVECONTAINER {
+		go self.removeLater(host, task)
+	} else {
+		levi.Send(task)
+	}
+	if task.Type == types.TESTAPPLICATION || task.Type == types.BUILDIMAGE {
 		streamLogHub.GetBufferedLog(task.ID, true)
 	}
 	return nil
 }
 
+// 删容器之前先从 nginx 里摘掉, 等 Drain 秒再发
+// update 的老容器要等新容器过了健康检查 (最多 replaceTimeout) 再摘
+// 等的时候 levi 可能重连过, 发之前再看一眼队列, 已经被 Replay 发掉的就不发了
+func (self *Hub) removeLater(host string, task *types.Task) {
+	c := types.GetContainerByCid(task.Container)
+	if c != nil {
+		if job := types.GetJob(task.ID); job != nil && job.Kind == types.UPDATECONTAINER {
+			waitHealthy(job.Result, replaceTimeout)
+		}
+		c.SetStopping(true)
+		// daemon 不在 nginx 里
+		if av := c.AppVersion(); av != nil && c.Port != 0 {
+			self.RefreshNginx(av.ID, c.SubApp)
+			if task.Drain > 0 {
+				time.Sleep(time.Duration(task.Drain) * time.Second)
+			}
+		}
+	}
+	if !types.IsTaskQueued(task.ID, task.Type) {
+		return
+	}
+	if levi := self.Levi(host); levi != nil {
+		levi.Send(task)
+	}
+}
+
+// 新容器配了健康检查的话等它不是 starting 了
+func waitHealthy(cid string, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		c := types.GetContainerByCid(cid)
+		if c == nil || c.Health != types.HEALTH_STARTING {
+			return
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// update 的新容器起来了, 再去删老的
+func (self *Hub) replaceContainer(jobID int) {
+	task := types.UpdateRemoveTask(jobID)
+	if task == nil {
+		return
+	}
+	c := types.GetContainerByCid(task.Container)
+	if c == nil {
+		return
+	}
+	host := c.Host()
+	if host == nil {
+		return
+	}
+	if err := self.Dispatch(host.IP, task); err != nil {
+		Logger.Info("remove replaced container ", task.Container, " error: ", err)
+	}
+}
+
 func init() {
 	LeviHub = &Hub{
 		levis:         make(map[string]*Levi),
 		lastCheckTime: make(map[string]time.Time),
 		apps:          map[int][]string{},
-		done:          make(chan *NInfo),
-		immediate:     make(chan bool),
+		jobs:          map[int][]int{},
+		done:          make(chan *NInfo, 256),
+		immediate:     make(chan bool, 1),
 		size:          10,
 		finished:      false,
 	}
@@ -251,7 +641,7 @@ func NewConnection(ws *websocket.Conn, host string, port int) *Connection {
 	ws.SetReadDeadline(ZeroTime)
 	ws.SetWriteDeadline(ZeroTime)
 	ws.SetPongHandler(func(s string) error {
-		LeviHub.lastCheckTime[host] = time.Now()
+		LeviHub.touch(host)
 		Logger.Info("Connection pong: ", s, " from host: ", host)
 		return nil
 	})
@@ -264,11 +654,24 @@ func ServeWS(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", 405)
 		return
 	}
+	if redirectToLeader(w, r) {
+		return
+	}
 
-	// 拿 ip:port
-	rs := strings.Split(r.RemoteAddr, ":")
-	ip := rs[0]
-	port, _ := strconv.Atoi(rs[1])
+	ip, err := leviIdentity(r)
+	if err != nil {
+		Logger.Info("levi from ", r.RemoteAddr, " rejected: ", err)
+		http.Error(w, err.Error(), 401)
+		return
+	}
+	// 同一个 host 只能有一条连接, 旧的断了 CheckAlive 会清掉
+	if LeviHub.HasLevi(ip) {
+		Logger.Info("levi ", ip, " from ", r.RemoteAddr, " rejected: already connected")
+		http.Error(w, "levi "+ip+" already connected", 409)
+		return
+	}
+	_, p, _ := net.SplitHostPort(r.RemoteAddr)
+	port, _ := strconv.Atoi(p)
 
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -280,9 +683,25 @@ func ServeWS(w http.ResponseWriter, r *http.Request) {
 	// 同时开始 listen
 	c := NewConnection(ws, ip, port)
 	levi := NewLevi(c, config.Config.Task.Queuesize)
-	LeviHub.AddLevi(levi)
-	types.NewHost(ip, "")
+	// 没带 NBE-Levi-Protocol 的是老 levi, 走兼容的格式
+	if err := levi.Handshake(Atoi(r.Header.Get("NBE-Levi-Protocol"), types.PROTOCOL_LEGACY)); err != nil {
+		Logger.Info("levi ", ip, " handshake error: ", err)
+		c.CloseConnection()
+		return
+	}
+	// 前面看过了, 但是两条连接可能同时握手, 以 AddLevi 为准
+	if !LeviHub.AddLevi(levi) {
+		Logger.Info("levi ", ip, " from ", r.RemoteAddr, " rejected: already connected")
+		ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(closeConflict, "levi "+ip+" already connected"))
+		c.CloseConnection()
+		return
+	}
+	host := types.NewHost(ip, levi.facts.Hostname)
+	if host != nil && levi.protocol != types.PROTOCOL_LEGACY {
+		host.Report(&levi.facts)
+	}
 
 	go levi.Run()
 	go levi.WaitTask()
+	go levi.Replay()
 }
@@ -0,0 +1,290 @@
+package dot
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"types"
+)
+
+func testHostIP(c *types.Container) string {
+	return map[int]string{1: "10.0.0.1", 2: "10.0.0.2"}[c.HostID]
+}
+
+func TestUpstreamServers(t *testing.T) {
+	cases := []struct {
+		name   string
+		canary *types.Canary
+		cs     []*types.Container
+		want   []*UpstreamServer
+	}{
+		{"none", nil, nil, []*UpstreamServer{}},
+		{
+			"no canary", nil, []*types.Container{{HostID: 1, Port: 5000, Version: "v1"}, {HostID: 2, Port: 5001, Version: "v1"}},
+			[]*UpstreamServer{{"10.0.0.1:5000", 0}, {"10.0.0.2:5001", 0}},
+		},
+		{
+			"skip not ready", nil, []*types.Container{
+				{HostID: 1, Port: 5000, Version: "v1"},
+				{HostID: 1, Port: 0, Version: "v1"},
+				{HostID: 1, Port: 5002, Health: types.HEALTH_STARTING},
+				{HostID: 1, Port: 5003, Health: types.HEALTH_UNHEALTHY},
+				{HostID: 1, Port: 5004, Health: types.HEALTH_HEALTHY},
+				{HostID: 1, Port: 5005, Stopping: true},
+				{HostID: 3, Port: 5006, Version: "v1"},
+			},
+			[]*UpstreamServer{{"10.0.0.1:5000", 0}, {"10.0.0.1:5004", 0}},
+		},
+		{
+			"canary weight", &types.Canary{Stable: "v1", Canary: "v2", Weight: 25}, []*types.Container{{HostID: 1, Port: 5000, Version: "v1"}, {HostID: 2, Port: 5001, Version: "v1"}, {HostID: 1, Port: 5002, Version: "v2"}},
+			[]*UpstreamServer{{"10.0.0.1:5000", 3}, {"10.0.0.2:5001", 3}, {"10.0.0.1:5002", 2}},
+		},
+		{
+			"canary not up yet", &types.Canary{Stable: "v1", Canary: "v2", Weight: 25}, []*types.Container{{HostID: 1, Port: 5000, Version: "v1"}, {HostID: 1, Port: 5002, Version: "v2", Health: types.HEALTH_STARTING}},
+			[]*UpstreamServer{{"10.0.0.1:5000", 1}},
+		},
+		{
+			"canary zero", &types.Canary{Stable: "v1", Canary: "v2", Weight: 0}, []*types.Container{{HostID: 1, Port: 5000, Version: "v1"}, {HostID: 1, Port: 5002, Version: "v2"}},
+			[]*UpstreamServer{{"10.0.0.1:5000", 1}},
+		},
+		{
+			"canary all", &types.Canary{Stable: "v1", Canary: "v2", Weight: 100}, []*types.Container{{HostID: 1, Port: 5000, Version: "v1"}, {HostID: 1, Port: 5002, Version: "v2"}},
+			[]*UpstreamServer{{"10.0.0.1:5002", 1}},
+		},
+		{
+			"stable gone", &types.Canary{Stable: "v1", Canary: "v2", Weight: 10}, []*types.Container{{HostID: 1, Port: 5002, Version: "v2"}},
+			[]*UpstreamServer{{"10.0.0.1:5002", 1}},
+		},
+	}
+	for _, c := range cases {
+		got := upstreamServers(c.canary, c.cs, testHostIP)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: upstreamServers = %+v, want %+v", c.name, addrs(got), addrs(c.want))
+		}
+	}
+}
+
+func addrs(ups []*UpstreamServer) []UpstreamServer {
+	r := []UpstreamServer{}
+	for _, u := range ups {
+		r = append(r, *u)
+	}
+	return r
+}
+
+func TestFakeIngress(t *testing.T) {
+	f := NewFakeIngress()
+	if err := f.ApplyServer(&Server{Name: "web"}); err == nil {
+		t.Error("server without upstream applied")
+	}
+	if err := f.ApplyUpstream(&Upstream{}); err == nil {
+		t.Error("upstream without name applied")
+	}
+	if err := f.ApplyUpstream(&Upstream{Name: "web"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.ApplyServer(&Server{Name: "web"}); err != nil {
+		t.Fatal(err)
+	}
+	if !f.Exists("web") || f.Exists("blog") {
+		t.Errorf("Exists(web) = %v, Exists(blog) = %v", f.Exists("web"), f.Exists("blog"))
+	}
+	if err := f.Reload(); err != nil || f.Reloads != 1 {
+		t.Errorf("Reload = %v, %d reloads", err, f.Reloads)
+	}
+	if err := f.Delete("web"); err != nil || f.Exists("web") {
+		t.Errorf("Delete = %v, exists %v", err, f.Exists("web"))
+	}
+
+	f.Fail = errors.New("disk full")
+	if err := f.ApplyUpstream(&Upstream{Name: "web"}); err != f.Fail || f.Exists("web") {
+		t.Errorf("failed ApplyUpstream = %v, exists %v", err, f.Exists("web"))
+	}
+	if err := f.Reload(); err != f.Fail || f.Reloads != 1 {
+		t.Errorf("failed Reload = %v, %d reloads", err, f.Reloads)
+	}
+}
+
+func TestApplyServer(t *testing.T) {
+	ups := []*UpstreamServer{{Addr: "10.0.0.1:5000"}}
+	ok := func(*Server) error { return nil }
+	domainErr := errors.New("domain a.com is used by blog")
+	fail := errors.New("disk full")
+
+	cases := []struct {
+		name     string
+		before   func(*FakeIngress)
+		domains  func(*Server) error
+		err      error
+		upstream bool
+		server   string
+		stream   bool
+	}{
+		{"new", nil, ok, nil, true, "new", false},
+		{"update", func(f *FakeIngress) {
+			f.Upstreams["web"] = &Upstream{Name: "web"}
+			f.Servers["web"] = &Server{Name: "web", ServerName: "old"}
+		}, ok, nil, true, "new", false},
+		// 域名有问题的时候容器照样换, server 还是上一次的
+		{"bad domains", func(f *FakeIngress) {
+			f.Upstreams["web"] = &Upstream{Name: "web"}
+			f.Servers["web"] = &Server{Name: "web", ServerName: "old"}
+		}, func(*Server) error { return domainErr }, domainErr, true, "old", false},
+		{"stream to server", func(f *FakeIngress) {
+			f.Streams["web"] = &Stream{Name: "web", Listen: 9000}
+		}, ok, nil, true, "new", false},
+		{"ingress failed", func(f *FakeIngress) {
+			f.Fail = fail
+		}, ok, fail, false, "", false},
+	}
+	for _, c := range cases {
+		f := NewFakeIngress()
+		if c.before != nil {
+			c.before(f)
+		}
+		server := &Server{Name: "web", ServerName: "new"}
+		err := applyServer(f, server, ups, c.domains)
+		if err != c.err {
+			t.Errorf("%s: err = %v, want %v", c.name, err, c.err)
+		}
+		if u := f.Upstreams["web"]; (u != nil) != c.upstream || (u != nil && !reflect.DeepEqual(u.Servers, ups)) {
+			t.Errorf("%s: upstream = %+v", c.name, u)
+		}
+		got := ""
+		if s := f.Servers["web"]; s != nil {
+			got = s.ServerName
+		}
+		if got != c.server {
+			t.Errorf("%s: server = %q, want %q", c.name, got, c.server)
+		}
+		if _, exists := f.Streams["web"]; exists != c.stream {
+			t.Errorf("%s: stream exists = %v, want %v", c.name, exists, c.stream)
+		}
+	}
+}
+
+// http 和 tcp/udp 来回切的时候另一种配置要没了
+func TestSwitchServerAndStream(t *testing.T) {
+	f := NewFakeIngress()
+	ups := []*UpstreamServer{{Addr: "10.0.0.1:5000"}}
+	ok := func(*Server) error { return nil }
+
+	if err := applyServer(f, &Server{Name: "web"}, ups, ok); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.ApplyStream(&Stream{Name: "web", Protocol: types.PROTOCOL_TCP, Servers: ups}); err == nil {
+		t.Error("stream without listen port applied")
+	}
+	if f.Servers["web"] == nil || f.Upstreams["web"] == nil {
+		t.Error("failed stream removed server")
+	}
+	if err := f.ApplyStream(&Stream{Name: "web", Protocol: types.PROTOCOL_TCP, Listen: 9000, Servers: ups}); err != nil {
+		t.Fatal(err)
+	}
+	if f.Servers["web"] != nil || f.Upstreams["web"] != nil || f.Streams["web"] == nil {
+		t.Errorf("after stream: upstream %v, server %v, stream %v", f.Upstreams["web"], f.Servers["web"], f.Streams["web"])
+	}
+	if err := f.ApplyServer(&Server{Name: "web"}); err == nil {
+		t.Error("server without upstream applied")
+	}
+	if err := applyServer(f, &Server{Name: "web"}, ups, ok); err != nil {
+		t.Fatal(err)
+	}
+	if f.Servers["web"] == nil || f.Upstreams["web"] == nil || f.Streams["web"] != nil {
+		t.Errorf("after server: upstream %v, server %v, stream %v", f.Upstreams["web"], f.Servers["web"], f.Streams["web"])
+	}
+	if err := f.Delete("web"); err != nil || f.Exists("web") {
+		t.Errorf("delete: %v, exists %v", err, f.Exists("web"))
+	}
+}
+
+// 这几种情况不用查库, 什么都不动
+// 这几种情况不用查库, 什么都不动
+// 这几种情况不用查库, 什么都不动
+func TestApplyIngressUntouched(t *testing.T) {
+	env := &types.Environment{Name: types.ENV_TEST}
+	app := &types.Application{Name: "web"}
+	cases := []struct {
+		name   string
+		before func(*FakeIngress)
+		cs     []*types.Container
+	}{
+		{"no containers, no config", nil, nil},
+		{"other app has config", func(f *FakeIngress) {
+			f.Upstreams["blog.test"] = &Upstream{Name: "blog.test"}
+		}, nil},
+		{"none healthy", func(f *FakeIngress) {
+			f.Upstreams["web.test"] = &Upstream{Name: "web.test", Servers: []*UpstreamServer{{Addr: "10.0.0.1:5000"}}}
+			f.Servers["web.test"] = &Server{Name: "web.test"}
+		}, []*types.Container{
+			{HostID: 1, Port: 5001, Health: types.HEALTH_STARTING},
+			{HostID: 1, Port: 5000, Stopping: true},
+			{HostID: 1},
+		}},
+	}
+	for _, c := range cases {
+		f := NewFakeIngress()
+		if c.before != nil {
+			c.before(f)
+		}
+		upstreams, servers := len(f.Upstreams), len(f.Servers)
+		name, err := applyIngress(f, app, nil, "web", "", env, c.cs)
+		if name != "" || err != nil {
+			t.Errorf("%s: applyIngress = %q, %v, want nothing", c.name, name, err)
+		}
+		if len(f.Upstreams) != upstreams || len(f.Servers) != servers {
+			t.Errorf("%s: ingress changed", c.name)
+		}
+	}
+}
+
+func TestWithRouteOwner(t *testing.T) {
+	cases := []struct {
+		subnames []string
+		want     []string
+	}{
+		{[]string{""}, []string{""}},
+		{[]string{"", "web-api"}, []string{"web-api", ""}},
+		{[]string{"web-api", "", "web-api", "web-admin", ""}, []string{"web-api", "web-admin", ""}},
+	}
+	for _, c := range cases {
+		if got := withRouteOwner(nil, c.subnames); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("withRouteOwner(%q) = %q, want %q", c.subnames, got, c.want)
+		}
+	}
+}
+
+func TestReloadErrors(t *testing.T) {
+	cases := []struct {
+		errs ReloadErrors
+		want string
+	}{
+		{ReloadErrors{}, ""},
+		{ReloadErrors{"web": "bad server"}, "web: bad server"},
+		{ReloadErrors{"web.test": "x", "blog": "y", "web": "z"}, "blog: y; web: z; web.test: x"},
+	}
+	for _, c := range cases {
+		if got := c.errs.Error(); got != c.want {
+			t.Errorf("Error() = %q, want %q", got, c.want)
+		}
+	}
+}
+
+func TestAddLevi(t *testing.T) {
+	hub := &Hub{levis: map[string]*Levi{}, lastCheckTime: map[string]time.Time{}}
+	first, second := &Levi{host: "10.0.0.1"}, &Levi{host: "10.0.0.1"}
+	if !hub.AddLevi(first) {
+		t.Fatal("first levi rejected")
+	}
+	if hub.AddLevi(second) {
+		t.Error("second levi of the same host added")
+	}
+	if hub.Levi("10.0.0.1") != first {
+		t.Error("first levi replaced")
+	}
+	if !hub.AddLevi(&Levi{host: "10.0.0.2"}) {
+		t.Error("levi of another host rejected")
+	}
+}
@@ -0,0 +1,156 @@
+package dot
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"config"
+	. "utils"
+)
+
+const (
+	INGRESS_NGINX = "nginx"
+	INGRESS_FAKE  = "fake"
+)
+
+// 前面接流量的东西, 现在是 nginx, 以后可以换成 haproxy/envoy
+// Apply* 和 Delete 只改配置, Reload 之后才生效, Reload 失败的话这一轮的改动都不生效
+// name 是 upstream 的名字, 一个 app/sub app 在一个环境里一个
+// 一个 name 要么是 http 的 upstream 和 server, 要么是 tcp/udp 的 stream, apply 一种会把另一种删掉
+type Ingress interface {
+	ApplyUpstream(upstream *Upstream) error
+	ApplyServer(server *Server) error
+	ApplyStream(stream *Stream) error
+	Delete(name string) error
+	// 有没有 name 的配置
+	Exists(name string) bool
+	Reload() error
+}
+
+// Weight 为 0 的时候不写 weight
+type UpstreamServer struct {
+	Addr   string
+	Weight int
+}
+
+type Upstream struct {
+	Name    string
+	Servers []*UpstreamServer
+}
+
+// 四层转发, Protocol 是 tcp 或者 udp, Listen 是 master nginx 上对外的端口
+type Stream struct {
+	Name     string
+	App      string
+	Env      string
+	Protocol string
+	Listen   int
+	Servers  []*UpstreamServer
+}
+
+// Name 是 upstream 的名字, App 是 app/sub app 的名字, Env 是环境
+// Static 是 url 里静态文件的前缀, Path 是本地的目录
+// ServerNames 是 ServerName 加上 app.yaml 里的 domains, TLS 里的域名上 https, Redirect 的话它们的 http 跳到 https
+// Protocol 是 grpc 的话 http 听在 Listen 上 (http2), 不是 80
+type Server struct {
+	Name        string
+	App         string
+	Env         string
+	Protocol    string
+	Listen      int
+	ServerName  string
+	ServerNames []string
+	PodName     string
+	Static      string
+	Path        string
+	Routes      []*Route
+	TLS         []*TLS
+	Redirect    bool
+}
+
+// path 前缀转给别的 upstream, Name 是 upstream 的名字, App 是 sub app 的名字
+type Route struct {
+	Path string
+	Name string
+	App  string
+}
+
+// Name 是 server_name, Domain 是证书的域名, 通配的证书两个不一样
+type TLS struct {
+	Name   string
+	Domain string
+	Cert   []byte
+	Key    []byte
+}
+
+// 最近一次 reload 的结果, Errors 是每个 name 在 apply/delete 的时候出的错
+type ReloadResult struct {
+	Time   time.Time         `json:"time"`
+	OK     bool              `json:"ok"`
+	Names  []string          `json:"names"`
+	Errors map[string]string `json:"errors"`
+	Error  string            `json:"error"`
+}
+
+// Reload 的时候有的 name 的改动没换上去, 别的都好了
+type ReloadErrors map[string]string
+
+func (e ReloadErrors) Error() string {
+	names := []string{}
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	errs := make([]string, len(names))
+	for i, name := range names {
+		errs[i] = name + ": " + e[name]
+	}
+	return strings.Join(errs, "; ")
+}
+
+func NewIngress(kind string) (Ingress, error) {
+	switch kind {
+	case "", INGRESS_NGINX:
+		return NewNginxIngress(), nil
+	case INGRESS_FAKE:
+		return NewFakeIngress(), nil
+	}
+	return nil, fmt.Errorf("unknown ingress %s", kind)
+}
+
+var ingressMutex sync.Mutex
+
+// 配置里的 ingress, 第一次用的时候才建, 这时候配置已经读了
+func (self *Hub) Ingress() Ingress {
+	ingressMutex.Lock()
+	defer ingressMutex.Unlock()
+	if self.ingress == nil {
+		ingress, err := NewIngress(config.Config.Ingress)
+		if err != nil {
+			Logger.Assert(err, "ingress")
+		}
+		self.ingress = ingress
+	}
+	return self.ingress
+}
+
+func (self *Hub) SetIngress(ingress Ingress) {
+	ingressMutex.Lock()
+	defer ingressMutex.Unlock()
+	self.ingress = ingress
+}
+
+func (self *Hub) LastReload() *ReloadResult {
+	ingressMutex.Lock()
+	defer ingressMutex.Unlock()
+	return self.lastReload
+}
+
+func (self *Hub) setLastReload(r *ReloadResult) {
+	ingressMutex.Lock()
+	defer ingressMutex.Unlock()
+	self.lastReload = r
+}
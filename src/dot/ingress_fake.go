@@ -0,0 +1,98 @@
+package dot
+
+import (
+	"errors"
+	"sync"
+)
+
+// 全放在内存里, 测试和本地跑的时候用
+// Fail 设了的话所有操作都返回这个错
+type FakeIngress struct {
+	sync.Mutex
+	Upstreams map[string]*Upstream
+	Servers   map[string]*Server
+	Streams   map[string]*Stream
+	Reloads   int
+	Fail      error
+}
+
+func NewFakeIngress() *FakeIngress {
+	return &FakeIngress{
+		Upstreams: map[string]*Upstream{},
+		Servers:   map[string]*Server{},
+		Streams:   map[string]*Stream{},
+	}
+}
+
+func (self *FakeIngress) ApplyUpstream(upstream *Upstream) error {
+	self.Lock()
+	defer self.Unlock()
+	if self.Fail != nil {
+		return self.Fail
+	}
+	if upstream.Name == "" {
+		return errors.New("upstream without name")
+	}
+	self.Upstreams[upstream.Name] = upstream
+	delete(self.Streams, upstream.Name)
+	return nil
+}
+
+func (self *FakeIngress) ApplyServer(server *Server) error {
+	self.Lock()
+	defer self.Unlock()
+	if self.Fail != nil {
+		return self.Fail
+	}
+	if _, exists := self.Upstreams[server.Name]; !exists {
+		return errors.New("server without upstream " + server.Name)
+	}
+	self.Servers[server.Name] = server
+	return nil
+}
+
+func (self *FakeIngress) ApplyStream(stream *Stream) error {
+	self.Lock()
+	defer self.Unlock()
+	if self.Fail != nil {
+		return self.Fail
+	}
+	if stream.Listen == 0 {
+		return errors.New("stream without listen port " + stream.Name)
+	}
+	self.Streams[stream.Name] = stream
+	delete(self.Upstreams, stream.Name)
+	delete(self.Servers, stream.Name)
+	return nil
+}
+
+func (self *FakeIngress) Delete(name string) error {
+	self.Lock()
+	defer self.Unlock()
+	if self.Fail != nil {
+		return self.Fail
+	}
+	delete(self.Upstreams, name)
+	delete(self.Servers, name)
+	delete(self.Streams, name)
+	return nil
+}
+
+func (self *FakeIngress) Exists(name string) bool {
+	self.Lock()
+	defer self.Unlock()
+	_, up := self.Upstreams[name]
+	_, server := self.Servers[name]
+	_, stream := self.Streams[name]
+	return up || server || stream
+}
+
+func (self *FakeIngress) Reload() error {
+	self.Lock()
+	defer self.Unlock()
+	if self.Fail != nil {
+		return self.Fail
+	}
+	self.Reloads = self.Reloads + 1
+	return nil
+}
@@ -3,7 +3,6 @@ package dot
 import (
 	"fmt"
 	"path"
-	"strings"
 	"sync"
 	"time"
 
@@ -12,16 +11,32 @@ import (
 	. "utils"
 )
 
+const (
+	handshakeTimeout = 10 * time.Second
+
+	// levi 能回答 query 的话, 重连之后发了没回的任务才会重发
+	CAPABILITY_QUERY = "query"
+)
+
 type Levi struct {
-	conn      *Connection
-	inTask    chan *types.Task
-	immediate chan bool
-	host      string
-	size      int
-	tasks     map[string]*types.LeviGroupedTask
-	waiting   map[string]*types.LeviGroupedTask
-	running   bool
-	wg        *sync.WaitGroup
+	conn         *Connection
+	inTask       chan *types.Task
+	immediate    chan bool
+	host         string
+	size         int
+	tasks        map[string]*types.LeviGroupedTask
+	waiting      map[string]*types.LeviGroupedTask
+	running      bool
+	wg           *sync.WaitGroup
+	protocol     int
+	capabilities []string
+	facts        types.HostFacts
+	// websocket 不能同时写
+	wlock sync.Mutex
+	// 管着 closed 和 accepted, 别的 goroutine 往 inTask 里塞任务都走 Send
+	lock     sync.Mutex
+	closed   bool
+	accepted map[string]bool
 }
 
 func NewLevi(conn *Connection, size int) *Levi {
@@ -35,7 +50,17 @@ func NewLevi(conn *Connection, size int) *Levi {
 		waiting:   make(map[string]*types.LeviGroupedTask),
 		running:   true,
 		wg:        &sync.WaitGroup{},
+		accepted:  map[string]bool{},
+	}
+}
+
+func (self *Levi) Can(capability string) bool {
+	for _, c := range self.capabilities {
+		if c == capability {
+			return true
+		}
 	}
+	return false
 }
 
 func (self *Levi) Host() *types.Host {
@@ -80,7 +105,78 @@ func (self *Levi) WaitTask() {
 	}
 }
 
+// 重新连上来的时候, 之前没发出去的任务再塞回去
+// 发出去了没回的先问 levi 收到了没有, 没收到的再发
+// 不会回答的 levi 不重发, 免得跑两遍, 这些任务直接算失败, 不然 job 一直是 running
+func (self *Levi) Replay() {
+	if uuids := types.GetUnackedGroups(self.host); len(uuids) > 0 {
+		if self.Can(CAPABILITY_QUERY) {
+			if err := self.write(types.MSG_QUERY, &types.Query{IDs: uuids}); err != nil {
+				Logger.Info("query ", self.host, " error: ", err)
+			}
+		} else {
+			Logger.Info("levi ", self.host, " can't answer query, fail ", uuids)
+			for _, uuid := range uuids {
+				types.FailUnackedGroup(uuid, "levi reconnected, result unknown")
+			}
+		}
+	}
+	self.resend(types.GetPendingTasks(self.host))
+}
+
+// levi 收到了的等它回, 没收到的重发
+func (self *Levi) answer(q *types.Query) {
+	known := map[string]bool{}
+	for _, uuid := range q.Known {
+		known[uuid] = true
+	}
+	for _, uuid := range q.IDs {
+		if known[uuid] {
+			if lgt := self.group(uuid); lgt != nil {
+				lgt.Ack()
+			}
+			continue
+		}
+		Logger.Info("levi ", self.host, " didn't get ", uuid, ", resend")
+		self.resend(types.GetUnackedTasks(uuid))
+	}
+}
+
+// 要删的容器还是要先从 nginx 摘掉再发
+func (self *Levi) resend(tasks []*types.Task) {
+	for _, task := range tasks {
+		Logger.Info("replay task ", task.ID, " to ", self.host)
+		if task.Type == types.REMOVECONTAINER {
+			go LeviHub.removeLater(self.host, task)
+			continue
+		}
+		self.Send(task)
+		if task.Type == types.TESTAPPLICATION || task.Type == types.BUILDIMAGE {
+			streamLogHub.GetBufferedLog(task.ID, true)
+		}
+	}
+}
+
+// 关了就不发, 同一个任务在一条连接上只发一次, Replay 和 Dispatch 可能同时塞
+func (self *Levi) Send(task *types.Task) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	key := fmt.Sprintf("%d:%d", task.ID, task.Type)
+	if self.closed || self.accepted[key] {
+		return false
+	}
+	self.accepted[key] = true
+	self.inTask <- task
+	return true
+}
+
 func (self *Levi) Close() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.closed {
+		return
+	}
+	self.closed = true
 	self.wg.Add(1)
 	self.running = false
 	self.inTask <- nil
@@ -96,79 +192,265 @@ func (self *Levi) SendTasks() {
 		go func(lgt *types.LeviGroupedTask) {
 			defer self.wg.Done()
 			self.waiting[lgt.UUID] = lgt
-			if err := self.conn.ws.WriteJSON(&lgt); err != nil {
+			if err := self.write(types.MSG_TASKS, withEnv(lgt)); err != nil {
 				Logger.Info(err, "JSON write error")
+				return
 			}
+			lgt.MarkSent()
 		}(lgt)
 	}
 	self.wg.Wait()
 	self.tasks = make(map[string]*types.LeviGroupedTask)
 }
 
+// 要发的时候才把环境变量填到 Add 任务的副本上
+// 原来的 lgt 会存着等 levi 回, 不带 secret
+func withEnv(lgt *types.LeviGroupedTask) *types.LeviGroupedTask {
+	tasks := *lgt.Tasks
+	tasks.Add = make([]*types.Task, len(lgt.Tasks.Add))
+	for i, task := range lgt.Tasks.Add {
+		t := *task
+		if job := types.GetJob(t.ID); job != nil {
+			vars, err := types.ResolveEnv(job.AppName, t.GetEnvironment())
+			if err != nil {
+				Logger.Info("env of task ", t.ID, " error: ", err)
+			}
+			t.Env = vars
+		}
+		tasks.Add[i] = &t
+	}
+	out := *lgt
+	out.Tasks = &tasks
+	return &out
+}
+
+// 老的 levi 直接收 LeviGroupedTask, 新的收 Message
+func (self *Levi) write(kind string, body interface{}) error {
+	self.wlock.Lock()
+	defer self.wlock.Unlock()
+	if self.protocol == types.PROTOCOL_LEGACY {
+		return self.conn.ws.WriteJSON(body)
+	}
+	m, err := types.NewMessage(kind, body)
+	if err != nil {
+		return err
+	}
+	return self.conn.ws.WriteJSON(m)
+}
+
+// levi 在升级连接的时候用 NBE-Levi-Protocol 说自己支持哪个版本
+// 不是老协议的话, 第一条消息必须是 hello, dot 回一个商量好版本的 hello
+func (self *Levi) Handshake(version int) error {
+	self.protocol = types.NegotiateVersion(version)
+	if self.protocol == types.PROTOCOL_LEGACY {
+		return nil
+	}
+	ws := self.conn.ws
+	ws.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer ws.SetReadDeadline(ZeroTime)
+
+	var m types.Message
+	if err := ws.ReadJSON(&m); err != nil {
+		return err
+	}
+	if m.Kind != types.MSG_HELLO {
+		return fmt.Errorf("expect hello, got %s", m.Kind)
+	}
+	var hello types.Hello
+	if err := m.Decode(&hello); err != nil {
+		return err
+	}
+	self.protocol = types.NegotiateVersion(hello.Version)
+	self.capabilities = hello.Capabilities
+	self.facts = hello.Host
+	Logger.Info("levi ", self.host, " protocol ", self.protocol, " capabilities ", hello.Capabilities)
+	return self.write(types.MSG_HELLO, &types.Hello{Version: self.protocol})
+}
+
+// 老协议一条 TaskReply 可能翻译成好几条消息
+func (self *Levi) read() ([]*types.Message, error) {
+	if self.protocol != types.PROTOCOL_LEGACY {
+		var m types.Message
+		if err := self.conn.ws.ReadJSON(&m); err != nil {
+			return nil, err
+		}
+		return []*types.Message{&m}, nil
+	}
+	var reply types.TaskReply
+	if err := self.conn.ws.ReadJSON(&reply); err != nil {
+		return nil, err
+	}
+	var task *types.Task
+	if lgt := self.group(reply.ID); lgt != nil {
+		task = taskOf(lgt, reply.Index, reply.Type)
+	}
+	return types.LegacyMessages(&reply, task), nil
+}
+
 func (self *Levi) Run() {
 	// 接收数据
-	finish := false
 	defer func() {
 		self.Close()
 		LeviHub.RemoveLevi(self.host)
 	}()
 	host := self.Host()
-	for !finish {
-		var taskReply types.TaskReply
-		switch err := self.conn.ws.ReadJSON(&taskReply); {
-		case err != nil:
+	for {
+		ms, err := self.read()
+		if err != nil {
 			Logger.Info("read json error: ", err)
-			finish = true
-		default:
+			return
+		}
+		for _, m := range ms {
+			self.handle(host, m)
+		}
+	}
+}
 
-			taskUUID := taskReply.ID
+func (self *Levi) handle(host *types.Host, m *types.Message) {
+	switch m.Kind {
+	case types.MSG_STATUS:
+		var status types.Status
+		if err := m.Decode(&status); err != nil {
+			Logger.Info("bad status: ", err)
+			return
+		}
+		doStatus(host, &status)
+	case types.MSG_FACTS:
+		var facts types.HostFacts
+		if err := m.Decode(&facts); err != nil {
+			Logger.Info("bad facts: ", err)
+			return
+		}
+		if host != nil {
+			host.Report(&facts)
+		}
+	case types.MSG_HEALTH:
+		var report types.HealthReport
+		if err := m.Decode(&report); err != nil {
+			Logger.Info("bad health: ", err)
+			return
+		}
+		if host != nil {
+			doHealth(host, &report)
+		}
+	case types.MSG_ACK:
+		var ack types.Ack
+		if err := m.Decode(&ack); err != nil {
+			Logger.Info("bad ack: ", err)
+			return
+		}
+		if lgt := self.group(ack.ID); lgt != nil {
+			lgt.Ack()
+		}
+	case types.MSG_QUERY:
+		var q types.Query
+		if err := m.Decode(&q); err != nil {
+			Logger.Info("bad query: ", err)
+			return
+		}
+		self.answer(&q)
+	case types.MSG_PROGRESS, types.MSG_LOG, types.MSG_RESULT, types.MSG_ERROR:
+		self.handleTask(host, m)
+	default:
+		Logger.Info("unknown message ", m.Kind, " from ", self.host)
+	}
+}
 
-			if taskUUID == "__STATUS__" {
-				doStatus(host, taskReply.Data)
-				continue
-			}
+func (self *Levi) handleTask(host *types.Host, m *types.Message) {
+	// 这几种消息的 body 都带着 TaskRef
+	var ref types.TaskRef
+	if err := m.Decode(&ref); err != nil {
+		Logger.Info("bad ", m.Kind, ": ", err)
+		return
+	}
+	lgt := self.group(ref.ID)
+	if lgt == nil {
+		Logger.Info(ref.ID, " not exists, ignore")
+		return
+	}
+	lgt.Ack()
 
-			lgt, exists := self.waiting[taskUUID]
-			if !exists {
-				Logger.Info(taskUUID, " not exists, ignore")
-				continue
-			}
+	av := types.GetVersion(lgt.Name, lgt.Version)
+	if av == nil {
+		Logger.Info(fmt.Sprintf("AppVersion %v", av), "没了")
+		return
+	}
+	task := taskOf(lgt, ref.Index, ref.Type)
+	if task == nil {
+		Logger.Info("task/retval is nil, ignore")
+		return
+	}
 
-			av := types.GetVersion(lgt.Name, lgt.Version)
-			if av == nil {
-				Logger.Info(fmt.Sprintf("AppVersion %v", av), "没了")
-				continue
-			}
+	switch m.Kind {
+	case types.MSG_PROGRESS:
+		var p types.Progress
+		m.Decode(&p)
+		doProgress(av, host, task, &p)
+	case types.MSG_LOG:
+		var l types.Log
+		m.Decode(&l)
+		doLog(task, ref.Type, l.Line)
+	case types.MSG_ERROR:
+		var e types.TaskError
+		m.Decode(&e)
+		doError(task, ref.Type, e.Message)
+	case types.MSG_RESULT:
+		var r types.Result
+		m.Decode(&r)
+		switch ref.Type {
+		case types.ADD:
+			doAdd(av, host, task, &r)
+		case types.REMOVE:
+			doRemove(task, &r)
+		case types.BUILD:
+			doBuild(av, task, &r)
+		case types.TEST:
+			doTest(task, &r)
+		}
+	}
 
-			lt := lgt.Tasks
-
-			switch taskReply.Type {
-			case types.ADD:
-				doAdd(av, host, lt.Add, taskReply)
-			case types.REMOVE:
-				doRemove(lt.Remove, taskReply)
-			case types.BUILD:
-				doBuild(av, lt.Build, taskReply)
-			case types.TEST:
-				doTest(av, lt.Add, taskReply)
-			case types.INFO:
-				doStatus(host, taskReply.Data)
-			}
+	if lgt.Done() {
 
-			if lgt.Done() {
+		for _, subappname := range lgt.RestartSubAppNames() {
+			LeviHub.done <- &NInfo{av.ID, subappname, lgt.JobIDs()}
+		}
 
-				for _, subappname := range lgt.RestartSubAppNames() {
-					LeviHub.done <- &NInfo{av.ID, subappname}
-				}
+		if lgt.RestartImmediately(host, av.Name) {
+			LeviHub.flush()
+		}
 
-				if lgt.RestartImmediately(host, av.Name) {
-					LeviHub.immediate <- true
-				}
+		lgt.Finish()
+		delete(self.waiting, ref.ID)
+	}
+}
 
-				delete(self.waiting, taskUUID)
-			}
-		}
+// dot 重启过或者 levi 换了连接, 从库里把这组任务找回来
+func (self *Levi) group(uuid string) *types.LeviGroupedTask {
+	lgt, exists := self.waiting[uuid]
+	if exists {
+		return lgt
 	}
+	if lgt = types.GetGroupedTask(uuid); lgt != nil {
+		self.waiting[uuid] = lgt
+	}
+	return lgt
+}
+
+// 测试任务也是放在 Add 里的
+func taskOf(lgt *types.LeviGroupedTask, index, kind int) *types.Task {
+	var tasks []*types.Task
+	switch kind {
+	case types.ADD, types.TEST:
+		tasks = lgt.Tasks.Add
+	case types.REMOVE:
+		tasks = lgt.Tasks.Remove
+	case types.BUILD:
+		tasks = lgt.Tasks.Build
+	}
+	if index < 0 || index >= len(tasks) {
+		return nil
+	}
+	return tasks[index]
 }
 
 func (self *Levi) Len() int {
@@ -180,153 +462,153 @@ func (self *Levi) Len() int {
 }
 
 // status没有关联task, 不要担心
-func doStatus(host *types.Host, data string) {
-	r := strings.Split(data, "|")
-	// status|name|containerId
-	if len(r) != 3 {
+func doStatus(host *types.Host, status *types.Status) {
+	if status.Status == "die" {
+		Logger.Info("Should delete ", status.Container, " of ", status.Name)
+		if c := types.GetContainerByCid(status.Container); c != nil {
+			// 不要发 RemoveContainerTask, 删容器本身也会报 die
+			onContainerDie(host, c, status.ExitCode)
+		} else {
+			Logger.Info("Container ", status.Container, " already removed")
+		}
+	}
+}
+
+// 测试容器起来了, 先记下来, 等 TEST 的结果再删
+func doProgress(av *types.AppVersion, host *types.Host, task *types.Task, p *types.Progress) {
+	if !task.IsTest() {
+		Logger.Debug("Add progress: ", p.Container)
 		return
 	}
-	status, name, containerId := r[0], r[1], r[2]
-	if status == "die" {
-		Logger.Info("Should delete ", containerId, " of ", name)
-		if c := types.GetContainerByCid(containerId); c != nil {
-			// 不要发了
-			// LeviHub.Dispatch(host.IP, types.RemoveContainerTask(c))
+	if job := types.GetJob(task.ID); job != nil {
+		if p.Container != "" {
+			job.SetResult(p.Container)
+			types.NewContainer(av, host, task.Bind, p.Container, task.Test, task.SubApp, task.Entrypoint, task.GetEnvironment(), "", task.Memory, task.CpuShare)
+			types.BindCores(task.ID, p.Container)
 		} else {
-			Logger.Info("Container ", containerId, " already removed")
+			job.Done(types.FAIL, "failed when create testing container")
+			types.ReleaseJobCores(task.ID)
 		}
 	}
 }
 
-func doAdd(av *types.AppVersion, host *types.Host, tasks []*types.Task, reply types.TaskReply) {
-	task, retval := tasks[reply.Index], reply.Data
-	if task == nil {
-		Logger.Info("task/retval is nil, ignore")
-		return
+func doLog(task *types.Task, kind int, line string) {
+	switch kind {
+	case types.BUILD, types.TEST:
+		streamLogHub.GetBufferedLog(task.ID, true).Feed(line)
+	default:
+		// TODO 记录下AddContainer/RemoveContainer的日志流返回
+		Logger.Debug("Task ", task.ID, " output stream: ", line)
 	}
+}
+
+// levi 那边出错了, 没有结果
+func doError(task *types.Task, kind int, message string) {
+	Logger.Info("Task ", task.ID, " error: ", message)
 	if job := types.GetJob(task.ID); job != nil {
-		switch reply.Done {
-		case true:
-			if !task.IsTest() {
-				if retval != "" {
-					job.Done(types.SUCC, retval)
-					types.NewContainer(av, host, task.Bind, retval, task.Daemon, task.SubApp)
-				} else {
-					job.Done(types.FAIL, retval)
-				}
-			} else {
-				// 理论上不可能出现任务是测试Type是ADD_TASK同时又是Done为true的
-				job.Done(types.FAIL, retval)
+		if kind == types.TEST {
+			if c := types.GetContainerByCid(job.Result); c != nil {
+				c.Delete()
 			}
-			task.Done()
-		case false:
-			if !task.IsTest() {
-				Logger.Debug("Add output stream: ", retval)
-				// TODO 记录下AddContainer的日志流返回
-			} else {
-				// 如果测试任务就没返回容器值, 那么直接挂
-				if retval != "" {
-					job.SetResult(retval)
-					types.NewContainer(av, host, task.Bind, retval, task.Test, task.SubApp)
-				} else {
-					job.Done(types.FAIL, "failed when create testing container")
-				}
+		}
+		job.Done(types.FAIL, message)
+	}
+	if kind == types.ADD || kind == types.TEST {
+		types.ReleaseJobCores(task.ID)
+	}
+	// 没删掉, 放回 nginx
+	if kind == types.REMOVE {
+		if c := types.GetContainerByCid(task.Container); c != nil {
+			c.SetStopping(false)
+			if av := c.AppVersion(); av != nil {
+				LeviHub.done <- &NInfo{av.ID, c.SubApp, nil}
 			}
 		}
 	}
-
+	if kind == types.BUILD || kind == types.TEST {
+		streamLogHub.RemoveBufferedLog(task.ID)
+	}
+	task.Done()
 }
 
-func doTest(av *types.AppVersion, tasks []*types.Task, reply types.TaskReply) {
-	task, retval := tasks[reply.Index], reply.Data
-	b := streamLogHub.GetBufferedLog(task.ID, true)
-	if task == nil {
-		Logger.Info("task/retval is nil, ignore")
-		return
-	}
+func doAdd(av *types.AppVersion, host *types.Host, task *types.Task, r *types.Result) {
 	if job := types.GetJob(task.ID); job != nil {
-		b.Feed(retval)
-		switch reply.Done {
-		case false:
-			// TODO 记录下TestContainer的日志流返回
-			Logger.Debug("Test output stream: ", retval)
-		case true:
-			if task.IsTest() {
-				container := types.GetContainerByCid(job.Result)
-				if container == nil {
-					return
-				}
-				if retval == "0" {
-					job.Done(types.SUCC, fmt.Sprintf("%s|%s", container.IdentID, retval))
-				} else {
-					job.Done(types.FAIL, fmt.Sprintf("%s|%s", container.IdentID, retval))
+		if r.OK {
+			job.Done(types.SUCC, r.Container)
+			if c := types.NewContainer(av, host, task.Bind, r.Container, task.Daemon, task.SubApp, task.Entrypoint, task.GetEnvironment(), task.InitialHealth(), task.Memory, task.CpuShare); c != nil {
+				c.AddPorts(task.Ports)
+				if task.Restarts > 0 {
+					c.SetRestarts(task.Restarts)
 				}
-				container.Delete()
-				streamLogHub.RemoveBufferedLog(task.ID)
 			}
-			task.Done()
+			types.BindCores(task.ID, r.Container)
+			// 新的起来了才去删老的, 失败了老的不动
+			if task.Type == types.UPDATECONTAINER {
+				go LeviHub.replaceContainer(task.ID)
+			}
+		} else {
+			job.Done(types.FAIL, r.Container)
+			types.ReleaseTask(host, task)
 		}
+		task.Done()
 	}
-
 }
 
-func doBuild(av *types.AppVersion, tasks []*types.Task, reply types.TaskReply) {
-	task, retval := tasks[reply.Index], reply.Data
-	b := streamLogHub.GetBufferedLog(task.ID, true)
-	b.Feed(retval)
-
-	if task == nil {
-		Logger.Info("task/retval is nil, ignore")
-		return
-	}
-
-	switch reply.Done {
-	case false:
-		Logger.Debug("Build output stream: ", retval)
-	case true:
-		appUserUid := av.UserUID()
-		staticPath := path.Join(config.Config.Nginx.Staticdir, av.Name, av.Version)
-		staticSrcPath := path.Join(config.Config.Nginx.Staticsrcdir, av.Name, av.Version)
-		if err := CopyFiles(staticPath, staticSrcPath, appUserUid, appUserUid); err != nil {
-			Logger.Info("copy files error: ", err)
+func doTest(task *types.Task, r *types.Result) {
+	if job := types.GetJob(task.ID); job != nil {
+		container := types.GetContainerByCid(job.Result)
+		if container == nil {
+			return
 		}
-		if job := types.GetJob(task.ID); job != nil {
-			if retval != "" {
-				job.Done(types.SUCC, retval)
-				av.SetImageAddr(retval)
-			} else {
-				job.Done(types.FAIL, retval)
-			}
+		result := fmt.Sprintf("%s|%d", container.IdentID, r.ExitCode)
+		if r.OK {
+			job.Done(types.SUCC, result)
+		} else {
+			job.Done(types.FAIL, result)
 		}
+		container.Delete()
 		streamLogHub.RemoveBufferedLog(task.ID)
 		task.Done()
 	}
 }
 
-func doRemove(tasks []*types.Task, reply types.TaskReply) {
-	task, retval := tasks[reply.Index], reply.Data
-
-	if task == nil {
-		Logger.Info("task/retval is nil, ignore")
-		return
+func doBuild(av *types.AppVersion, task *types.Task, r *types.Result) {
+	appUserUid := av.UserUID()
+	staticPath := path.Join(config.Config.Nginx.Staticdir, av.Name, av.Version)
+	staticSrcPath := path.Join(config.Config.Nginx.Staticsrcdir, av.Name, av.Version)
+	if err := CopyFiles(staticPath, staticSrcPath, appUserUid, appUserUid); err != nil {
+		Logger.Info("copy files error: ", err)
 	}
-	switch reply.Done {
-	case false:
-		Logger.Debug("Remove output stream: ", retval)
-	case true:
-		if old := types.GetContainerByCid(task.Container); old != nil {
-			old.Delete()
+	if job := types.GetJob(task.ID); job != nil {
+		if r.OK {
+			job.Done(types.SUCC, r.Image)
+			av.SetImageAddr(r.Image)
 		} else {
-			Logger.Info("要删的容器已经不在了")
+			job.Done(types.FAIL, r.Image)
 		}
-		// build 根据返回值来判断是不是成功
-		if job := types.GetJob(task.ID); job != nil {
-			if retval == "1" {
-				job.Done(types.SUCC, "removed")
-			} else {
-				job.Done(types.FAIL, "not removed")
+	}
+	streamLogHub.RemoveBufferedLog(task.ID)
+	task.Done()
+}
+
+func doRemove(task *types.Task, r *types.Result) {
+	if old := types.GetContainerByCid(task.Container); old != nil {
+		old.Delete()
+	} else {
+		Logger.Info("要删的容器已经不在了")
+	}
+	// build 根据返回值来判断是不是成功
+	// update 的 job 结果是新容器, 老的删掉了就不改了
+	if job := types.GetJob(task.ID); job != nil {
+		if job.Kind == types.UPDATECONTAINER {
+			if !r.OK {
+				job.Done(types.FAIL, "old container not removed")
 			}
+		} else if r.OK {
+			job.Done(types.SUCC, "removed")
+		} else {
+			job.Done(types.FAIL, "not removed")
 		}
-		task.Done()
 	}
+	task.Done()
 }
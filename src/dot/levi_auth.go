@@ -0,0 +1,86 @@
+package dot
+
+import (
+	"crypto/hmac"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"config"
+	. "utils"
+)
+
+const leviSignatureWindow = 5 * time.Minute
+
+var (
+	NoLeviCredential     = errors.New("no levi credential")
+	InvalidLeviSignature = errors.New("invalid levi signature")
+	ExpiredLeviSignature = errors.New("levi signature expired")
+)
+
+// dot 配了证书就走 https/wss, 配了 ca 就顺便验 levi 的客户端证书
+func ServerTLSConfig() (*tls.Config, error) {
+	conf := &tls.Config{}
+	if config.Config.TLS.CA == "" {
+		return conf, nil
+	}
+	pem, err := ioutil.ReadFile(config.Config.TLS.CA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificate in " + config.Config.TLS.CA)
+	}
+	conf.ClientCAs = pool
+	// api 的客户端不带证书, 所以只是给了就验
+	conf.ClientAuth = tls.VerifyClientCertIfGiven
+	return conf, nil
+}
+
+// 从凭证里拿 levi 的 host, 不再相信来源地址
+// 客户端证书: 第一个 IP SAN, 没有就用 CN
+// token: NBE-Levi-Host, NBE-Levi-Timestamp, NBE-Levi-Signature
+// signature = hex(hmac-sha256(secret, "host|timestamp"))
+func leviIdentity(r *http.Request) (string, error) {
+	if !config.Config.LeviAuth.Enable {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		return host, err
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cert := r.TLS.VerifiedChains[0][0]
+		if len(cert.IPAddresses) > 0 {
+			return cert.IPAddresses[0].String(), nil
+		}
+		if cert.Subject.CommonName != "" {
+			return cert.Subject.CommonName, nil
+		}
+	}
+
+	host := r.Header.Get("NBE-Levi-Host")
+	if host == "" {
+		return "", NoLeviCredential
+	}
+	if config.Config.LeviAuth.Secret == "" {
+		return "", InvalidLeviSignature
+	}
+	ts := r.Header.Get("NBE-Levi-Timestamp")
+	sent, err := hex.DecodeString(r.Header.Get("NBE-Levi-Signature"))
+	if err != nil || !hmac.Equal(sent, HMACSign(config.Config.LeviAuth.Secret, host, ts)) {
+		return "", InvalidLeviSignature
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return "", InvalidLeviSignature
+	}
+	if d := time.Since(time.Unix(unix, 0)); d > leviSignatureWindow || d < -leviSignatureWindow {
+		return "", ExpiredLeviSignature
+	}
+	return host, nil
+}
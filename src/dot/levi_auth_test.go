@@ -0,0 +1,63 @@
+package dot
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"config"
+	. "utils"
+)
+
+func TestLeviIdentity(t *testing.T) {
+	saved := config.Config.LeviAuth
+	defer func() { config.Config.LeviAuth = saved }()
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Add(-2*leviSignatureWindow).Unix(), 10)
+	sign := func(secret, host, ts string) string {
+		return hex.EncodeToString(HMACSign(secret, host, ts))
+	}
+	chain := func(cert *x509.Certificate) *tls.ConnectionState {
+		return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	}
+
+	cases := []struct {
+		name    string
+		enable  bool
+		remote  string
+		tls     *tls.ConnectionState
+		headers map[string]string
+		host    string
+		err     error
+	}{
+		{"disabled uses remote addr", false, "10.0.0.1:5000", nil, map[string]string{"NBE-Levi-Host": "10.0.0.9"}, "10.0.0.1", nil},
+		{"cert ip san", true, "10.0.0.1:5000", chain(&x509.Certificate{IPAddresses: []net.IP{net.ParseIP("10.0.0.2")}, Subject: pkix.Name{CommonName: "cn"}}), nil, "10.0.0.2", nil},
+		{"cert cn", true, "10.0.0.1:5000", chain(&x509.Certificate{Subject: pkix.Name{CommonName: "10.0.0.3"}}), nil, "10.0.0.3", nil},
+		{"no credential", true, "10.0.0.1:5000", nil, nil, "", NoLeviCredential},
+		{"signature", true, "10.0.0.1:5000", nil, map[string]string{"NBE-Levi-Host": "10.0.0.4", "NBE-Levi-Timestamp": now, "NBE-Levi-Signature": sign("s3cret", "10.0.0.4", now)}, "10.0.0.4", nil},
+		{"other host", true, "10.0.0.1:5000", nil, map[string]string{"NBE-Levi-Host": "10.0.0.5", "NBE-Levi-Timestamp": now, "NBE-Levi-Signature": sign("s3cret", "10.0.0.4", now)}, "", InvalidLeviSignature},
+		{"wrong secret", true, "10.0.0.1:5000", nil, map[string]string{"NBE-Levi-Host": "10.0.0.4", "NBE-Levi-Timestamp": now, "NBE-Levi-Signature": sign("other", "10.0.0.4", now)}, "", InvalidLeviSignature},
+		{"bad timestamp", true, "10.0.0.1:5000", nil, map[string]string{"NBE-Levi-Host": "10.0.0.4", "NBE-Levi-Timestamp": "x", "NBE-Levi-Signature": sign("s3cret", "10.0.0.4", "x")}, "", InvalidLeviSignature},
+		{"expired", true, "10.0.0.1:5000", nil, map[string]string{"NBE-Levi-Host": "10.0.0.4", "NBE-Levi-Timestamp": old, "NBE-Levi-Signature": sign("s3cret", "10.0.0.4", old)}, "", ExpiredLeviSignature},
+	}
+	for _, c := range cases {
+		config.Config.LeviAuth = config.LeviAuthConfig{Enable: c.enable, Secret: "s3cret"}
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.remote
+		r.TLS = c.tls
+		for k, v := range c.headers {
+			r.Header.Set(k, v)
+		}
+		host, err := leviIdentity(r)
+		if host != c.host || err != c.err {
+			t.Errorf("%s: leviIdentity = %q, %v, want %q, %v", c.name, host, err, c.host, c.err)
+		}
+	}
+}
@@ -1,52 +1,487 @@
 package dot
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"sync"
 	"text/template"
+
+	"config"
+	. "utils"
 )
 
-func UpstreamConf(name string, ups []string, tmplPath, targetPath string) error {
-	f, err := os.Create(targetPath)
-	defer f.Close()
-	if err != nil {
-		return err
+// 用模板渲染配置, Reload 的时候先在 staging 里 nginx -t, 过了再原子地换上去
+// 换上去之后 nginx -t 或者 reload 失败就把原来的文件放回去, 最后用 res 同步到 nginx 那边
+type NginxIngress struct {
+	sync.Mutex
+	// 等着 Reload 的改动, key 是本地的路径
+	pending map[string]*nginxFile
+}
+
+// remove 是要删掉, 做备份的时候是本来就没有; secret 的是 key, 只有 owner 能读
+// name 是哪个 upstream 的改动, 测不过的时候按它分开测
+type nginxFile struct {
+	name    string
+	remote  string
+	content []byte
+	remove  bool
+	secret  bool
+}
+
+func NewNginxIngress() *NginxIngress {
+	return &NginxIngress{pending: map[string]*nginxFile{}}
+}
+
+func (self *NginxIngress) paths(name, kind string) (string, string) {
+	n := config.Config.Nginx
+	file := fmt.Sprintf("%s.%s.conf", name, kind)
+	switch kind {
+	case "upstream":
+		return path.Join(n.LocalUpDir, file), path.Join(n.RemoteUpDir, file)
+	case "stream":
+		return path.Join(n.LocalStreamDir, file), path.Join(n.RemoteStreamDir, file)
+	}
+	return path.Join(n.LocalServerDir, file), path.Join(n.RemoteServerDir, file)
+}
+
+// 有这个文件 (或者要写) 才删, 免得每次都去 res nginx_clean
+func (self *NginxIngress) drop(name, kind string) {
+	if self.exists(name, kind) {
+		self.put(name, kind, nil, true)
+	}
+}
+
+func (self *NginxIngress) exists(name, kind string) bool {
+	local, _ := self.paths(name, kind)
+	self.Lock()
+	defer self.Unlock()
+	if f, exists := self.pending[local]; exists {
+		return !f.remove
+	}
+	return FileExists(local)
+}
+
+func (self *NginxIngress) put(name, kind string, content []byte, remove bool) {
+	local, remote := self.paths(name, kind)
+	self.add(local, remote, &nginxFile{name: name, content: content, remove: remove})
+}
+
+func (self *NginxIngress) add(local, remote string, f *nginxFile) {
+	self.Lock()
+	defer self.Unlock()
+	f.remote = remote
+	self.pending[local] = f
+}
+
+// UpStreams 只有地址, 给老的模板用
+func (self *NginxIngress) ApplyUpstream(upstream *Upstream) error {
+	ups := make([]string, len(upstream.Servers))
+	for i, server := range upstream.Servers {
+		ups[i] = server.Addr
 	}
 	data := struct {
 		Name      string
 		UpStreams []string
+		Servers   []*UpstreamServer
 	}{
-		Name:      name,
+		Name:      upstream.Name,
 		UpStreams: ups,
+		Servers:   upstream.Servers,
 	}
-	t := template.Must(template.ParseFiles(tmplPath))
-	err = t.Execute(f, data)
+	content, err := render(config.Config.Nginx.UpstreamTemplate, data)
 	if err != nil {
 		return err
 	}
+	self.put(upstream.Name, "upstream", content, false)
+	self.drop(upstream.Name, "stream")
 	return nil
 }
 
-func ServerConf(name, podname, staticPath, staticDir, tmplPath, targetPath string) error {
-	f, err := os.Create(targetPath)
-	defer f.Close()
+// https 的 server_name, Cert 和 Key 是 nginx 那边的路径
+type httpsServer struct {
+	Name string
+	Cert string
+	Key  string
+}
+
+// 老的模板用 Name.PodName 的 prod 还是一样的
+// 新的模板用 HTTP (正常转发的 server_name), Redirects (跳到 https 的), HTTPS
+// 证书和 key 写在 cert_dir 里, 和配置一起换上去
+func (self *NginxIngress) ApplyServer(server *Server) error {
+	names := server.ServerNames
+	if len(names) == 0 {
+		names = []string{server.ServerName}
+	}
+	data := struct {
+		*Server
+		HTTP      []string
+		Redirects []string
+		HTTPS     []*httpsServer
+	}{Server: server, HTTP: []string{}, Redirects: []string{}, HTTPS: []*httpsServer{}}
+
+	dir := config.Config.Nginx.CertDir
+	if len(server.TLS) > 0 && dir == "" {
+		return errors.New("nginx.cert_dir not configured")
+	}
+	secure := map[string]bool{}
+	for _, t := range server.TLS {
+		file := strings.Replace(t.Domain, "*", "_", 1)
+		data.HTTPS = append(data.HTTPS, &httpsServer{
+			Name: t.Name,
+			Cert: path.Join(dir, file+".crt"),
+			Key:  path.Join(dir, file+".key"),
+		})
+		secure[t.Name] = true
+	}
+	for _, name := range names {
+		if server.Redirect && secure[name] {
+			data.Redirects = append(data.Redirects, name)
+		} else {
+			data.HTTP = append(data.HTTP, name)
+		}
+	}
+
+	content, err := render(config.Config.Nginx.ServerTemplate, data)
 	if err != nil {
 		return err
 	}
-	data := struct {
-		Name    string
-		PodName string
-		Static  string
-		Path    string
-	}{
-		Name:    name,
-		PodName: podname,
-		Static:  staticPath,
-		Path:    staticDir,
+	for i, t := range server.TLS {
+		self.add(data.HTTPS[i].Cert, data.HTTPS[i].Cert, &nginxFile{name: server.Name, content: t.Cert})
+		self.add(data.HTTPS[i].Key, data.HTTPS[i].Key, &nginxFile{name: server.Name, content: t.Key, secret: true})
+	}
+	self.put(server.Name, "server", content, false)
+	return nil
+}
+
+// tcp/udp 用 stream 模板, 写在 local_stream_dir 里
+func (self *NginxIngress) ApplyStream(stream *Stream) error {
+	if config.Config.Nginx.LocalStreamDir == "" {
+		return errors.New("nginx.local_stream_dir not configured")
 	}
-	t := template.Must(template.ParseFiles(tmplPath))
-	err = t.Execute(f, data)
+	content, err := render(config.Config.Nginx.StreamTemplate, stream)
 	if err != nil {
 		return err
 	}
+	self.put(stream.Name, "stream", content, false)
+	self.drop(stream.Name, "upstream")
+	self.drop(stream.Name, "server")
+	return nil
+}
+
+func (self *NginxIngress) Delete(name string) error {
+	for _, kind := range []string{"upstream", "server"} {
+		self.put(name, kind, nil, true)
+	}
+	self.drop(name, "stream")
+	return nil
+}
+
+// 还没 Reload 的改动也算
+func (self *NginxIngress) Exists(name string) bool {
+	for _, kind := range []string{"upstream", "server", "stream"} {
+		if self.exists(name, kind) {
+			return true
+		}
+	}
+	return false
+}
+
+// 测不过的 name 不换, 别的照样换上去, 返回 ReloadErrors
+// 换上去之后 nginx -t 或者 reload 失败的话放回 pending 等下一次
+func (self *NginxIngress) Reload() error {
+	self.Lock()
+	defer self.Unlock()
+	changes, bad := validate(self.pending)
+	self.pending = map[string]*nginxFile{}
+
+	backup, err := swap(changes)
+	if err == nil {
+		err = run("nginx", testArgs()...)
+	}
+	if err == nil {
+		// reload 失败的话文件放回去之后再 reload 一次
+		if err = run("nginx", "-s", "reload"); err != nil {
+			defer run("nginx", "-s", "reload")
+		}
+	}
+	if err != nil {
+		// 没配 conf 的话没测过, 可能就是改动本身的问题, 放回去也过不了
+		if config.Config.Nginx.Conf != "" {
+			self.requeue(changes)
+		}
+		if rerr := restore(backup); rerr != nil {
+			return fmt.Errorf("%s, rollback failed: %s", err, rerr)
+		}
+		return fmt.Errorf("%s, rolled back", err)
+	}
+
+	for local, f := range changes {
+		if f.remove {
+			err = res("nginx_clean", f.remote)
+		} else {
+			err = res("nginx_reload", local, f.remote)
+		}
+		if err != nil {
+			bad[f.name] = err.Error()
+			self.requeue(map[string]*nginxFile{local: f})
+		}
+	}
+	if len(bad) != 0 {
+		return bad
+	}
+	return nil
+}
+
+// 这期间又改了的用新的
+func (self *NginxIngress) requeue(changes map[string]*nginxFile) {
+	for local, f := range changes {
+		if _, exists := self.pending[local]; !exists {
+			self.pending[local] = f
+		}
+	}
+}
+
+// 一起测不过就一个 name 一个 name 地测, 返回能换上去的和测不过的
+func validate(changes map[string]*nginxFile) (map[string]*nginxFile, ReloadErrors) {
+	bad := ReloadErrors{}
+	err := stage(changes)
+	if err == nil {
+		return changes, bad
+	}
+	groups := map[string]map[string]*nginxFile{}
+	for local, f := range changes {
+		if groups[f.name] == nil {
+			groups[f.name] = map[string]*nginxFile{}
+		}
+		groups[f.name][local] = f
+	}
+	good := map[string]*nginxFile{}
+	for name, files := range groups {
+		if e := stage(files); e != nil {
+			bad[name] = fmt.Sprintf("nginx config test failed: %s", e)
+			continue
+		}
+		for local, f := range files {
+			good[local] = f
+		}
+	}
+	// 单个都过了合起来不过, 或者过了的合起来还是不过, 只能都不换
+	if len(bad) == 0 || stage(good) != nil {
+		for name := range groups {
+			bad[name] = fmt.Sprintf("nginx config test failed, nothing changed: %s", err)
+		}
+		return map[string]*nginxFile{}, bad
+	}
+	return good, bad
+}
+
+func testArgs() []string {
+	if conf := config.Config.Nginx.Conf; conf != "" {
+		return []string{"-t", "-c", conf}
+	}
+	return []string{"-t"}
+}
+
+// 把现在的配置, 证书和这次的改动放到 staging 目录里
+// conf 和配置文件里的本地目录换成 staging 的再 nginx -t, 没配 conf 的话只能换上去之后再测
+func stage(changes map[string]*nginxFile) error {
+	n := config.Config.Nginx
+	if n.Conf == "" || len(changes) == 0 {
+		return nil
+	}
+	dir := n.StagingDir
+	if dir == "" {
+		tmp, err := ioutil.TempDir("", "dot-nginx")
+		if err != nil {
+			return err
+		}
+		dir = tmp
+	} else if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	// up 和 server 可能是一个目录
+	dirs := map[string]string{}
+	for _, local := range []string{n.LocalUpDir, n.LocalServerDir, n.LocalStreamDir, n.CertDir} {
+		if local == "" {
+			continue
+		}
+		local = path.Clean(local)
+		if _, exists := dirs[local]; !exists {
+			dirs[local] = path.Join(dir, fmt.Sprintf("d%d", len(dirs)))
+		}
+	}
+	for local, staging := range dirs {
+		if err := copyFiles(local, staging); err != nil {
+			return err
+		}
+	}
+	for local, f := range changes {
+		target := path.Join(dirs[path.Dir(local)], path.Base(local))
+		if err := put(target, f); err != nil {
+			return err
+		}
+	}
+
+	// 长的先换, 免得一个是另一个的前缀
+	locals := []string{}
+	for local := range dirs {
+		locals = append(locals, local)
+	}
+	sort.Sort(sort.Reverse(byLength(locals)))
+	rewrite := func(s string) string {
+		for _, local := range locals {
+			s = strings.Replace(s, local, dirs[local], -1)
+		}
+		return s
+	}
+	for _, staging := range dirs {
+		files, err := ioutil.ReadDir(staging)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if !strings.HasSuffix(file.Name(), ".conf") {
+				continue
+			}
+			p := path.Join(staging, file.Name())
+			content, err := ioutil.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(p, []byte(rewrite(string(content))), 0644); err != nil {
+				return err
+			}
+		}
+	}
+
+	conf, err := ioutil.ReadFile(n.Conf)
+	if err != nil {
+		return err
+	}
+	// 和 conf 放一个目录, 相对路径的 include 才找得到
+	testConf := n.Conf + ".dot-test"
+	if err := ioutil.WriteFile(testConf, []byte(rewrite(string(conf))), 0644); err != nil {
+		return err
+	}
+	defer os.Remove(testConf)
+	return run("nginx", "-t", "-c", testConf)
+}
+
+type byLength []string
+
+func (b byLength) Len() int           { return len(b) }
+func (b byLength) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byLength) Less(i, j int) bool { return len(b[i]) < len(b[j]) }
+
+// 写了一半的 .tmp 不要
+func copyFiles(src, dst string) error {
+	if err := os.MkdirAll(dst, 0700); err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(src)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, file := range files {
+		if !file.Mode().IsRegular() || strings.HasSuffix(file.Name(), ".tmp") {
+			continue
+		}
+		content, err := ioutil.ReadFile(path.Join(src, file.Name()))
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path.Join(dst, file.Name()), content, file.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 把改动换上去, 返回原来的文件; 出错的时候已经换了的也在里面
+func swap(changes map[string]*nginxFile) (map[string]*nginxFile, error) {
+	backup := map[string]*nginxFile{}
+	for local, f := range changes {
+		old := &nginxFile{remote: f.remote, secret: f.secret}
+		content, err := ioutil.ReadFile(local)
+		if os.IsNotExist(err) {
+			old.remove = true
+		} else if err != nil {
+			return backup, err
+		}
+		old.content = content
+		backup[local] = old
+		if err := put(local, f); err != nil {
+			return backup, err
+		}
+	}
+	return backup, nil
+}
+
+func restore(backup map[string]*nginxFile) error {
+	errs := []string{}
+	for local, f := range backup {
+		if err := put(local, f); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// 先写到同一个目录的临时文件再 rename, nginx 不会读到写了一半的
+func put(target string, f *nginxFile) error {
+	if f.remove {
+		if err := EnsureFileAbsent(target); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	mode := os.FileMode(0644)
+	if f.secret {
+		mode = 0600
+	}
+	tmp := target + ".tmp"
+	if err := ioutil.WriteFile(tmp, f.content, mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp, target)
+}
+
+func render(tmplPath string, data interface{}) ([]byte, error) {
+	t, err := template.ParseFiles(tmplPath)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func res(args ...string) error {
+	return run("res", args...)
+}
+
+// 出错的时候把输出也带上
+func run(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %s %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
 	return nil
 }
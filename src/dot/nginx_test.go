@@ -0,0 +1,469 @@
+package dot
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+
+	"config"
+	. "utils"
+)
+
+func readFile(t *testing.T, p string) string {
+	content, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func writeFile(t *testing.T, p, content string) {
+	if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func listDir(t *testing.T, dir string) []string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestPut(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dot-nginx-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFile(t, path.Join(dir, "old.conf"), "old")
+
+	cases := []struct {
+		name    string
+		file    string
+		f       *nginxFile
+		content string
+		exists  bool
+		mode    os.FileMode
+	}{
+		{"new", "a.conf", &nginxFile{content: []byte("a")}, "a", true, 0644},
+		{"overwrite", "old.conf", &nginxFile{content: []byte("new")}, "new", true, 0644},
+		{"secret", "a.key", &nginxFile{content: []byte("key"), secret: true}, "key", true, 0600},
+		{"remove", "old.conf", &nginxFile{remove: true}, "", false, 0},
+		{"remove missing", "none.conf", &nginxFile{remove: true}, "", false, 0},
+	}
+	for _, c := range cases {
+		target := path.Join(dir, c.file)
+		if err := put(target, c.f); err != nil {
+			t.Errorf("%s: put error: %s", c.name, err)
+			continue
+		}
+		info, err := os.Stat(target)
+		if !c.exists {
+			if err == nil {
+				t.Errorf("%s: %s still exists", c.name, c.file)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		if got := readFile(t, target); got != c.content {
+			t.Errorf("%s: content = %q, want %q", c.name, got, c.content)
+		}
+		if info.Mode().Perm() != c.mode {
+			t.Errorf("%s: mode = %v, want %v", c.name, info.Mode().Perm(), c.mode)
+		}
+	}
+	for _, name := range listDir(t, dir) {
+		if strings.HasSuffix(name, ".tmp") {
+			t.Errorf("left %s behind", name)
+		}
+	}
+}
+
+func TestCopyFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dot-nginx-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src, dst := path.Join(dir, "src"), path.Join(dir, "dst")
+	writeFile(t, path.Join(src, "a.conf"), "a")
+	writeFile(t, path.Join(src, "b.key"), "b")
+	writeFile(t, path.Join(src, "c.conf.tmp"), "half")
+	writeFile(t, path.Join(src, "sub", "d.conf"), "d")
+	os.Chmod(path.Join(src, "b.key"), 0600)
+
+	if err := copyFiles(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := listDir(t, dst), []string{"a.conf", "b.key"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("copied %v, want %v", got, want)
+	}
+	if got := readFile(t, path.Join(dst, "a.conf")); got != "a" {
+		t.Errorf("a.conf = %q", got)
+	}
+	if info, err := os.Stat(path.Join(dst, "b.key")); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("b.key mode not kept: %v", err)
+	}
+
+	// 还没有的目录当作空的
+	empty := path.Join(dir, "empty")
+	if err := copyFiles(path.Join(dir, "none"), empty); err != nil {
+		t.Fatal(err)
+	}
+	if got := listDir(t, empty); len(got) != 0 {
+		t.Errorf("copied %v from missing dir", got)
+	}
+}
+
+func TestSwapRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dot-nginx-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFile(t, path.Join(dir, "a.conf"), "old a")
+	writeFile(t, path.Join(dir, "c.conf"), "old c")
+	writeFile(t, path.Join(dir, "d.conf"), "old d")
+
+	changes := map[string]*nginxFile{
+		path.Join(dir, "a.conf"): {content: []byte("new a")},
+		path.Join(dir, "b.conf"): {content: []byte("new b")},
+		path.Join(dir, "c.conf"): {remove: true},
+		path.Join(dir, "e.conf"): {remove: true},
+	}
+	backup, err := swap(changes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := listDir(t, dir), []string{"a.conf", "b.conf", "d.conf"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("after swap %v, want %v", got, want)
+	}
+	if got := readFile(t, path.Join(dir, "a.conf")); got != "new a" {
+		t.Errorf("a.conf = %q after swap", got)
+	}
+	if len(backup) != len(changes) {
+		t.Errorf("backup has %d files, want %d", len(backup), len(changes))
+	}
+	if !backup[path.Join(dir, "b.conf")].remove || !backup[path.Join(dir, "e.conf")].remove {
+		t.Error("files that didn't exist should be removed on restore")
+	}
+
+	if err := restore(backup); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := listDir(t, dir), []string{"a.conf", "c.conf", "d.conf"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("after restore %v, want %v", got, want)
+	}
+	for name, want := range map[string]string{"a.conf": "old a", "c.conf": "old c", "d.conf": "old d"} {
+		if got := readFile(t, path.Join(dir, name)); got != want {
+			t.Errorf("%s = %q after restore, want %q", name, got, want)
+		}
+	}
+}
+
+// 临时目录里的 nginx 和 res
+// nginx -t 的时候哪个文件里有 BROKEN 就失败, 有 fail-reload 的时候 -s reload 失败
+// 参数都记到 log 里, nginx -t -c 的 conf 复制一份到 tested.conf
+type fakeNginx struct {
+	root string
+	bin  string
+	path string
+}
+
+func newFakeNginx(t *testing.T) *fakeNginx {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs /bin/sh")
+	}
+	root, err := ioutil.TempDir("", "dot-nginx-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeNginx{root: root, bin: path.Join(root, "bin"), path: os.Getenv("PATH")}
+	nginx := `#!/bin/sh
+echo "nginx $@" >> ` + f.bin + `/log
+if [ "$1" = "-t" ]; then
+	if [ "$2" = "-c" ]; then
+		cp "$3" ` + f.bin + `/tested.conf
+	fi
+	if grep -rqs BROKEN ` + path.Join(root, "conf") + `; then
+		echo "BROKEN found" >&2
+		exit 1
+	fi
+fi
+if [ "$1" = "-s" ] && [ -f ` + f.bin + `/fail-reload ]; then
+	exit 1
+fi
+exit 0
+`
+	res := `#!/bin/sh
+echo "res $@" >> ` + f.bin + `/log
+`
+	writeFile(t, path.Join(f.bin, "nginx"), nginx)
+	writeFile(t, path.Join(f.bin, "res"), res)
+	os.Chmod(path.Join(f.bin, "nginx"), 0755)
+	os.Chmod(path.Join(f.bin, "res"), 0755)
+	os.Setenv("PATH", f.bin+":"+f.path)
+
+	conf := path.Join(root, "conf")
+	writeFile(t, path.Join(root, "tmpl", "upstream.tmpl"), "upstream {{.Name}} {\n{{range .Servers}}    server {{.Addr}};\n{{end}}}\n")
+	writeFile(t, path.Join(root, "tmpl", "server.tmpl"), "server {\n    server_name{{range .HTTP}} {{.}}{{end}};\n    location / { proxy_pass http://{{.Name}}; }\n}\n")
+	writeFile(t, path.Join(root, "tmpl", "stream.tmpl"), "server {\n    listen {{.Listen}};\n}\n")
+	writeFile(t, path.Join(conf, "nginx.conf"), "http {\n    include "+path.Join(conf, "up")+"/*.conf;\n    include "+path.Join(conf, "server")+"/*.conf;\n}\n")
+	config.Config.Nginx = config.NginxConfig{
+		Conf:             path.Join(conf, "nginx.conf"),
+		UpstreamTemplate: path.Join(root, "tmpl", "upstream.tmpl"),
+		LocalUpDir:       path.Join(conf, "up"),
+		RemoteUpDir:      "/remote/up",
+		ServerTemplate:   path.Join(root, "tmpl", "server.tmpl"),
+		LocalServerDir:   path.Join(conf, "server"),
+		RemoteServerDir:  "/remote/server",
+		StreamTemplate:   path.Join(root, "tmpl", "stream.tmpl"),
+		LocalStreamDir:   path.Join(conf, "stream"),
+		RemoteStreamDir:  "/remote/stream",
+		StagingDir:       path.Join(conf, "staging"),
+	}
+	for _, dir := range []string{"up", "server", "stream"} {
+		os.MkdirAll(path.Join(conf, dir), 0755)
+	}
+	return f
+}
+
+func (f *fakeNginx) Close() {
+	os.Setenv("PATH", f.path)
+	os.RemoveAll(f.root)
+}
+
+func (f *fakeNginx) log(t *testing.T) []string {
+	content, err := ioutil.ReadFile(path.Join(f.bin, "log"))
+	if os.IsNotExist(err) {
+		return []string{}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(path.Join(f.bin, "log"))
+	return strings.Split(strings.TrimSpace(string(content)), "\n")
+}
+
+func (f *fakeNginx) local(dir, file string) string {
+	return path.Join(f.root, "conf", dir, file)
+}
+
+func TestStage(t *testing.T) {
+	saved := config.Config.Nginx
+	defer func() { config.Config.Nginx = saved }()
+	f := newFakeNginx(t)
+	defer f.Close()
+	writeFile(t, f.local("up", "web.upstream.conf"), "upstream web {}\n")
+
+	good := map[string]*nginxFile{f.local("up", "blog.upstream.conf"): {name: "blog", content: []byte("upstream blog {}\n")}}
+	broken := map[string]*nginxFile{f.local("up", "blog.upstream.conf"): {name: "blog", content: []byte("BROKEN\n")}}
+
+	if err := stage(good); err != nil {
+		t.Fatalf("stage: %s", err)
+	}
+	tested := readFile(t, path.Join(f.bin, "tested.conf"))
+	if strings.Contains(tested, f.local("up", "")) || !strings.Contains(tested, path.Join(f.root, "conf", "staging")) {
+		t.Errorf("conf not rewritten to staging: %s", tested)
+	}
+	// 测完 staging 和测试用的 conf 都不留, 本来的目录不动
+	if FileExists(config.Config.Nginx.StagingDir) || FileExists(config.Config.Nginx.Conf+".dot-test") {
+		t.Error("staging left behind")
+	}
+	if got, want := listDir(t, f.local("up", "")), []string{"web.upstream.conf"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("stage touched live dir: %v", got)
+	}
+
+	if err := stage(broken); err == nil {
+		t.Error("stage of broken config passed")
+	}
+
+	// 现有的配置坏了的话什么都测不过
+	writeFile(t, f.local("server", "web.server.conf"), "BROKEN\n")
+	if err := stage(good); err == nil {
+		t.Error("stage passed with broken live config")
+	}
+	os.Remove(f.local("server", "web.server.conf"))
+
+	f.log(t)
+	if err := stage(map[string]*nginxFile{}); err != nil {
+		t.Errorf("stage nothing: %s", err)
+	}
+	config.Config.Nginx.Conf = ""
+	if err := stage(broken); err != nil {
+		t.Errorf("stage without conf: %s", err)
+	}
+	if log := f.log(t); len(log) != 0 {
+		t.Errorf("ran %v without anything to test", log)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	saved := config.Config.Nginx
+	defer func() { config.Config.Nginx = saved }()
+	f := newFakeNginx(t)
+	defer f.Close()
+
+	web := map[string]*nginxFile{
+		f.local("up", "web.upstream.conf"):   {name: "web", content: []byte("upstream web {}\n")},
+		f.local("server", "web.server.conf"): {name: "web", content: []byte("server {}\n")},
+	}
+	blog := map[string]*nginxFile{
+		f.local("up", "blog.upstream.conf"): {name: "blog", content: []byte("BROKEN\n")},
+	}
+	all := map[string]*nginxFile{}
+	for _, g := range []map[string]*nginxFile{web, blog} {
+		for local, file := range g {
+			all[local] = file
+		}
+	}
+
+	cases := []struct {
+		name    string
+		changes map[string]*nginxFile
+		good    []string
+		bad     []string
+	}{
+		{"all good", web, []string{f.local("server", "web.server.conf"), f.local("up", "web.upstream.conf")}, []string{}},
+		{"one broken", all, []string{f.local("server", "web.server.conf"), f.local("up", "web.upstream.conf")}, []string{"blog"}},
+		{"all broken", blog, []string{}, []string{"blog"}},
+	}
+	for _, c := range cases {
+		good, bad := validate(c.changes)
+		locals := []string{}
+		for local := range good {
+			locals = append(locals, local)
+		}
+		sort.Strings(locals)
+		names := []string{}
+		for name := range bad {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if !reflect.DeepEqual(locals, c.good) || !reflect.DeepEqual(names, c.bad) {
+			t.Errorf("%s: validate = %v, %v, want %v, %v", c.name, locals, bad, c.good, c.bad)
+		}
+	}
+}
+
+func TestNginxReload(t *testing.T) {
+	saved := config.Config.Nginx
+	defer func() { config.Config.Nginx = saved }()
+	f := newFakeNginx(t)
+	defer f.Close()
+	ingress := NewNginxIngress()
+
+	// blog 测不过, web 照样换上去
+	if err := ingress.ApplyUpstream(&Upstream{Name: "web", Servers: []*UpstreamServer{{Addr: "10.0.0.1:5000"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ingress.ApplyServer(&Server{Name: "web", ServerName: "web.hunantv.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ingress.ApplyUpstream(&Upstream{Name: "blog", Servers: []*UpstreamServer{{Addr: "BROKEN"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if !ingress.Exists("web") || !ingress.Exists("blog") {
+		t.Error("pending changes should exist")
+	}
+	err := ingress.Reload()
+	errs, ok := err.(ReloadErrors)
+	if !ok || len(errs) != 1 || errs["blog"] == "" {
+		t.Fatalf("Reload = %v, want error of blog only", err)
+	}
+	if !strings.Contains(readFile(t, f.local("up", "web.upstream.conf")), "10.0.0.1:5000") {
+		t.Error("web upstream not written")
+	}
+	if FileExists(f.local("up", "blog.upstream.conf")) {
+		t.Error("broken blog upstream written")
+	}
+	log := strings.Join(f.log(t), "\n")
+	for _, want := range []string{
+		"nginx -s reload",
+		"res nginx_reload " + f.local("up", "web.upstream.conf") + " /remote/up/web.upstream.conf",
+		"res nginx_reload " + f.local("server", "web.server.conf") + " /remote/server/web.server.conf",
+	} {
+		if !strings.Contains(log, want) {
+			t.Errorf("log missing %q:\n%s", want, log)
+		}
+	}
+	if strings.Contains(log, "blog.upstream.conf /remote") {
+		t.Errorf("broken blog synced:\n%s", log)
+	}
+
+	// reload 失败的话换回去, 改动留着下一次再试
+	writeFile(t, path.Join(f.bin, "fail-reload"), "")
+	ingress.ApplyUpstream(&Upstream{Name: "web", Servers: []*UpstreamServer{{Addr: "10.0.0.2:5000"}}})
+	if err := ingress.Reload(); err == nil || !strings.Contains(err.Error(), "rolled back") {
+		t.Fatalf("Reload = %v, want rolled back", err)
+	}
+	if !strings.Contains(readFile(t, f.local("up", "web.upstream.conf")), "10.0.0.1:5000") {
+		t.Error("web upstream not rolled back")
+	}
+	os.Remove(path.Join(f.bin, "fail-reload"))
+	if err := ingress.Reload(); err != nil {
+		t.Fatalf("Reload after fix: %s", err)
+	}
+	if !strings.Contains(readFile(t, f.local("up", "web.upstream.conf")), "10.0.0.2:5000") {
+		t.Error("requeued web upstream not written")
+	}
+
+	// 换成 stream, upstream 和 server 要删掉
+	f.log(t)
+	if err := ingress.ApplyStream(&Stream{Name: "web", Protocol: "tcp", Listen: 9000}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ingress.Reload(); err != nil {
+		t.Fatalf("Reload stream: %s", err)
+	}
+	if got := listDir(t, f.local("up", "")); len(got) != 0 {
+		t.Errorf("upstreams left: %v", got)
+	}
+	if got := listDir(t, f.local("server", "")); len(got) != 0 {
+		t.Errorf("servers left: %v", got)
+	}
+	if !strings.Contains(readFile(t, f.local("stream", "web.stream.conf")), "listen 9000") {
+		t.Error("stream not written")
+	}
+	log = strings.Join(f.log(t), "\n")
+	for _, want := range []string{
+		"res nginx_clean /remote/up/web.upstream.conf",
+		"res nginx_clean /remote/server/web.server.conf",
+		"res nginx_reload " + f.local("stream", "web.stream.conf") + " /remote/stream/web.stream.conf",
+	} {
+		if !strings.Contains(log, want) {
+			t.Errorf("log missing %q:\n%s", want, log)
+		}
+	}
+
+	if err := ingress.Delete("web"); err != nil {
+		t.Fatal(err)
+	}
+	if ingress.Exists("web") {
+		t.Error("deleted web still exists")
+	}
+	if err := ingress.Reload(); err != nil {
+		t.Fatalf("Reload delete: %s", err)
+	}
+	if got := listDir(t, f.local("stream", "")); len(got) != 0 {
+		t.Errorf("streams left: %v", got)
+	}
+}
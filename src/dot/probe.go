@@ -0,0 +1,59 @@
+package dot
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	PROBE_HTTP = "http"
+	PROBE_TCP  = "tcp"
+)
+
+// 对 ip:port 做一次健康检查
+// http 返回码 >= 400 算失败
+func probe(kind, ip string, port int, path string, timeout time.Duration) error {
+	addr := net.JoinHostPort(ip, strconv.Itoa(port))
+	switch kind {
+	case "":
+		return nil
+	case PROBE_TCP:
+		conn, err := net.DialTimeout("tcp", addr, timeout)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+		return nil
+	case PROBE_HTTP:
+		client := &http.Client{Timeout: timeout}
+		resp, err := client.Get(fmt.Sprintf("http://%s%s", addr, path))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("%s%s returns %d", addr, path, resp.StatusCode)
+		}
+		return nil
+	}
+	return errors.New("unknown health check " + kind)
+}
+
+// 一直试到成功或者超时
+func probeUntil(kind, ip string, port int, path string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := probe(kind, ip, port, path, 5*time.Second)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
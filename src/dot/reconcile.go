@@ -0,0 +1,188 @@
+package dot
+
+import (
+	"time"
+
+	"config"
+	"scheduler"
+	"types"
+	. "utils"
+)
+
+const (
+	defaultReconcileInterval = 30
+	defaultReconcileTimeout  = 600
+	defaultQueueRetention    = 72
+)
+
+var Reconciler = &Reconcile{trigger: make(chan bool, 1)}
+
+// 定时把容器调整到 deployment 里声明的样子
+type Reconcile struct {
+	trigger chan bool
+}
+
+func (self *Reconcile) interval() time.Duration {
+	if config.Config.Reconcile.Interval <= 0 {
+		return defaultReconcileInterval * time.Second
+	}
+	return time.Duration(config.Config.Reconcile.Interval) * time.Second
+}
+
+// 超过这个时间还没跑完的任务就不管了, 当它丢了
+func (self *Reconcile) timeout() time.Duration {
+	if config.Config.Reconcile.Timeout <= 0 {
+		return defaultReconcileTimeout * time.Second
+	}
+	return time.Duration(config.Config.Reconcile.Timeout) * time.Second
+}
+
+// 不阻塞, 已经有一个在等就算了
+func (self *Reconcile) Trigger() {
+	select {
+	case self.trigger <- true:
+	default:
+	}
+}
+
+func (self *Reconcile) Run() {
+	for !LeviHub.finished {
+		select {
+		case <-self.trigger:
+		case <-time.After(self.interval()):
+		}
+		if !Elector.IsLeader() {
+			continue
+		}
+		for _, d := range types.GetDeployments("") {
+			self.reconcile(d)
+		}
+		types.PruneQueuedTasks(time.Now().Add(-queueRetention()))
+	}
+}
+
+func queueRetention() time.Duration {
+	if config.Config.Task.QueueRetention <= 0 {
+		return defaultQueueRetention * time.Hour
+	}
+	return time.Duration(config.Config.Task.QueueRetention) * time.Hour
+}
+
+func (self *Reconcile) reconcile(d *types.Deployment) {
+	av := d.AppVersion()
+	if av == nil {
+		Logger.Info("reconcile: version not found ", d.AppName, " ", d.Version)
+		return
+	}
+	appyaml, err := av.GetSubAppYaml(d.SubApp)
+	if err != nil {
+		Logger.Info("reconcile: app.yaml error ", err)
+		return
+	}
+	// 还有任务没跑完, 等下一轮
+	kinds := []int{types.ADDCONTAINER, types.REMOVECONTAINER, types.UPDATECONTAINER}
+	since := time.Now().Add(-self.timeout())
+	if types.HasRunningJobs(d.AppName, kinds, since) || types.HasQueuedRemoves(d.AppName, since) {
+		Logger.Debug("reconcile: ", d.AppName, " has running jobs, skip")
+		return
+	}
+
+	// canary 的容器归 canary 管, promote 之后才归 deployment, 只有 prod 有 canary
+	var canary *types.Canary
+	if d.Env == types.ENV_PROD {
+		canary = types.GetCanary(d.AppName, d.SubApp)
+	}
+
+	// deployment 管的是默认的 web 和 daemon 入口, 别的入口的容器不动
+	webEntry, _ := appyaml.GetEntrypoint("", false)
+	daemonEntry, _ := appyaml.GetEntrypoint("", true)
+
+	var web, oldWeb, daemons, oldDaemons []*types.Container
+	for _, c := range d.Containers() {
+		// 机器不在线的容器当作没有
+		if h := c.Host(); h == nil || h.Status != 0 {
+			continue
+		}
+		// 已经在删的不算, 不然会再发一次 remove/update
+		if c.Stopping || types.IsContainerRemoving(c.ContainerID) {
+			continue
+		}
+		if canary != nil && canary.Status != types.CANARY_PROMOTING && c.Version == canary.Canary {
+			continue
+		}
+		switch {
+		case c.IdentID == "" && !runs(c, webEntry), c.IdentID != "" && !runs(c, daemonEntry):
+			continue
+		case c.IdentID == "" && c.Version == av.Version:
+			web = append(web, c)
+		case c.IdentID == "":
+			oldWeb = append(oldWeb, c)
+		case c.Version == av.Version:
+			daemons = append(daemons, c)
+		default:
+			oldDaemons = append(oldDaemons, c)
+		}
+	}
+	converge(av, appyaml, d.Env, d.Replicas, web, oldWeb, webEntry)
+	converge(av, appyaml, d.Env, d.Daemons, daemons, oldDaemons, daemonEntry)
+}
+
+// 老容器没记入口的当作跑的是默认的
+func runs(c *types.Container, entrypoint *types.Entrypoint) bool {
+	return entrypoint != nil && (c.Entrypoint == "" || c.Entrypoint == entrypoint.Name)
+}
+
+// 旧版本的先升级, 多了删, 少了让 scheduler 找地方加
+func converge(av *types.AppVersion, appyaml *types.AppYaml, env string, want int, current, old []*types.Container, entrypoint *types.Entrypoint) {
+	have := len(current)
+	for _, c := range old {
+		var task *types.Task
+		if have < want {
+			task = types.UpdateContainerTask(c, av)
+			have = have + 1
+		} else {
+			task = types.RemoveContainerTask(c)
+		}
+		dispatchTo(c.Host(), task)
+	}
+
+	if have > want {
+		for _, c := range current[want:] {
+			dispatchTo(c.Host(), types.RemoveContainerTask(c))
+		}
+		return
+	}
+
+	missing := want - have
+	if missing <= 0 {
+		return
+	}
+	if entrypoint == nil {
+		Logger.Info("reconcile: no entrypoint for ", av.Name)
+		return
+	}
+	ps, err := scheduler.Schedule(missing, "", "", !entrypoint.Daemon, appyaml.Resources.For(entrypoint.Name))
+	if err != nil {
+		Logger.Info("reconcile: schedule ", av.Name, " error ", err)
+		return
+	}
+	for i := 0; i < missing; i = i + 1 {
+		host := ps[i].Host
+		task, err := types.AddContainerTask(av, host, appyaml, entrypoint, env)
+		if err != nil {
+			Logger.Info("reconcile: add ", av.Name, " on ", host.IP, " error ", err)
+			continue
+		}
+		dispatchTo(host, task)
+	}
+}
+
+func dispatchTo(host *types.Host, task *types.Task) {
+	if host == nil || task == nil {
+		Logger.Info("reconcile: task created error")
+		return
+	}
+	if err := LeviHub.Dispatch(host.IP, task); err != nil {
+		Logger.Info("reconcile: dispatch error ", err)
+	}
+}
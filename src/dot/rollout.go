@@ -0,0 +1,300 @@
+package dot
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"types"
+	. "utils"
+)
+
+const defaultRolloutTimeout = 300
+
+// 不是 leader 了就停下, 库里的状态留着, 新的 leader 起来的时候会接着处理
+var NotLeader = errors.New("not leader any more")
+
+// 滚动升级, 每批 batchSize 个容器
+// 升完一批做健康检查, 过了才升下一批, 任何一批失败就把升过的都滚回 from
+func StartRollout(from, to *types.AppVersion, hosts []*types.Host,
+	batchSize, pause int, health, healthPath string, timeout int) (*types.Rollout, error) {
+
+	cs := []*types.Container{}
+	if len(hosts) == 0 {
+		cs = from.Containers()
+	} else {
+		for _, host := range hosts {
+			if host != nil {
+				cs = append(cs, types.GetContainerByHostAndAppVersion(host, from)...)
+			}
+		}
+	}
+	if len(cs) == 0 {
+		return nil, errors.New("no container to update")
+	}
+	if health != "" && health != PROBE_HTTP && health != PROBE_TCP {
+		return nil, errors.New("health must be http/tcp")
+	}
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	if timeout <= 0 {
+		timeout = defaultRolloutTimeout
+	}
+	if healthPath == "" {
+		healthPath = "/"
+	}
+
+	r := types.NewRollout(from, to, batchSize, pause, health, healthPath, timeout, cs)
+	if r == nil {
+		return nil, errors.New("rollout created error")
+	}
+	go runRollout(r, from, to)
+	return r, nil
+}
+
+// 这个进程里正在跑的, 换了 leader 的时候旧 leader 上的还在跑就不要再管
+var rollouts = struct {
+	sync.Mutex
+	ids map[int]bool
+}{ids: map[int]bool{}}
+
+func track(r *types.Rollout) bool {
+	rollouts.Lock()
+	defer rollouts.Unlock()
+	if rollouts.ids[r.ID] {
+		return false
+	}
+	rollouts.ids[r.ID] = true
+	return true
+}
+
+func untrack(r *types.Rollout) {
+	rollouts.Lock()
+	defer rollouts.Unlock()
+	delete(rollouts.ids, r.ID)
+}
+
+// dot 重启的时候没跑完的升级都滚回去, 进度都记在 steps 里
+func ResumeRollouts() {
+	for _, r := range types.GetUnfinishedRollouts() {
+		from := types.GetVersion(r.AppName, r.FromVersion)
+		if from == nil {
+			r.Finish(types.ROLLOUT_FAILED, "interrupted by dot restart, version "+r.FromVersion+" not found")
+			continue
+		}
+		if !track(r) {
+			continue
+		}
+		go func(r *types.Rollout) {
+			defer untrack(r)
+			rollback(r, from, errors.New("interrupted by dot restart"))
+		}(r)
+	}
+}
+
+func runRollout(r *types.Rollout, from, to *types.AppVersion) {
+	if !track(r) {
+		return
+	}
+	defer untrack(r)
+	steps := r.GetSteps()
+	for i := 0; i < len(steps); i = i + r.BatchSize {
+		if !Elector.IsLeader() {
+			Logger.Info("rollout ", r.ID, " stopped: ", NotLeader)
+			return
+		}
+		end := i + r.BatchSize
+		if end > len(steps) {
+			end = len(steps)
+		}
+		r.Batch = i/r.BatchSize + 1
+		r.Save()
+
+		n, err := upgradeBatch(r, steps, i, end, to)
+		if err == NotLeader {
+			Logger.Info("rollout ", r.ID, " stopped: ", err)
+			return
+		}
+		if err != nil {
+			Logger.Info("rollout ", r.ID, " batch ", r.Batch, " failed: ", err)
+			rollback(r, from, err)
+			return
+		}
+		r.Upgraded = r.Upgraded + n
+		r.Save()
+
+		if end < len(steps) && r.Pause > 0 {
+			time.Sleep(time.Duration(r.Pause) * time.Second)
+		}
+	}
+	r.Finish(types.ROLLOUT_SUCCEEDED, "")
+}
+
+// 发了 update 的都恢复成 from, 不做健康检查
+func rollback(r *types.Rollout, from *types.AppVersion, cause error) {
+	r.Status = types.ROLLOUT_ROLLINGBACK
+	r.Message = cause.Error()
+	r.Save()
+	errs := []string{}
+	for _, step := range r.GetSteps() {
+		if step.TaskID == 0 {
+			continue
+		}
+		err := restoreStep(r, from, step)
+		if err == NotLeader {
+			Logger.Info("rollout ", r.ID, " rollback stopped: ", err)
+			return
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) != 0 {
+		r.Finish(types.ROLLOUT_FAILED, fmt.Sprintf("%s; rollback failed: %s", cause, strings.Join(errs, "; ")))
+		return
+	}
+	r.Finish(types.ROLLOUT_ROLLEDBACK, cause.Error())
+}
+
+// 新容器起来了的升回 from, 老的会被它换掉
+// 新的没起来老的还在就不用管, 老的也没了 (比如新的后来挂了) 就在原来的机器上补一个 from 的
+func restoreStep(r *types.Rollout, from *types.AppVersion, step *types.RolloutStep) error {
+	if !Elector.IsLeader() {
+		return NotLeader
+	}
+	timeout := time.Duration(r.Timeout) * time.Second
+	host := types.GetHostByID(step.Old.HostID)
+	if host == nil {
+		return fmt.Errorf("host %d not found", step.Old.HostID)
+	}
+	var task *types.Task
+	if job := waitJob(step.TaskID, timeout); job != nil && job.Succ == types.SUCC {
+		if c := types.GetContainerByCid(job.Result); c != nil {
+			if task = types.UpdateContainerTask(c, from); task == nil {
+				return errors.New("task created error")
+			}
+		}
+	}
+	if task == nil {
+		if types.GetContainerByCid(step.Old.ContainerID) != nil {
+			return nil
+		}
+		appyaml, err := from.GetSubAppYaml(step.Old.SubApp)
+		if err != nil {
+			return err
+		}
+		entrypoint, err := step.Old.GetEntrypoint(appyaml)
+		if err != nil {
+			return err
+		}
+		if task, err = types.AddContainerTask(from, host, appyaml, entrypoint, step.Old.Env); err != nil {
+			return err
+		}
+	}
+	// dot 刚起来的时候 levi 还没连上
+	for deadline := time.Now().Add(timeout); !LeviHub.HasLevi(host.IP) && time.Now().Before(deadline); {
+		time.Sleep(time.Second)
+	}
+	// 等的时候可能换了 leader
+	if !Elector.IsLeader() {
+		return NotLeader
+	}
+	if err := LeviHub.Dispatch(host.IP, task); err != nil {
+		return err
+	}
+	r.AddTaskIDs([]int{task.ID})
+	_, err := waitContainer(host, from, task, timeout)
+	return err
+}
+
+// 发 steps[i:end] 的 update 任务, 等新容器起来, 过了健康检查返回升了几个
+// 发出去了的都要等完, 回滚的时候按 steps 里记的任务来
+func upgradeBatch(r *types.Rollout, steps []*types.RolloutStep, i, end int, to *types.AppVersion) (int, error) {
+	type sent struct {
+		host *types.Host
+		task *types.Task
+	}
+	var err error
+	tasks := []*sent{}
+	for j := i; j < end; j = j + 1 {
+		if !Elector.IsLeader() {
+			err = NotLeader
+			break
+		}
+		c := types.GetContainerByCid(steps[j].Old.ContainerID)
+		if c == nil {
+			err = fmt.Errorf("container %s not found", steps[j].Old.ContainerID)
+			break
+		}
+		host := c.Host()
+		task := types.UpdateContainerTask(c, to)
+		if host == nil || task == nil {
+			err = errors.New("task created error")
+			break
+		}
+		if err = LeviHub.Dispatch(host.IP, task); err != nil {
+			break
+		}
+		steps[j].TaskID = task.ID
+		r.SetStepTask(j, task.ID)
+		tasks = append(tasks, &sent{host, task})
+	}
+
+	timeout := time.Duration(r.Timeout) * time.Second
+	news := []*types.Container{}
+	for _, s := range tasks {
+		c, e := waitContainer(s.host, to, s.task, timeout)
+		if e != nil {
+			if err == nil {
+				err = e
+			}
+			continue
+		}
+		news = append(news, c)
+	}
+	if err != nil {
+		return len(news), err
+	}
+
+	for _, c := range news {
+		if c.Port == 0 {
+			continue
+		}
+		if err := probeUntil(r.Health, c.Host().IP, c.Port, r.HealthPath, timeout); err != nil {
+			return len(news), err
+		}
+	}
+	return len(news), nil
+}
+
+// 等任务跑完, 超时了返回 nil
+func waitJob(id int, timeout time.Duration) *types.Job {
+	deadline := time.Now().Add(timeout)
+	for {
+		if job := types.GetJob(id); job != nil && job.Status == types.DONE {
+			return job
+		}
+		if time.Now().After(deadline) {
+			return nil
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// 等 update 任务的新容器出现在 container 表里
+func waitContainer(host *types.Host, av *types.AppVersion, task *types.Task, timeout time.Duration) (*types.Container, error) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if c := types.GetContainerByTask(host, av, task); c != nil {
+			return c, nil
+		}
+		if job := types.GetJob(task.ID); job != nil && job.Status == types.DONE && job.Succ == types.FAIL {
+			return nil, fmt.Errorf("task %d failed: %s", task.ID, job.Result)
+		}
+		time.Sleep(time.Second)
+	}
+	return nil, fmt.Errorf("task %d timeout", task.ID)
+}
@@ -0,0 +1,240 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"config"
+	"types"
+)
+
+const (
+	SPREAD  = "spread"
+	BINPACK = "binpack"
+
+	// cpushare 1024 算一个核
+	sharesPerCore = 1024
+)
+
+var (
+	NoHostAvailable = errors.New("no host available")
+	UnknownStrategy = errors.New("unknown strategy, should be spread/binpack")
+)
+
+// 调度结果, Reason 说明为什么选了这台机器
+type Placement struct {
+	Host   *types.Host `json:"-"`
+	IP     string      `json:"ip"`
+	Reason string      `json:"reason"`
+}
+
+// 一台候选机器当前的状态, 这一轮已经选了它的也算进去
+// freeCpuSet 是还能绑的核, 只有打开 use_cpu_set 才看
+type candidate struct {
+	host       *types.Host
+	containers int
+	freePorts  int
+	cores      int
+	memory     int
+	freeCores  float64
+	freeMemory int
+	freeCpuSet int
+}
+
+func (c *candidate) String() string {
+	return fmt.Sprintf("%d containers, %d free ports, %.1f free cores, %d free memory",
+		c.containers, c.freePorts, c.freeCores, c.freeMemory)
+}
+
+func newCandidate(host *types.Host, req types.CoreRequest) *candidate {
+	cs := host.Containers()
+	totalPorts := config.Config.Maxport - config.Config.Minport + 1
+	cores, memory := capacity(host)
+	usedMemory, usedShares := 0, 0
+	for _, c := range cs {
+		m, share := usage(c)
+		usedMemory, usedShares = usedMemory+m, usedShares+share
+	}
+	c := &candidate{
+		host:       host,
+		containers: len(cs),
+		cores:      cores,
+		memory:     memory,
+		freePorts:  totalPorts - len(host.Ports()),
+		freeCores:  float64(cores) - float64(usedShares)/sharesPerCore,
+		freeMemory: memory - usedMemory,
+	}
+	if req.Count > 0 {
+		c.freeCpuSet = host.FreeCores(req.Exclusive)
+	}
+	return c
+}
+
+// 老的容器没记资源, 按配置里的算
+func usage(c *types.Container) (int, int) {
+	memory, share := c.Memory, c.CpuShare
+	if memory == 0 {
+		memory = config.Config.Task.Memory
+	}
+	if share == 0 {
+		share = config.Config.Task.CpuShare
+	}
+	return memory, share
+}
+
+// 这一轮又放了一个上去
+func (c *candidate) take(needPort bool, res types.Resources) {
+	c.containers = c.containers + 1
+	if needPort {
+		c.freePorts = c.freePorts - 1
+	}
+	c.freeMemory = c.freeMemory - res.Memory
+	c.freeCores = c.freeCores - float64(res.CpuShare)/sharesPerCore
+	// 共享的核还能给别人用
+	if req := res.Cores(); req.Exclusive {
+		c.freeCpuSet = c.freeCpuSet - req.Count
+	}
+}
+
+// levi 报上来了就用机器自己的, 没报的话用配置里的
+func capacity(host *types.Host) (int, int) {
+	cores, memory := config.Config.Scheduler.Cores, config.Config.Scheduler.Memory
+	if host.Cores > 0 {
+		cores = host.Cores
+	}
+	if host.Memory > 0 {
+		memory = int(host.Memory)
+	}
+	return cores, memory
+}
+
+// 放不下返回原因, 放得下返回空, 和剩下的比
+func (c *candidate) reject(selector map[string]string, needPort bool, res types.Resources) string {
+	if c.host.Cordoned {
+		return "cordoned"
+	}
+	if !c.host.Match(selector) {
+		return "labels not match"
+	}
+	if needPort && c.freePorts <= 0 {
+		return "no free port"
+	}
+	if c.memory > 0 && c.freeMemory < res.Memory {
+		return "not enough memory"
+	}
+	if c.cores > 0 && c.freeCores*sharesPerCore < float64(res.CpuShare) {
+		return "not enough cpu"
+	}
+	if c.freeCpuSet < res.Cores().Count {
+		return "not enough free cores"
+	}
+	return ""
+}
+
+// spread 优先选容器少的, binpack 优先选容器多的
+// 容器数一样的时候都选剩余资源多的
+type byStrategy struct {
+	cs       []*candidate
+	strategy string
+}
+
+func (b byStrategy) Len() int      { return len(b.cs) }
+func (b byStrategy) Swap(i, j int) { b.cs[i], b.cs[j] = b.cs[j], b.cs[i] }
+func (b byStrategy) Less(i, j int) bool {
+	x, y := b.cs[i], b.cs[j]
+	if x.containers != y.containers {
+		if b.strategy == BINPACK {
+			return x.containers > y.containers
+		}
+		return x.containers < y.containers
+	}
+	if x.freeMemory != y.freeMemory {
+		return x.freeMemory > y.freeMemory
+	}
+	return x.freePorts > y.freePorts
+}
+
+// 从在线的机器里给 count 个容器选地方, 一次选一个, 选了的机器把这个容器算进去再排
+// 机器不够的时候一台机器上会放好几个, spread 的话就是轮着放; 放不下 count 个就出错
+// selector 是 "ssd=true,rack=a3" 这样的, 机器的 labels 要都满足, 空的话不限制
+// needPort 为 false 的时候不看端口, 比如 daemon/build/test
+// res 是每个容器要的资源, 用 app.yaml 的 Resources.For(入口) 拿
+func Schedule(count int, strategy, selector string, needPort bool, res types.Resources) ([]*Placement, error) {
+	if strategy == "" {
+		strategy = config.Config.Scheduler.Strategy
+	}
+	if strategy == "" {
+		strategy = SPREAD
+	}
+	if strategy != SPREAD && strategy != BINPACK {
+		return nil, UnknownStrategy
+	}
+	if count <= 0 {
+		count = 1
+	}
+
+	cs := []*candidate{}
+	for _, host := range types.GetOnlineHosts() {
+		cs = append(cs, newCandidate(host, res.Cores()))
+	}
+	return place(cs, count, strategy, types.ParseLabels(selector), needPort, res)
+}
+
+// 在候选机器里放 count 个, 放的时候会改 all 里剩下的资源
+func place(all []*candidate, count int, strategy string, labels map[string]string, needPort bool, res types.Resources) ([]*Placement, error) {
+	cs := []*candidate{}
+	rejected := []string{}
+	for _, c := range all {
+		if reason := c.reject(labels, needPort, res); reason != "" {
+			rejected = append(rejected, fmt.Sprintf("%s %s", c.host.IP, reason))
+			continue
+		}
+		cs = append(cs, c)
+	}
+	if len(cs) == 0 {
+		if len(rejected) == 0 {
+			return nil, NoHostAvailable
+		}
+		return nil, fmt.Errorf("%s: %s", NoHostAvailable, strings.Join(rejected, ", "))
+	}
+
+	ps := make([]*Placement, 0, count)
+	for len(ps) < count {
+		fits := []*candidate{}
+		for _, c := range cs {
+			if c.reject(labels, needPort, res) == "" {
+				fits = append(fits, c)
+			}
+		}
+		if len(fits) == 0 {
+			return nil, fmt.Errorf("%s: only %d of %d containers fit", NoHostAvailable, len(ps), count)
+		}
+		sort.Stable(byStrategy{fits, strategy})
+		c := fits[0]
+		ps = append(ps, &Placement{
+			Host:   c.host,
+			IP:     c.host.IP,
+			Reason: fmt.Sprintf("%s: ranked 1 of %d, %s", strategy, len(fits), c),
+		})
+		c.take(needPort, res)
+	}
+	return ps, nil
+}
+
+// 指定了机器的时候看剩下的资源够不够, 不看 labels
+func Fits(host *types.Host, needPort bool, res types.Resources) error {
+	if reason := newCandidate(host, res.Cores()).reject(nil, needPort, res); reason != "" {
+		return fmt.Errorf("host %s: %s", host.IP, reason)
+	}
+	return nil
+}
+
+func Hosts(ps []*Placement) []*types.Host {
+	hosts := make([]*types.Host, len(ps))
+	for i, p := range ps {
+		hosts[i] = p.Host
+	}
+	return hosts
+}
@@ -0,0 +1,205 @@
+package scheduler
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"config"
+	"types"
+)
+
+func TestReject(t *testing.T) {
+	saved := config.Config
+	defer func() { config.Config = saved }()
+	config.Config.UseCPUSet = true
+
+	exclusive := true
+	res := types.Resources{Memory: 512, CpuShare: 1024}
+	withCores := types.Resources{Memory: 512, CpuShare: 1024, CpuSet: 2, Exclusive: &exclusive}
+	host := &types.Host{IP: "a"}
+	cases := []struct {
+		name     string
+		c        *candidate
+		selector map[string]string
+		needPort bool
+		res      types.Resources
+		want     string
+	}{
+		{"fits", &candidate{host: host, freePorts: 10, cores: 8, memory: 4096, freeCores: 4, freeMemory: 1024}, nil, true, res, ""},
+		{"cordoned", &candidate{host: &types.Host{Cordoned: true}}, nil, false, res, "cordoned"},
+		{"labels", &candidate{host: &types.Host{Labels: "ssd=false"}}, map[string]string{"ssd": "true"}, false, res, "labels not match"},
+		{"user labels", &candidate{host: &types.Host{Labels: "ssd=false", UserLabels: "ssd=true"}}, map[string]string{"ssd": "true"}, false, res, ""},
+		{"no port", &candidate{host: host}, nil, true, res, "no free port"},
+		{"no port needed", &candidate{host: host}, nil, false, res, ""},
+		{"memory", &candidate{host: host, memory: 4096, freeMemory: 511}, nil, false, res, "not enough memory"},
+		{"memory exactly", &candidate{host: host, memory: 4096, freeMemory: 512}, nil, false, res, ""},
+		{"cpu", &candidate{host: host, cores: 8, freeCores: 0.5}, nil, false, res, "not enough cpu"},
+		{"cpu exactly", &candidate{host: host, cores: 8, freeCores: 1}, nil, false, res, ""},
+		{"cpuset", &candidate{host: host, freeCpuSet: 1}, nil, false, withCores, "not enough free cores"},
+		{"cpuset fits", &candidate{host: host, freeCpuSet: 2}, nil, false, withCores, ""},
+		// 机器没报容量也没配的时候不看资源
+		{"unknown capacity", &candidate{host: host, freeCores: -3, freeMemory: -100}, nil, false, res, ""},
+	}
+	for _, c := range cases {
+		if got := c.c.reject(c.selector, c.needPort, c.res); got != c.want {
+			t.Errorf("%s: reject = %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestTake(t *testing.T) {
+	saved := config.Config
+	defer func() { config.Config = saved }()
+	config.Config.UseCPUSet = true
+
+	exclusive, shared := true, false
+
+	cases := []struct {
+		name     string
+		needPort bool
+		res      types.Resources
+		want     candidate
+	}{
+		{"port", true, types.Resources{Memory: 100, CpuShare: 512}, candidate{containers: 2, freePorts: 9, freeCores: 3.5, freeMemory: 900, freeCpuSet: 4}},
+		{"no port", false, types.Resources{Memory: 100, CpuShare: 512}, candidate{containers: 2, freePorts: 10, freeCores: 3.5, freeMemory: 900, freeCpuSet: 4}},
+		{"exclusive cores", true, types.Resources{CpuSet: 2, Exclusive: &exclusive}, candidate{containers: 2, freePorts: 9, freeCores: 4, freeMemory: 1000, freeCpuSet: 2}},
+		{"shared cores", true, types.Resources{CpuSet: 2, Exclusive: &shared}, candidate{containers: 2, freePorts: 9, freeCores: 4, freeMemory: 1000, freeCpuSet: 4}},
+	}
+	for _, c := range cases {
+		got := &candidate{host: &types.Host{IP: "a"}, containers: 1, freePorts: 10, freeCores: 4, freeMemory: 1000, freeCpuSet: 4}
+		got.take(c.needPort, c.res)
+		if got.containers != c.want.containers || got.freePorts != c.want.freePorts || got.freeCores != c.want.freeCores ||
+			got.freeMemory != c.want.freeMemory || got.freeCpuSet != c.want.freeCpuSet {
+			t.Errorf("%s: take = %s, %d free cores, want %s, %d free cores", c.name, got, got.freeCpuSet, &c.want, c.want.freeCpuSet)
+		}
+	}
+}
+
+func TestUsage(t *testing.T) {
+	saved := config.Config
+	defer func() { config.Config = saved }()
+	config.Config.Task.Memory, config.Config.Task.CpuShare = 256, 512
+
+	cases := []struct {
+		c             *types.Container
+		memory, share int
+	}{
+		{&types.Container{}, 256, 512},
+		{&types.Container{Memory: 1024}, 1024, 512},
+		{&types.Container{CpuShare: 2048}, 256, 2048},
+		{&types.Container{Memory: 1024, CpuShare: 2048}, 1024, 2048},
+	}
+	for _, c := range cases {
+		if memory, share := usage(c.c); memory != c.memory || share != c.share {
+			t.Errorf("usage(%d, %d) = %d, %d, want %d, %d", c.c.Memory, c.c.CpuShare, memory, share, c.memory, c.share)
+		}
+	}
+}
+
+func TestByStrategy(t *testing.T) {
+	a, b, c := &types.Host{IP: "a"}, &types.Host{IP: "b"}, &types.Host{IP: "c"}
+	cases := []struct {
+		strategy string
+		cs       []*candidate
+		want     string
+	}{
+		{SPREAD, []*candidate{{host: a, containers: 3}, {host: b, containers: 1}, {host: c, containers: 2}}, "b,c,a"},
+		{BINPACK, []*candidate{{host: a, containers: 3}, {host: b, containers: 1}, {host: c, containers: 2}}, "a,c,b"},
+		{SPREAD, []*candidate{{host: a, freeMemory: 100}, {host: b, freeMemory: 300}, {host: c, freeMemory: 200}}, "b,c,a"},
+		{BINPACK, []*candidate{{host: a, freeMemory: 100}, {host: b, freeMemory: 300}}, "b,a"},
+		{SPREAD, []*candidate{{host: a, freePorts: 5}, {host: b, freePorts: 10}}, "b,a"},
+		{SPREAD, []*candidate{{host: a}, {host: b}}, "a,b"},
+	}
+	for _, c := range cases {
+		sort.Stable(byStrategy{c.cs, c.strategy})
+		if got := candidateIPs(c.cs); got != c.want {
+			t.Errorf("%s: order = %s, want %s", c.strategy, got, c.want)
+		}
+	}
+}
+
+func candidateIPs(cs []*candidate) string {
+	ips := []string{}
+	for _, c := range cs {
+		ips = append(ips, c.host.IP)
+	}
+	return strings.Join(ips, ",")
+}
+
+func placementIPs(ps []*Placement) string {
+	ips := []string{}
+	for _, p := range ps {
+		ips = append(ips, p.IP)
+	}
+	return strings.Join(ips, ",")
+}
+
+func TestPlace(t *testing.T) {
+	res := types.Resources{Memory: 100, CpuShare: 1024}
+	a, b := &types.Host{IP: "a"}, &types.Host{IP: "b"}
+	cases := []struct {
+		name     string
+		cs       []*candidate
+		count    int
+		strategy string
+		labels   map[string]string
+		needPort bool
+		want     string
+		err      string
+	}{
+		{
+			"spread takes turns", []*candidate{{host: a, freePorts: 10, freeMemory: 1000}, {host: b, freePorts: 10, freeMemory: 900}},
+			4, SPREAD, nil, true, "a,b,a,b", "",
+		},
+		{
+			"spread fills the emptier first", []*candidate{{host: a, containers: 2, freePorts: 10}, {host: b, freePorts: 10}},
+			3, SPREAD, nil, true, "b,b,a", "",
+		},
+		{
+			"binpack stacks", []*candidate{{host: a, freePorts: 10}, {host: b, containers: 1, freePorts: 10}},
+			3, BINPACK, nil, true, "b,b,b", "",
+		},
+		{
+			"binpack moves on when full", []*candidate{{host: a, freePorts: 10}, {host: b, containers: 1, freePorts: 10, cores: 8, freeCores: 2}},
+			3, BINPACK, nil, true, "b,b,a", "",
+		},
+		{
+			"ports run out", []*candidate{{host: a, freePorts: 1}, {host: b, freePorts: 1}},
+			3, SPREAD, nil, true, "", "only 2 of 3 containers fit",
+		},
+		{
+			"ports not needed", []*candidate{{host: a, freePorts: 1}},
+			3, SPREAD, nil, false, "a,a,a", "",
+		},
+		{
+			"memory runs out", []*candidate{{host: a, freePorts: 10, memory: 4096, freeMemory: 250}},
+			3, SPREAD, nil, true, "", "only 2 of 3 containers fit",
+		},
+		{
+			"labels", []*candidate{{host: a, freePorts: 10}, {host: &types.Host{IP: "b", Labels: "ssd=true"}, freePorts: 10}},
+			2, SPREAD, map[string]string{"ssd": "true"}, true, "b,b", "",
+		},
+		{
+			"all rejected", []*candidate{{host: a}, {host: &types.Host{IP: "b", Cordoned: true}}},
+			1, SPREAD, nil, true, "", "a no free port, b cordoned",
+		},
+		{"no hosts", nil, 1, SPREAD, nil, true, "", NoHostAvailable.Error()},
+	}
+	for _, c := range cases {
+		ps, err := place(c.cs, c.count, c.strategy, c.labels, c.needPort, res)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: err = %v, want %q", c.name, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: err = %v", c.name, err)
+			continue
+		}
+		if got := placementIPs(ps); got != c.want {
+			t.Errorf("%s: placed on %s, want %s", c.name, got, c.want)
+		}
+	}
+}
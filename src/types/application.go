@@ -41,16 +41,105 @@ type AppVersion struct {
 }
 
 type AppYaml struct {
-	Appname        string   `json:"appname"`
-	Runtime        string   `json:"runtime"`
-	Port           int      `json:"port"`
-	Cmd            []string `json:"cmd"`
-	Daemon         []string `json:"daemon"`
-	Test           []string `json:"test"`
-	Build          []string `json:"build"`
-	Static         string   `json:"static"`
-	Schema         string   `json:"schema"`
-	ReleaseManager []string `json:"release_manager" yaml:"release_manager"`
+	Appname        string        `json:"appname"`
+	Runtime        string        `json:"runtime"`
+	Port           int           `json:"port"`
+	Protocol       string        `json:"protocol"`
+	Ports          []*PortSpec   `json:"ports"`
+	Ingress        string        `json:"ingress"`
+	Cmd            []string      `json:"cmd"`
+	Daemon         []string      `json:"daemon"`
+	Test           []string      `json:"test"`
+	Build          []string      `json:"build"`
+	Static         string        `json:"static"`
+	Schema         string        `json:"schema"`
+	ReleaseManager []string      `json:"release_manager" yaml:"release_manager"`
+	Restart        RestartPolicy `json:"restart"`
+	Resources      ResourceSpec  `json:"resources"`
+	Health         HealthCheck   `json:"health"`
+	Stop           StopPolicy    `json:"stop"`
+	Domains        []string      `json:"domains"`
+	Routes         []*Route      `json:"routes"`
+	TLS            TLSPolicy     `json:"tls"`
+
+	Entrypoints map[string]*Entrypoint `json:"entrypoints"`
+}
+
+const (
+	RESTART_NEVER      = "never"
+	RESTART_ON_FAILURE = "on-failure"
+	RESTART_ALWAYS     = "always"
+)
+
+// 容器挂了之后要不要再起一个
+// 不写就是 never
+type RestartPolicy struct {
+	Policy     string `json:"policy"`
+	MaxRetries int    `json:"max_retries" yaml:"max_retries"`
+}
+
+// exitCode 拿不到的时候传 -1, 当失败处理
+// retries 是这个容器 (和它之前挂掉的那些) 连着重启过的次数
+func (rp RestartPolicy) ShouldRestart(exitCode, retries int) bool {
+	switch rp.Policy {
+	case RESTART_ALWAYS:
+		return true
+	case RESTART_ON_FAILURE:
+		return exitCode != 0 && (rp.MaxRetries <= 0 || retries < rp.MaxRetries)
+	}
+	return false
+}
+
+// restarts 是这个容器 (和它之前挂掉的那些) 已经重启过的次数
+// 第一次等 task.restart_backoff 秒, 每次翻倍, 最多 task.restart_backoff_max 秒
+func RestartBackoff(restarts int) time.Duration {
+	base, max := config.Config.Task.RestartBackoff, config.Config.Task.RestartBackoffMax
+	if base <= 0 {
+		base = 1
+	}
+	if max <= 0 {
+		max = 300
+	}
+	delay := base
+	for i := 0; i < restarts && delay < max; i = i + 1 {
+		delay = delay * 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return time.Duration(delay) * time.Second
+}
+
+// 删容器的时候先从 nginx 里摘掉, 等 drain 秒再让 levi 停
+// levi 先发 SIGTERM, grace 秒还没退出再 kill
+// 不写用配置里的 task.stop_drain/task.stop_grace
+type StopPolicy struct {
+	Drain int `json:"drain"`
+	Grace int `json:"grace"`
+}
+
+func (sp StopPolicy) GetDrain() int {
+	if sp.Drain > 0 {
+		return sp.Drain
+	}
+	return config.Config.Task.StopDrain
+}
+
+func (sp StopPolicy) GetGrace() int {
+	if sp.Grace > 0 {
+		return sp.Grace
+	}
+	return config.Config.Task.StopGrace
+}
+
+// 容器自己的版本的 app.yaml 里的, 拿不到就用配置里的
+func (c *Container) StopPolicy() StopPolicy {
+	if av := c.AppVersion(); av != nil {
+		if appYaml, err := av.GetSubAppYaml(c.SubApp); err == nil {
+			return appYaml.Stop
+		}
+	}
+	return StopPolicy{}
 }
 
 type ManagerSet struct {
@@ -82,11 +171,10 @@ func (self *ManagerSet) SetManager(names []string) error {
 	return nil
 }
 
+// 没打开 auth 的时候都是 NBEBot, 还和原来一样谁都能改
+// 打开了之后只认 release_manager 里的, 没写的 app 只有 admin 能改
 func (self *ManagerSet) IsManager(name string) bool {
-	if name == "NBEBot" {
-		return true
-	}
-	if len(self.manager) == 0 {
+	if !config.Config.Auth.Enable && (name == "NBEBot" || len(self.manager) == 0) {
 		return true
 	}
 	_, exists := self.manager[name]
@@ -170,11 +258,20 @@ func Register(projectname, version, namespace, appyaml, submitter string) *Appli
 		return nil
 	}
 	Logger.Debug("app.yaml: ", appYamlDict)
+	if err := appYamlDict.Validate(); err != nil {
+		Logger.Info("app.yaml error: ", err)
+		return nil
+	}
 
 	appname := appYamlDict.Appname
+	if err := CheckDomains(appname, appYamlDict.Domains); err != nil {
+		Logger.Info("app.yaml error: ", err)
+		return nil
+	}
 	// 设置新的release manager
+	// 新的 app 谁都能注册, 已经有了的要是 release manager 或者 admin
 	m := NewManagerSet(appname)
-	if !m.IsManager(submitter) {
+	if GetApplication(appname) != nil && !m.IsManager(submitter) && !IsAdmin(submitter) {
 		Logger.Info("current user is ", submitter, " not manager")
 		return nil
 	}
@@ -236,11 +333,18 @@ func (a *Application) CreateDNS() error {
 	if err != nil {
 		return err
 	}
+	// 别的环境的是 环境/app, 也就是 app.环境.podname
 	for _, c := range a.Containers() {
-		if c.SubApp == "" {
-			names[c.AppName] = struct{}{}
-		} else {
-			names[c.SubApp] = struct{}{}
+		name := c.AppName
+		if c.SubApp != "" {
+			name = c.SubApp
+		}
+		env := GetEnvironment(c.Env)
+		if env == nil {
+			continue
+		}
+		if p := env.DNSPath(name); p != "" {
+			names[p] = struct{}{}
 		}
 	}
 	for domain, _ := range names {
@@ -369,9 +473,9 @@ func (a *Application) AllVersionHosts() []*Host {
 	return hosts
 }
 
-// env could be prod/test
+// 每个环境一份
 func resourceKey(name, env string) string {
-	if env != "prod" && env != "test" {
+	if !IsEnvironment(env) {
 		return ""
 	}
 	return path.Join(AppPathPrefix, name, fmt.Sprintf("resource-%s", env))
@@ -0,0 +1,53 @@
+package types
+
+import "time"
+
+const (
+	AUDIT_OK           = "ok"
+	AUDIT_FAIL         = "fail"
+	AUDIT_UNAUTHORIZED = "unauthorized"
+	AUDIT_FORBIDDEN    = "forbidden"
+)
+
+// 每一个写操作都记一条
+// Action 是 "METHOD /route/:pattern", Params 是去掉了密码之类的表单
+type Audit struct {
+	ID      int       `orm:"column(id);auto;pk" json:"id"`
+	User    string    `json:"user"`
+	Action  string    `json:"action"`
+	Path    string    `json:"path"`
+	AppName string    `json:"app_name"`
+	Version string    `json:"version"`
+	Params  string    `orm:"type(text)" json:"params"`
+	TaskIDs string    `orm:"column(task_ids)" json:"task_ids"`
+	Outcome string    `json:"outcome"`
+	Message string    `json:"message"`
+	Created time.Time `orm:"auto_now_add;type(datetime)" json:"created"`
+}
+
+func NewAudit(a *Audit) *Audit {
+	if _, err := db.Insert(a); err != nil {
+		return nil
+	}
+	return a
+}
+
+// 空字符串的条件不过滤
+func GetAudits(user, appname, action, outcome string, start, limit int) []*Audit {
+	var as []*Audit
+	query := db.QueryTable(new(Audit))
+	if user != "" {
+		query = query.Filter("User", user)
+	}
+	if appname != "" {
+		query = query.Filter("AppName", appname)
+	}
+	if action != "" {
+		query = query.Filter("Action", action)
+	}
+	if outcome != "" {
+		query = query.Filter("Outcome", outcome)
+	}
+	query.OrderBy("-ID").Limit(limit, start).All(&as)
+	return as
+}
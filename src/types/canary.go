@@ -0,0 +1,92 @@
+package types
+
+import "time"
+
+const (
+	CANARY_RUNNING   = "running"
+	CANARY_PROMOTING = "promoting"
+	CANARY_ABORTING  = "aborting"
+)
+
+// 一个 app/sub app 同时跑两个版本, Weight 是给 Canary 版本的流量百分比
+// 不是 Canary 版本的容器都算 Stable 那边
+type Canary struct {
+	ID      int       `orm:"column(id);auto;pk" json:"id"`
+	AppName string    `json:"app_name"`
+	SubApp  string    `orm:"column(sub_app)" json:"sub_app"`
+	Stable  string    `json:"stable"`
+	Canary  string    `json:"canary"`
+	Weight  int       `json:"weight"`
+	Status  string    `json:"status"`
+	Created time.Time `orm:"auto_now_add;type(datetime)" json:"created"`
+	Updated time.Time `orm:"auto_now;type(datetime)" json:"updated"`
+}
+
+func GetCanary(appname, subApp string) *Canary {
+	var c Canary
+	err := db.QueryTable(new(Canary)).Filter("AppName", appname).Filter("SubApp", subApp).One(&c)
+	if err != nil {
+		return nil
+	}
+	return &c
+}
+
+func GetCanaries(appname string) []*Canary {
+	var cs []*Canary
+	db.QueryTable(new(Canary)).Filter("AppName", appname).OrderBy("SubApp").All(&cs)
+	return cs
+}
+
+// 有就改权重, 没有就创建
+func SetCanary(stable, canary *AppVersion, subApp string, weight int) *Canary {
+	c := GetCanary(stable.Name, subApp)
+	if c == nil {
+		c = &Canary{AppName: stable.Name, SubApp: subApp}
+	}
+	c.Stable = stable.Version
+	c.Canary = canary.Version
+	c.Weight = weight
+	c.Status = CANARY_RUNNING
+	var err error
+	if c.ID == 0 {
+		_, err = db.Insert(c)
+	} else {
+		_, err = db.Update(c)
+	}
+	if err != nil {
+		return nil
+	}
+	return c
+}
+
+func (c *Canary) SetStatus(status string, weight int) {
+	c.Status = status
+	c.Weight = weight
+	db.Update(c)
+}
+
+func (c *Canary) Delete() bool {
+	_, err := db.Delete(&Canary{ID: c.ID})
+	return err == nil
+}
+
+// stable 个老版本的容器, canary 个新版本的容器
+// 返回每个老容器和每个新容器在 upstream 里的 weight, 0 表示不要放进去
+func (c *Canary) Weights(stable, canary int) (int, int) {
+	switch {
+	case canary == 0 || c.Weight <= 0:
+		return 1, 0
+	case stable == 0 || c.Weight >= 100:
+		return 0, 1
+	}
+	s, n := (100-c.Weight)*canary, c.Weight*stable
+	d := gcd(s, n)
+	return s / d, n / d
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
@@ -0,0 +1,32 @@
+package types
+
+import "testing"
+
+func TestCanaryWeights(t *testing.T) {
+	cases := []struct {
+		weight, stable, canary int
+		ws, wc                 int
+	}{
+		{10, 3, 0, 1, 0},
+		{0, 3, 1, 1, 0},
+		{-5, 3, 1, 1, 0},
+		{10, 0, 1, 0, 1},
+		{100, 3, 1, 0, 1},
+		{150, 3, 1, 0, 1},
+		{50, 1, 1, 1, 1},
+		{50, 3, 1, 1, 3},
+		{10, 1, 1, 9, 1},
+		{10, 9, 1, 1, 1},
+		{20, 4, 2, 2, 1},
+		{25, 2, 1, 3, 2},
+		{99, 1, 1, 1, 99},
+	}
+	for _, c := range cases {
+		canary := &Canary{Weight: c.weight}
+		ws, wc := canary.Weights(c.stable, c.canary)
+		if ws != c.ws || wc != c.wc {
+			t.Errorf("weight %d stable %d canary %d: Weights = %d, %d, want %d, %d",
+				c.weight, c.stable, c.canary, ws, wc, c.ws, c.wc)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package types
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+
+	"config"
+	. "utils"
+)
+
+const (
+	CERT_UPLOAD = "upload"
+	CERT_ACME   = "acme"
+
+	defaultCertDays = 90
+)
+
+// Dot 管着的证书, 上传的或者本地 acme 签的, Domain 可以是 *.a.com
+// Cert 是整条链, Key 用 secrets.key 加密过, 接口里不给
+type Certificate struct {
+	ID      int       `orm:"column(id);auto;pk" json:"id"`
+	Domain  string    `orm:"unique" json:"domain"`
+	Cert    string    `orm:"type(text)" json:"cert"`
+	Key     string    `orm:"type(text)" json:"-"`
+	Source  string    `json:"source"`
+	Expires time.Time `orm:"type(datetime)" json:"expires"`
+	Created time.Time `orm:"auto_now_add;type(datetime)" json:"created"`
+	Updated time.Time `orm:"auto_now;type(datetime)" json:"updated"`
+}
+
+func GetCertificate(domain string) *Certificate {
+	var c Certificate
+	if err := db.QueryTable(new(Certificate)).Filter("Domain", domain).One(&c); err != nil {
+		return nil
+	}
+	return &c
+}
+
+func GetCertificates() []*Certificate {
+	var cs []*Certificate
+	db.QueryTable(new(Certificate)).OrderBy("Domain").All(&cs)
+	return cs
+}
+
+// 域名用的证书, 先找一样的再找通配的
+func CertificateFor(name string) *Certificate {
+	if c := GetCertificate(name); c != nil {
+		return c
+	}
+	if i := strings.Index(name, "."); i > 0 {
+		return GetCertificate("*" + name[i:])
+	}
+	return nil
+}
+
+// 有就换掉, 证书和 key 要对得上, 证书里要有这个域名, 不能已经过期
+func SetCertificate(domain, certPEM, keyPEM, source string) (*Certificate, error) {
+	if !domainPattern.MatchString(domain) {
+		return nil, fmt.Errorf("invalid domain %s", domain)
+	}
+	pair, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		return nil, fmt.Errorf("invalid cert or key: %s", err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if !certHasName(leaf, domain) {
+		return nil, fmt.Errorf("certificate is not for %s", domain)
+	}
+	if time.Now().After(leaf.NotAfter) {
+		return nil, errors.New("certificate expired")
+	}
+	secret := config.Config.Secrets.Key
+	if secret == "" {
+		return nil, NoSecretKey
+	}
+	encrypted, err := Encrypt(secret, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	c := GetCertificate(domain)
+	if c == nil {
+		c = &Certificate{Domain: domain}
+	}
+	c.Cert, c.Key, c.Source, c.Expires = certPEM, encrypted, source, leaf.NotAfter
+	if c.ID == 0 {
+		_, err = db.Insert(c)
+	} else {
+		_, err = db.Update(c)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func certHasName(leaf *x509.Certificate, domain string) bool {
+	if leaf.Subject.CommonName == domain {
+		return true
+	}
+	for _, name := range leaf.DNSNames {
+		if name == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// 本地的 ACME 替身, 配了 acme.ca 就用它签, 不然自签名
+func IssueCertificate(domain string) (*Certificate, error) {
+	if !domainPattern.MatchString(domain) {
+		return nil, fmt.Errorf("invalid domain %s", domain)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	days := config.Config.Acme.Days
+	if days <= 0 {
+		days = defaultCertDays
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(0, 0, days),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	parent, signer, chain := template, interface{}(key), ""
+	if ca := config.Config.Acme; ca.CA != "" {
+		pair, err := tls.LoadX509KeyPair(ca.CA, ca.CAKey)
+		if err != nil {
+			return nil, fmt.Errorf("load acme ca failed: %s", err)
+		}
+		if parent, err = x509.ParseCertificate(pair.Certificate[0]); err != nil {
+			return nil, err
+		}
+		signer = pair.PrivateKey
+		caPEM, err := ioutil.ReadFile(ca.CA)
+		if err != nil {
+			return nil, err
+		}
+		chain = string(caPEM)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	certPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})) + chain
+	keyPEM := string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	return SetCertificate(domain, certPEM, keyPEM, CERT_ACME)
+}
+
+func (c *Certificate) KeyPEM() (string, error) {
+	secret := config.Config.Secrets.Key
+	if secret == "" {
+		return "", NoSecretKey
+	}
+	key, err := Decrypt(secret, c.Key)
+	if err != nil {
+		return "", fmt.Errorf("decrypt key of %s failed", c.Domain)
+	}
+	return key, nil
+}
+
+func (c *Certificate) Expired() bool {
+	return time.Now().After(c.Expires)
+}
+
+// 还有 app 的域名在用就不能删
+func (c *Certificate) Delete() error {
+	for _, d := range DomainsCoveredBy(c.Domain) {
+		if used := CertificateFor(d.Name); used != nil && used.ID == c.ID {
+			return fmt.Errorf("certificate is used by %s", d.AppName)
+		}
+	}
+	_, err := db.Delete(&Certificate{ID: c.ID})
+	return err
+}
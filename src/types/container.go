@@ -1,6 +1,10 @@
 package types
 
-import . "utils"
+import (
+	"time"
+
+	. "utils"
+)
 
 type Container struct {
 	ID          int    `orm:"column(id);auto;pk" json:"id"`
@@ -11,6 +15,22 @@ type Container struct {
 	AppName     string `json:"app_name"`
 	Version     string `json:"version"`
 	SubApp      string `orm:"column(sub_app)" json:"sub_app"`
+	Entrypoint  string `json:"entrypoint"`
+	// 跑在哪个环境, 测试容器是 test
+	Env string `json:"env"`
+	// app.yaml 里配了 health 的才有, 见 health.go
+	Health         string    `json:"health"`
+	HealthFailures int       `json:"health_failures"`
+	HealthMessage  string    `json:"health_message"`
+	HealthChecked  time.Time `orm:"null;type(datetime)" json:"health_checked"`
+	Created        time.Time `orm:"auto_now_add;type(datetime)" json:"created"`
+	// 要删了, 已经从 nginx 里摘掉
+	Stopping bool `json:"stopping"`
+	// 起的时候给的资源, 老的容器是 0, 调度的时候按配置里的算
+	Memory   int `json:"memory"`
+	CpuShare int `json:"cpushare"`
+	// 挂了被重启起来的, 前面已经重启过几次
+	Restarts int `json:"restarts"`
 }
 
 func (c *Container) Application() *Application {
@@ -25,10 +45,17 @@ func (c *Container) Host() *Host {
 	return GetHostByID(c.HostID)
 }
 
+func (c *Container) SetStopping(stopping bool) {
+	c.Stopping = stopping
+	db.Update(c, "Stopping")
+}
+
 func (c *Container) Delete() bool {
 	host := c.Host()
 	if host != nil {
 		host.RemovePort(c.Port)
+		c.deletePorts(host)
+		ReleaseContainerCores(c.ContainerID)
 	} else {
 		Logger.Debug("Host not found when deleting container")
 		return false
@@ -39,8 +66,14 @@ func (c *Container) Delete() bool {
 	return false
 }
 
-func NewContainer(av *AppVersion, host *Host, port int, containerID, identID, subApp string) *Container {
+// health 是一开始的健康状态, 配了健康检查的是 starting, 检查过了才进 nginx
+func NewContainer(av *AppVersion, host *Host, port int, containerID, identID, subApp, entrypoint, env, health string, memory, cpushare int) *Container {
 	c := Container{
+		Memory:      memory,
+		CpuShare:    cpushare,
+		Entrypoint:  entrypoint,
+		Env:         env,
+		Health:      health,
 		Port:        port,
 		ContainerID: containerID,
 		IdentID:     identID,
@@ -55,6 +88,11 @@ func NewContainer(av *AppVersion, host *Host, port int, containerID, identID, su
 	return nil
 }
 
+func (c *Container) SetRestarts(restarts int) {
+	c.Restarts = restarts
+	db.Update(c, "Restarts")
+}
+
 func GetContainerByCid(cid string) *Container {
 	var container Container
 	err := db.QueryTable(new(Container)).Filter("ContainerID", cid).One(&container)
@@ -92,8 +130,32 @@ func GetContainerByHostAndAppVersion(host *Host, av *AppVersion) []*Container {
 	return cs
 }
 
+func GetContainerByHostAndAppVersionAndEnv(host *Host, av *AppVersion, env string) []*Container {
+	var cs []*Container
+	db.QueryTable(new(Container)).Filter("HostID", host.ID).Filter("AppName", av.Name).Filter("Version", av.Version).
+		Filter("Env", env).OrderBy("Port").All(&cs)
+	return cs
+}
+
 func GetContainerByHost(host *Host) []*Container {
 	var cs []*Container
 	db.QueryTable(new(Container)).Filter("HostID", host.ID).OrderBy("Port").All(&cs)
 	return cs
 }
+
+// 根据任务找到它起出来的容器
+// daemon 用 ident 找, 其他的用 host 上绑定的端口找
+// task.Name 是小写的, 所以要带上 av
+func GetContainerByTask(host *Host, av *AppVersion, task *Task) *Container {
+	var container Container
+	query := db.QueryTable(new(Container)).Filter("HostID", host.ID).Filter("AppName", av.Name).Filter("Version", av.Version)
+	if task.Daemon != "" {
+		query = query.Filter("IdentID", task.Daemon)
+	} else {
+		query = query.Filter("Port", task.Bind)
+	}
+	if err := query.One(&container); err != nil {
+		return nil
+	}
+	return &container
+}
@@ -0,0 +1,134 @@
+package types
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	"config"
+)
+
+var NotEnoughCores = errors.New("not enough free cores")
+
+// 一个容器占了 host 上的哪个核, 和 port 表一样
+// 任务发出去的时候先按 JobID 占上, 容器起来之后填上 ContainerID
+// Exclusive 的核只给一个容器用, 不是的可以和别的不独占的容器共用
+type Core struct {
+	ID          int    `orm:"column(id);auto;pk" json:"id"`
+	HostID      int    `orm:"column(host_id)" json:"host_id"`
+	Core        int    `json:"core"`
+	Exclusive   bool   `json:"exclusive"`
+	JobID       int    `orm:"column(job_id)" json:"job_id"`
+	ContainerID string `orm:"column(container_id)" json:"container_id"`
+}
+
+// 一个容器要几个核, Count 为 0 就不绑
+type CoreRequest struct {
+	Count     int
+	Exclusive bool
+}
+
+func (h *Host) CoreAllocations() []*Core {
+	var cores []*Core
+	db.QueryTable(new(Core)).Filter("HostID", h.ID).OrderBy("Core", "ID").All(&cores)
+	return cores
+}
+
+// levi 报了就用机器自己的核数, 不然用配置里的
+func (h *Host) TotalCores() int {
+	if h.Cores > 0 {
+		return h.Cores
+	}
+	return config.Config.Scheduler.Cores
+}
+
+// 按已经分出去的次数从少到多排, 一样的按核的编号
+type byUsage struct {
+	cores []int
+	used  []int
+}
+
+func (b byUsage) Len() int      { return len(b.cores) }
+func (b byUsage) Swap(i, j int) { b.cores[i], b.cores[j] = b.cores[j], b.cores[i] }
+func (b byUsage) Less(i, j int) bool {
+	x, y := b.cores[i], b.cores[j]
+	if b.used[x] != b.used[y] {
+		return b.used[x] < b.used[y]
+	}
+	return x < y
+}
+
+// 给 jobID 这个任务在 host 上分 req.Count 个核, 返回 cpuset
+// 独占的只能选没人用的核, 共享的选没被独占的核里用的最少的
+// 只允许一个访问
+func AllocateCores(host *Host, jobID int, req CoreRequest) (string, error) {
+	if req.Count <= 0 {
+		return "", nil
+	}
+	coreMutex.Lock()
+	defer coreMutex.Unlock()
+
+	candidates, used := host.coreCandidates(req.Exclusive)
+	if len(candidates) < req.Count {
+		return "", NotEnoughCores
+	}
+	sort.Sort(byUsage{candidates, used})
+	chosen := candidates[:req.Count]
+	sort.Ints(chosen)
+
+	cpuset := make([]string, len(chosen))
+	for i, core := range chosen {
+		c := Core{HostID: host.ID, Core: core, Exclusive: req.Exclusive, JobID: jobID}
+		if _, err := db.Insert(&c); err != nil {
+			ReleaseJobCores(jobID)
+			return "", err
+		}
+		cpuset[i] = strconv.Itoa(core)
+	}
+	return strings.Join(cpuset, ","), nil
+}
+
+// 还能分给一个容器的核有几个, 独占的要没人用的
+func (h *Host) FreeCores(exclusive bool) int {
+	candidates, _ := h.coreCandidates(exclusive)
+	return len(candidates)
+}
+
+// 能选的核和每个核已经分出去的次数
+func (h *Host) coreCandidates(exclusive bool) ([]int, []int) {
+	total := h.TotalCores()
+	used := make([]int, total)
+	taken := make([]bool, total)
+	for _, c := range h.CoreAllocations() {
+		if c.Core < 0 || c.Core >= total {
+			continue
+		}
+		used[c.Core] = used[c.Core] + 1
+		if c.Exclusive {
+			taken[c.Core] = true
+		}
+	}
+	candidates := []int{}
+	for core := 0; core < total; core = core + 1 {
+		if taken[core] || (exclusive && used[core] > 0) {
+			continue
+		}
+		candidates = append(candidates, core)
+	}
+	return candidates, used
+}
+
+// 容器起来了, 把任务占的核记到容器上
+func BindCores(jobID int, containerID string) {
+	db.Raw("UPDATE core SET container_id=? WHERE job_id=? AND container_id=''", containerID, jobID).Exec()
+}
+
+// 任务失败了, 还没绑到容器上的核放回去
+func ReleaseJobCores(jobID int) {
+	db.Raw("DELETE FROM core WHERE job_id=? AND container_id=''", jobID).Exec()
+}
+
+func ReleaseContainerCores(containerID string) {
+	db.Raw("DELETE FROM core WHERE container_id=?", containerID).Exec()
+}
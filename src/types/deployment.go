@@ -0,0 +1,74 @@
+package types
+
+import "time"
+
+// 声明式的部署, 一个 app 的一个 sub app 在一个环境里只有一份
+// dot 会一直把容器调整到和这里一样
+type Deployment struct {
+	ID       int       `orm:"column(id);auto;pk" json:"id"`
+	AppName  string    `json:"app_name"`
+	Version  string    `json:"version"`
+	SubApp   string    `orm:"column(sub_app)" json:"sub_app"`
+	Replicas int       `json:"replicas"`
+	Daemons  int       `json:"daemons"`
+	Env      string    `json:"env"`
+	Created  time.Time `orm:"auto_now_add;type(datetime)" json:"created"`
+	Updated  time.Time `orm:"auto_now;type(datetime)" json:"updated"`
+}
+
+func GetDeployment(appname, subApp, env string) *Deployment {
+	var d Deployment
+	err := db.QueryTable(new(Deployment)).Filter("AppName", appname).Filter("SubApp", subApp).Filter("Env", env).One(&d)
+	if err != nil {
+		return nil
+	}
+	return &d
+}
+
+// appname 为空的时候返回全部
+func GetDeployments(appname string) []*Deployment {
+	var ds []*Deployment
+	query := db.QueryTable(new(Deployment))
+	if appname != "" {
+		query = query.Filter("AppName", appname)
+	}
+	query.OrderBy("AppName", "SubApp", "Env").All(&ds)
+	return ds
+}
+
+// 有就更新, 没有就创建
+func SetDeployment(av *AppVersion, subApp, env string, replicas, daemons int) *Deployment {
+	d := GetDeployment(av.Name, subApp, env)
+	if d == nil {
+		d = &Deployment{AppName: av.Name, SubApp: subApp, Env: env}
+	}
+	d.Version = av.Version
+	d.Replicas = replicas
+	d.Daemons = daemons
+	var err error
+	if d.ID == 0 {
+		_, err = db.Insert(d)
+	} else {
+		_, err = db.Update(d)
+	}
+	if err != nil {
+		return nil
+	}
+	return d
+}
+
+func (d *Deployment) AppVersion() *AppVersion {
+	return GetVersion(d.AppName, d.Version)
+}
+
+// 这个 deployment 管的所有容器, 不管是哪个版本
+func (d *Deployment) Containers() []*Container {
+	var cs []*Container
+	db.QueryTable(new(Container)).Filter("AppName", d.AppName).Filter("SubApp", d.SubApp).Filter("Env", d.Env).OrderBy("ID").All(&cs)
+	return cs
+}
+
+func (d *Deployment) Delete() bool {
+	_, err := db.Delete(&Deployment{ID: d.ID})
+	return err == nil
+}
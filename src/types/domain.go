@@ -0,0 +1,152 @@
+package types
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var domainPattern = regexp.MustCompile(`^(\*\.)?([a-z0-9]([a-z0-9-]*[a-z0-9])?\.)+[a-z][a-z0-9-]*[a-z0-9]$`)
+
+// app.yaml 里的 routes, path 前缀的请求转给同一个环境里的 sub app
+type Route struct {
+	Path string `json:"path"`
+	App  string `json:"app"`
+}
+
+// app.yaml 里的 tls, 打开了 domains 里的每个域名都要有证书
+// 默认的 server_name 有证书也会上 https; redirect 打开的话有证书的域名 http 会 301 到 https
+type TLSPolicy struct {
+	Enabled  bool `json:"enabled"`
+	Redirect bool `json:"redirect"`
+}
+
+// 哪个域名给了哪个 app/sub app, 一个域名只能给一个
+// 只有 prod 用 app.yaml 里的 domains
+type Domain struct {
+	ID      int       `orm:"column(id);auto;pk" json:"id"`
+	Name    string    `orm:"unique" json:"name"`
+	AppName string    `json:"app_name"`
+	SubApp  string    `json:"sub_app"`
+	Created time.Time `orm:"auto_now_add;type(datetime)" json:"created"`
+}
+
+func (a *AppYaml) validateDomains() error {
+	seen := map[string]struct{}{}
+	for _, domain := range a.Domains {
+		if !domainPattern.MatchString(domain) || strings.HasPrefix(domain, "*.") {
+			return fmt.Errorf("invalid domain %s", domain)
+		}
+		if _, exists := seen[domain]; exists {
+			return fmt.Errorf("duplicated domain %s", domain)
+		}
+		seen[domain] = struct{}{}
+	}
+	paths := map[string]struct{}{}
+	for _, route := range a.Routes {
+		if !strings.HasPrefix(route.Path, "/") || route.Path == "/" {
+			return fmt.Errorf("route path %s must start with / and can't be /", route.Path)
+		}
+		if strings.ContainsAny(route.Path, " ;{}") {
+			return fmt.Errorf("invalid route path %s", route.Path)
+		}
+		if route.App == "" || route.App == a.Appname {
+			return fmt.Errorf("route %s must go to a sub app", route.Path)
+		}
+		if _, exists := paths[route.Path]; exists {
+			return fmt.Errorf("duplicated route %s", route.Path)
+		}
+		paths[route.Path] = struct{}{}
+	}
+	return nil
+}
+
+func GetDomain(name string) *Domain {
+	var d Domain
+	if err := db.QueryTable(new(Domain)).Filter("Name", name).One(&d); err != nil {
+		return nil
+	}
+	return &d
+}
+
+func GetDomains(appname string) []*Domain {
+	var ds []*Domain
+	query := db.QueryTable(new(Domain))
+	if appname != "" {
+		query = query.Filter("AppName", appname)
+	}
+	query.OrderBy("Name").All(&ds)
+	return ds
+}
+
+// 注册的时候查一下有没有被别的 app 占了, 同一个 app 的不同 sub app 等到刷 nginx 的时候再查
+func CheckDomains(appname string, names []string) error {
+	for _, name := range names {
+		if d := GetDomain(name); d != nil && d.AppName != appname {
+			return fmt.Errorf("domain %s is used by %s", name, d.AppName)
+		}
+	}
+	return nil
+}
+
+// 刷 nginx 的时候占住这些域名, 被别的 app/sub app 占了就出错, 不在里面的放掉
+func ClaimDomains(appname, subapp string, names []string) error {
+	for _, name := range names {
+		d := GetDomain(name)
+		if d == nil {
+			d = &Domain{Name: name, AppName: appname, SubApp: subapp}
+			if _, err := db.Insert(d); err != nil {
+				return fmt.Errorf("claim domain %s failed: %s", name, err)
+			}
+			continue
+		}
+		if err := d.checkOwner(appname, subapp); err != nil {
+			return err
+		}
+	}
+	ReleaseDomains(appname, subapp, names)
+	return nil
+}
+
+// 不是这个 app/sub app 占的就报是谁占的
+func (d *Domain) checkOwner(appname, subapp string) error {
+	if d.AppName == appname && d.SubApp == subapp {
+		return nil
+	}
+	owner := d.AppName
+	if d.SubApp != "" {
+		owner = d.SubApp
+	}
+	return fmt.Errorf("domain %s is used by %s", d.Name, owner)
+}
+
+func ReleaseDomains(appname, subapp string, keep []string) {
+	query := db.QueryTable(new(Domain)).Filter("AppName", appname).Filter("SubApp", subapp)
+	if len(keep) > 0 {
+		query = query.Exclude("Name__in", keep)
+	}
+	query.Delete()
+}
+
+// 证书能用在哪些占了的域名上, *.a.com 管 b.a.com 不管 c.b.a.com
+func DomainsCoveredBy(certDomain string) []*Domain {
+	covered := []*Domain{}
+	for _, d := range GetDomains("") {
+		if coveredBy(d.Name, certDomain) {
+			covered = append(covered, d)
+		}
+	}
+	return covered
+}
+
+func coveredBy(name, certDomain string) bool {
+	if name == certDomain {
+		return true
+	}
+	if !strings.HasPrefix(certDomain, "*.") {
+		return false
+	}
+	i := strings.Index(name, ".")
+	return i > 0 && name[i+1:] == certDomain[2:]
+}
@@ -0,0 +1,80 @@
+package types
+
+import "testing"
+
+func TestCoveredBy(t *testing.T) {
+	cases := []struct {
+		name, cert string
+		want       bool
+	}{
+		{"a.com", "a.com", true},
+		{"b.a.com", "a.com", false},
+		{"b.a.com", "*.a.com", true},
+		{"c.b.a.com", "*.a.com", false},
+		{"a.com", "*.a.com", false},
+		{"ba.com", "*.a.com", false},
+		{"b.a.com.cn", "*.a.com", false},
+		{"*.a.com", "*.a.com", true},
+	}
+	for _, c := range cases {
+		if got := coveredBy(c.name, c.cert); got != c.want {
+			t.Errorf("coveredBy(%q, %q) = %v, want %v", c.name, c.cert, got, c.want)
+		}
+	}
+}
+
+func TestDomainCheckOwner(t *testing.T) {
+	cases := []struct {
+		domain      Domain
+		app, subapp string
+		err         string
+	}{
+		{Domain{Name: "a.com", AppName: "web"}, "web", "", ""},
+		{Domain{Name: "a.com", AppName: "web", SubApp: "web-api"}, "web", "web-api", ""},
+		{Domain{Name: "a.com", AppName: "web"}, "blog", "", "domain a.com is used by web"},
+		{Domain{Name: "a.com", AppName: "web"}, "web", "web-api", "domain a.com is used by web"},
+		{Domain{Name: "a.com", AppName: "web", SubApp: "web-api"}, "web", "", "domain a.com is used by web-api"},
+		{Domain{Name: "a.com", AppName: "web", SubApp: "web-api"}, "web", "web-admin", "domain a.com is used by web-api"},
+	}
+	for _, c := range cases {
+		err := c.domain.checkOwner(c.app, c.subapp)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != c.err {
+			t.Errorf("%+v checkOwner(%q, %q) = %q, want %q", c.domain, c.app, c.subapp, got, c.err)
+		}
+	}
+}
+
+func TestValidateDomains(t *testing.T) {
+	cases := []struct {
+		domains []string
+		routes  []*Route
+		ok      bool
+	}{
+		{nil, nil, true},
+		{[]string{"a.com", "www.a-b.com"}, nil, true},
+		{[]string{"*.a.com"}, nil, false},
+		{[]string{"A.com"}, nil, false},
+		{[]string{"a..com"}, nil, false},
+		{[]string{"-a.com"}, nil, false},
+		{[]string{"localhost"}, nil, false},
+		{[]string{"a.com", "a.com"}, nil, false},
+		{nil, []*Route{{"/api", "web-api"}, {"/admin", "web-admin"}}, true},
+		{nil, []*Route{{"api", "web-api"}}, false},
+		{nil, []*Route{{"/", "web-api"}}, false},
+		{nil, []*Route{{"/a b", "web-api"}}, false},
+		{nil, []*Route{{"/a;", "web-api"}}, false},
+		{nil, []*Route{{"/api", ""}}, false},
+		{nil, []*Route{{"/api", "web"}}, false},
+		{nil, []*Route{{"/api", "web-api"}, {"/api", "web-admin"}}, false},
+	}
+	for _, c := range cases {
+		a := &AppYaml{Appname: "web", Domains: c.domains, Routes: c.routes}
+		if err := a.validateDomains(); (err == nil) != c.ok {
+			t.Errorf("validateDomains(%v, %v) = %v, want ok %v", c.domains, c.routes, err, c.ok)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package types
+
+// 抢主, 如果 key 不存在就创建, 如果已经是自己就续期
+// 返回自己是不是 leader
+func CampaignLeader(key, id string, ttl uint64) (bool, error) {
+	if _, err := etcdClient.Create(key, id, ttl); err == nil {
+		return true, nil
+	}
+	if _, err := etcdClient.CompareAndSwap(key, id, ttl, id, 0); err == nil {
+		return true, nil
+	}
+	if _, err := etcdClient.Get(key, false, false); err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+func GetLeader(key string) string {
+	r, err := etcdClient.Get(key, false, false)
+	if err != nil || r.Node.Dir {
+		return ""
+	}
+	return r.Node.Value
+}
+
+// 只删自己的, 别人已经抢到了就不管
+func ResignLeader(key, id string) error {
+	_, err := etcdClient.CompareAndDelete(key, id, 0)
+	return err
+}
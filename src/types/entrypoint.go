@@ -0,0 +1,139 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	. "utils"
+)
+
+var NoSuchEntrypoint = errors.New("no such entrypoint")
+
+// app.yaml 里 entrypoints 下面的一项, key 就是 Name
+// Daemon 的不占端口也不进 nginx
+type Entrypoint struct {
+	Name   string `json:"name" yaml:"-"`
+	Cmd    string `json:"cmd"`
+	Daemon bool   `json:"daemon"`
+}
+
+func (e *Entrypoint) Argv() ([]string, error) {
+	argv, err := SplitArgs(e.Cmd)
+	if err != nil {
+		return nil, err
+	}
+	if len(argv) == 0 {
+		return nil, fmt.Errorf("entrypoint %s has empty cmd", e.Name)
+	}
+	return argv, nil
+}
+
+// 写了 entrypoints 的就用 entrypoints
+// 老的 cmd/daemon 列表也算, 第一个叫 cmd/daemon, 后面的叫 cmd1, cmd2, daemon1...
+func (a *AppYaml) GetEntrypoints() map[string]*Entrypoint {
+	eps := map[string]*Entrypoint{}
+	legacy := func(prefix string, cmds []string, daemon bool) {
+		for i, cmd := range cmds {
+			name := prefix
+			if i > 0 {
+				name = fmt.Sprintf("%s%d", prefix, i)
+			}
+			eps[name] = &Entrypoint{Name: name, Cmd: cmd, Daemon: daemon}
+		}
+	}
+	legacy(ENTRY_CMD, a.Cmd, false)
+	legacy(ENTRY_DAEMON, a.Daemon, true)
+	for name, e := range a.Entrypoints {
+		if e != nil {
+			eps[name] = &Entrypoint{Name: name, Cmd: e.Cmd, Daemon: e.Daemon}
+		}
+	}
+	return eps
+}
+
+// name 为空的时候选默认的
+// 老的 cmd/daemon 优先, 不然按名字排第一个 daemon 一样的
+func (a *AppYaml) GetEntrypoint(name string, daemon bool) (*Entrypoint, error) {
+	eps := a.GetEntrypoints()
+	if name != "" {
+		e, exists := eps[name]
+		if !exists {
+			return nil, fmt.Errorf("%s: %s", NoSuchEntrypoint, name)
+		}
+		return e, nil
+	}
+	legacy := ENTRY_CMD
+	if daemon {
+		legacy = ENTRY_DAEMON
+	}
+	if e, exists := eps[legacy]; exists && e.Daemon == daemon {
+		return e, nil
+	}
+	names := make([]string, 0, len(eps))
+	for n := range eps {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		if eps[n].Daemon == daemon {
+			return eps[n], nil
+		}
+	}
+	if daemon {
+		return nil, errors.New("no daemon defined in app.yaml")
+	}
+	return nil, errors.New("no cmd defined in app.yaml")
+}
+
+// 容器在 appYaml 里对应的入口, 老容器没记的用默认的
+func (c *Container) GetEntrypoint(appYaml *AppYaml) (*Entrypoint, error) {
+	return appYaml.GetEntrypoint(c.Entrypoint, c.IdentID != "")
+}
+
+// 测试命令有好几条的时候用 sh 按顺序跑, 有一条失败就算失败
+func (a *AppYaml) TestArgv() ([]string, error) {
+	switch len(a.Test) {
+	case 0:
+		return nil, errors.New("need test in app.yaml")
+	case 1:
+		return SplitArgs(a.Test[0])
+	}
+	return []string{"/bin/sh", "-c", strings.Join(a.Test, " && ")}, nil
+}
+
+// build 本来就是交给 shell 跑的, 好几条就连起来
+func (a *AppYaml) BuildCmd() string {
+	return strings.Join(a.Build, " && ")
+}
+
+// 注册的时候检查 entrypoints 能不能解析, resources 对不对得上, health, domains, routes, ports 和 protocol 写得对不对
+func (a *AppYaml) Validate() error {
+	eps := a.GetEntrypoints()
+	names := []string{ENTRY_TEST}
+	for name, e := range eps {
+		if _, err := e.Argv(); err != nil {
+			return err
+		}
+		names = append(names, name)
+	}
+	if len(a.Test) > 0 {
+		if _, err := a.TestArgv(); err != nil {
+			return err
+		}
+	}
+	if err := a.Health.Validate(); err != nil {
+		return err
+	}
+	if err := a.validateDomains(); err != nil {
+		return err
+	}
+	if err := a.validatePorts(); err != nil {
+		return err
+	}
+	if err := a.validateProtocol(); err != nil {
+		return err
+	}
+	return a.Resources.Validate(names)
+}
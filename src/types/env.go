@@ -0,0 +1,183 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"config"
+	. "utils"
+)
+
+const SECRET_MASK = "******"
+
+var (
+	NoSecretKey    = errors.New("secrets.key not configured")
+	InvalidEnvName = errors.New("invalid env var name")
+	envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// 容器的环境变量, Env 为空的是所有环境都有, 写了环境的覆盖它
+// Secret 的 Value 是用 secrets.key 加密过的, 接口里只给 ******
+// Ref 是 "资源名.字段", 发任务的时候从这个环境的资源里取, 比如 mysql.password
+type EnvVar struct {
+	ID      int       `orm:"column(id);auto;pk" json:"id"`
+	AppName string    `json:"app_name"`
+	Env     string    `json:"env"`
+	Name    string    `json:"name"`
+	Value   string    `orm:"type(text)" json:"-"`
+	Secret  bool      `json:"secret"`
+	Ref     string    `json:"ref"`
+	Created time.Time `orm:"auto_now_add;type(datetime)" json:"created"`
+	Updated time.Time `orm:"auto_now;type(datetime)" json:"updated"`
+
+	// 给接口看的, secret 的是 ******
+	Display string `orm:"-" json:"value"`
+}
+
+func GetEnvVars(appname string) []*EnvVar {
+	var es []*EnvVar
+	db.QueryTable(new(EnvVar)).Filter("AppName", appname).OrderBy("Env", "Name").All(&es)
+	for _, e := range es {
+		e.Display = e.Value
+		if e.Secret {
+			e.Display = SECRET_MASK
+		}
+	}
+	return es
+}
+
+func GetEnvVar(appname, env, name string) *EnvVar {
+	var e EnvVar
+	err := db.QueryTable(new(EnvVar)).Filter("AppName", appname).Filter("Env", env).Filter("Name", name).One(&e)
+	if err != nil {
+		return nil
+	}
+	return &e
+}
+
+// 有就改, 没有就创建; value 和 ref 只能写一个
+func SetEnvVar(appname, env, name, value, ref string, secret bool) (*EnvVar, error) {
+	if !envNamePattern.MatchString(name) {
+		return nil, InvalidEnvName
+	}
+	if env != "" && !IsEnvironment(env) {
+		return nil, NoSuchEnvironment
+	}
+	if ref != "" {
+		if value != "" {
+			return nil, errors.New("value and ref can't be both set")
+		}
+		if len(strings.SplitN(ref, ".", 2)) != 2 {
+			return nil, errors.New("ref must be resource.key")
+		}
+	}
+	if secret && ref == "" {
+		key := config.Config.Secrets.Key
+		if key == "" {
+			return nil, NoSecretKey
+		}
+		encrypted, err := Encrypt(key, value)
+		if err != nil {
+			return nil, err
+		}
+		value = encrypted
+	}
+
+	e := GetEnvVar(appname, env, name)
+	if e == nil {
+		e = &EnvVar{AppName: appname, Env: env, Name: name}
+	}
+	e.Value, e.Ref, e.Secret = value, ref, secret && ref == ""
+	var err error
+	if e.ID == 0 {
+		_, err = db.Insert(e)
+	} else {
+		_, err = db.Update(e)
+	}
+	if err != nil {
+		return nil, err
+	}
+	e.Display = e.Value
+	if e.Secret {
+		e.Display = SECRET_MASK
+	}
+	return e, nil
+}
+
+func (e *EnvVar) Delete() bool {
+	_, err := db.Delete(&EnvVar{ID: e.ID})
+	return err == nil
+}
+
+// 没写环境的排前面, 后面的覆盖前面的
+type byEnv []*EnvVar
+
+func (b byEnv) Len() int      { return len(b) }
+func (b byEnv) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byEnv) Less(i, j int) bool {
+	return b[i].Env < b[j].Env
+}
+
+// 某个环境下容器最后拿到的环境变量, 解密和取资源都在这里做
+// 只在发任务给 levi 的时候调, 结果不要存也不要打日志
+func ResolveEnv(appname, env string) (map[string]string, error) {
+	return resolveEnv(GetEnvVars(appname), env, func() map[string]interface{} {
+		return resource(appname, env)
+	})
+}
+
+// 资源要用到 ref 的时候才去取
+func resolveEnv(es []*EnvVar, env string, resources func() map[string]interface{}) (map[string]string, error) {
+	sort.Stable(byEnv(es))
+	vars := map[string]string{}
+	var res map[string]interface{}
+	for _, e := range es {
+		if e.Env != "" && e.Env != env {
+			continue
+		}
+		switch {
+		case e.Ref != "":
+			if res == nil {
+				res = resources()
+			}
+			v, err := resourceField(res, e.Ref)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", e.Name, err)
+			}
+			vars[e.Name] = v
+		case e.Secret:
+			key := config.Config.Secrets.Key
+			if key == "" {
+				return nil, NoSecretKey
+			}
+			v, err := Decrypt(key, e.Value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: decrypt failed", e.Name)
+			}
+			vars[e.Name] = v
+		default:
+			vars[e.Name] = e.Value
+		}
+	}
+	return vars, nil
+}
+
+// ref 是 "资源名.字段", 资源是 yaml 解出来的, 里面的 map key 是 interface{}
+func resourceField(res map[string]interface{}, ref string) (string, error) {
+	r := strings.SplitN(ref, ".", 2)
+	switch m := res[r[0]].(type) {
+	case map[interface{}]interface{}:
+		if v, exists := m[r[1]]; exists {
+			return fmt.Sprint(v), nil
+		}
+	case map[string]interface{}:
+		if v, exists := m[r[1]]; exists {
+			return fmt.Sprint(v), nil
+		}
+	}
+	return "", fmt.Errorf("no resource %s", ref)
+}
@@ -0,0 +1,78 @@
+package types
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+
+	"config"
+	"utils"
+)
+
+func TestResolveEnv(t *testing.T) {
+	saved := config.Config.Secrets
+	defer func() { config.Config.Secrets = saved }()
+	key := base64.StdEncoding.EncodeToString([]byte("0123456789abcdef"))
+	config.Config.Secrets.Key = key
+	secret, err := utils.Encrypt(key, "p@ss")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := map[string]interface{}{
+		"mysql":  map[interface{}]interface{}{"password": "dbpass", "port": 3306},
+		"redis":  map[string]interface{}{"host": "10.0.0.1"},
+		"sentry": "not a map",
+	}
+	cases := []struct {
+		name    string
+		vars    []*EnvVar
+		env     string
+		want    map[string]string
+		err     bool
+		fetched bool
+	}{
+		{"empty", nil, "prod", map[string]string{}, false, false},
+		{"plain", []*EnvVar{{Name: "A", Value: "1"}}, "prod", map[string]string{"A": "1"}, false, false},
+		{
+			"env overrides default", []*EnvVar{{Env: "prod", Name: "A", Value: "2"}, {Name: "A", Value: "1"}, {Name: "B", Value: "b"}},
+			"prod", map[string]string{"A": "2", "B": "b"}, false, false,
+		},
+		{
+			"other env skipped", []*EnvVar{{Name: "A", Value: "1"}, {Env: "test", Name: "A", Value: "2"}, {Env: "test", Name: "C", Value: "c"}},
+			"prod", map[string]string{"A": "1"}, false, false,
+		},
+		{"secret", []*EnvVar{{Name: "P", Value: secret, Secret: true}}, "prod", map[string]string{"P": "p@ss"}, false, false},
+		{"bad secret", []*EnvVar{{Name: "P", Value: "garbage", Secret: true}}, "prod", nil, true, false},
+		{
+			"refs", []*EnvVar{{Name: "DB_PASS", Ref: "mysql.password"}, {Name: "DB_PORT", Ref: "mysql.port"}, {Name: "REDIS", Ref: "redis.host"}},
+			"prod", map[string]string{"DB_PASS": "dbpass", "DB_PORT": "3306", "REDIS": "10.0.0.1"}, false, true,
+		},
+		{"missing field", []*EnvVar{{Name: "X", Ref: "mysql.user"}}, "prod", nil, true, true},
+		{"missing resource", []*EnvVar{{Name: "X", Ref: "influxdb.url"}}, "prod", nil, true, true},
+		{"not a map", []*EnvVar{{Name: "X", Ref: "sentry.dsn"}}, "prod", nil, true, true},
+		{"ref of other env", []*EnvVar{{Env: "test", Name: "X", Ref: "mysql.user"}}, "prod", map[string]string{}, false, false},
+	}
+	for _, c := range cases {
+		fetched := 0
+		got, err := resolveEnv(c.vars, c.env, func() map[string]interface{} {
+			fetched++
+			return res
+		})
+		if (err != nil) != c.err {
+			t.Errorf("%s: err = %v, want error %v", c.name, err, c.err)
+			continue
+		}
+		if !c.err && !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: resolveEnv = %v, want %v", c.name, got, c.want)
+		}
+		if (fetched > 0) != c.fetched || fetched > 1 {
+			t.Errorf("%s: fetched resources %d times", c.name, fetched)
+		}
+	}
+
+	config.Config.Secrets.Key = ""
+	if _, err := resolveEnv([]*EnvVar{{Name: "P", Value: secret, Secret: true}}, "prod", nil); err != NoSecretKey {
+		t.Errorf("no key: err = %v, want %v", err, NoSecretKey)
+	}
+}
@@ -0,0 +1,144 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"config"
+)
+
+// 一直都有的两个环境, 测试容器跑在 test 里
+const (
+	ENV_PROD = "prod"
+	ENV_TEST = "test"
+)
+
+var (
+	NoSuchEnvironment      = errors.New("no such environment")
+	environmentNamePattern = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+)
+
+// 除了 prod/test, 配置里 environments 写的, 还有用接口建的 (比如每个分支一个 preview)
+// 每个环境有自己的资源, 自己的容器和 deployment, nginx 里是单独的 upstream 和 server
+// Domain 不写 server_name 就是 app.环境.podname.域名, prod 没有中间的环境
+type Environment struct {
+	ID      int       `orm:"column(id);auto;pk" json:"id"`
+	Name    string    `json:"name"`
+	Domain  string    `json:"domain"`
+	Created time.Time `orm:"auto_now_add;type(datetime)" json:"created"`
+	// prod/test 和配置里的不能删
+	Builtin bool `orm:"-" json:"builtin"`
+}
+
+func builtinEnvironments() []*Environment {
+	es := []*Environment{
+		&Environment{Name: ENV_PROD, Builtin: true},
+		&Environment{Name: ENV_TEST, Builtin: true},
+	}
+	for _, e := range config.Config.Environments {
+		switch e.Name {
+		case ENV_PROD:
+			es[0].Domain = e.Domain
+		case ENV_TEST:
+			es[1].Domain = e.Domain
+		default:
+			es = append(es, &Environment{Name: e.Name, Domain: e.Domain, Builtin: true})
+		}
+	}
+	return es
+}
+
+func GetEnvironments() []*Environment {
+	var es []*Environment
+	db.QueryTable(new(Environment)).OrderBy("Name").All(&es)
+	return append(builtinEnvironments(), es...)
+}
+
+func GetEnvironment(name string) *Environment {
+	for _, e := range builtinEnvironments() {
+		if e.Name == name {
+			return e
+		}
+	}
+	var e Environment
+	if err := db.QueryTable(new(Environment)).Filter("Name", name).One(&e); err != nil {
+		return nil
+	}
+	return &e
+}
+
+func IsEnvironment(name string) bool {
+	return GetEnvironment(name) != nil
+}
+
+func NewEnvironment(name, domain string) (*Environment, error) {
+	if !environmentNamePattern.MatchString(name) {
+		return nil, errors.New("environment name must be lowercase letters, digits and -")
+	}
+	if IsEnvironment(name) {
+		return nil, fmt.Errorf("environment %s already exists", name)
+	}
+	e := &Environment{Name: name, Domain: domain}
+	if _, err := db.Insert(e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// 还有容器或者 deployment 的不能删, 环境变量和 nginx 上的端口跟着一起删
+func (e *Environment) Delete() error {
+	if e.Builtin {
+		return errors.New("can't delete builtin environment")
+	}
+	if n, _ := db.QueryTable(new(Container)).Filter("Env", e.Name).Count(); n > 0 {
+		return fmt.Errorf("environment %s still has %d containers", e.Name, n)
+	}
+	if n, _ := db.QueryTable(new(Deployment)).Filter("Env", e.Name).Count(); n > 0 {
+		return fmt.Errorf("environment %s still has %d deployments", e.Name, n)
+	}
+	db.QueryTable(new(EnvVar)).Filter("Env", e.Name).Delete()
+	db.QueryTable(new(Listener)).Filter("Env", e.Name).Delete()
+	_, err := db.Delete(&Environment{ID: e.ID})
+	return err
+}
+
+// mysql/redis/influxdb 这些资源用的名字, prod 就是 app 名, 别的带上环境
+func (e *Environment) DBName(appname string) string {
+	if e.Name == ENV_PROD {
+		return appname
+	}
+	return fmt.Sprintf("%s_%s", appname, strings.Replace(e.Name, "-", "_", -1))
+}
+
+// nginx 里 upstream 的名字和配置文件名, prod 的还是原来的 app 名
+func (e *Environment) UpstreamName(appname string) string {
+	if e.Name == ENV_PROD {
+		return appname
+	}
+	return fmt.Sprintf("%s.%s", appname, e.Name)
+}
+
+func (e *Environment) ServerName(appname string) string {
+	if e.Domain != "" {
+		return fmt.Sprintf("%s.%s", appname, e.Domain)
+	}
+	domain := config.Config.Nginx.Domain
+	if domain == "" {
+		domain = "hunantv.com"
+	}
+	return fmt.Sprintf("%s.%s.%s", e.UpstreamName(appname), config.Config.PodName, domain)
+}
+
+// 自己配了域名的不管 DNS
+func (e *Environment) DNSPath(appname string) string {
+	if e.Domain != "" {
+		return ""
+	}
+	if e.Name == ENV_PROD {
+		return appname
+	}
+	return e.Name + "/" + appname
+}
@@ -0,0 +1,51 @@
+package types
+
+import "time"
+
+// 容器死掉之后 dot 做了什么
+const (
+	EVENT_DIE = "die"
+
+	ACTION_REMOVED    = "removed"
+	ACTION_RESTARTED  = "restarted"
+	ACTION_RECONCILED = "reconciled"
+	ACTION_IGNORED    = "ignored"
+)
+
+type Event struct {
+	ID          int       `orm:"column(id);auto;pk" json:"id"`
+	AppName     string    `json:"app_name"`
+	Version     string    `json:"version"`
+	SubApp      string    `orm:"column(sub_app)" json:"sub_app"`
+	HostID      int       `orm:"column(host_id)" json:"host_id"`
+	ContainerID string    `orm:"column(container_id)" json:"container_id"`
+	Kind        string    `json:"kind"`
+	ExitCode    int       `json:"exit_code"`
+	Action      string    `json:"action"`
+	Message     string    `json:"message"`
+	Created     time.Time `orm:"auto_now_add;type(datetime)" json:"created"`
+}
+
+func NewEvent(c *Container, kind string, exitCode int, action, message string) *Event {
+	e := &Event{
+		AppName:     c.AppName,
+		Version:     c.Version,
+		SubApp:      c.SubApp,
+		HostID:      c.HostID,
+		ContainerID: c.ContainerID,
+		Kind:        kind,
+		ExitCode:    exitCode,
+		Action:      action,
+		Message:     message,
+	}
+	if _, err := db.Insert(e); err != nil {
+		return nil
+	}
+	return e
+}
+
+func GetEvents(appname string, start, limit int) []*Event {
+	var es []*Event
+	db.QueryTable(new(Event)).Filter("AppName", appname).OrderBy("-ID").Limit(limit, start).All(&es)
+	return es
+}
@@ -0,0 +1,130 @@
+package types
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	HEALTH_HTTP = "http"
+	HEALTH_TCP  = "tcp"
+	HEALTH_CMD  = "cmd"
+)
+
+// 容器的健康状态, 空的是没配健康检查, 和 healthy 一样进 nginx
+const (
+	HEALTH_STARTING  = "starting"
+	HEALTH_HEALTHY   = "healthy"
+	HEALTH_UNHEALTHY = "unhealthy"
+)
+
+const (
+	EVENT_UNHEALTHY = "unhealthy"
+
+	ACTION_REPLACED = "replaced"
+)
+
+// app.yaml 里的 health
+// http/tcp 是 dot 对容器的端口做, 只对有端口的入口有用; cmd 是 levi 在容器里跑, 返回 0 算过
+// 连续失败 threshold 次算 unhealthy, start_period 秒内的失败不算
+// replace 打开的话 unhealthy 的容器会被删掉重新起一个
+type HealthCheck struct {
+	Type        string `json:"type"`
+	Path        string `json:"path,omitempty"`
+	Cmd         string `json:"cmd,omitempty"`
+	Interval    int    `json:"interval,omitempty"`
+	Timeout     int    `json:"timeout,omitempty"`
+	Threshold   int    `json:"threshold,omitempty"`
+	StartPeriod int    `json:"start_period,omitempty" yaml:"start_period"`
+	Replace     bool   `json:"replace,omitempty"`
+}
+
+func (h *HealthCheck) Validate() error {
+	switch h.Type {
+	case "", HEALTH_HTTP, HEALTH_TCP:
+	case HEALTH_CMD:
+		if h.Cmd == "" {
+			return errors.New("health cmd is empty")
+		}
+	default:
+		return errors.New("unknown health check " + h.Type)
+	}
+	if h.Interval < 0 || h.Timeout < 0 || h.Threshold < 0 || h.StartPeriod < 0 {
+		return errors.New("health check settings must not be negative")
+	}
+	return nil
+}
+
+// 这个入口的健康检查, 不用做的是 nil
+func (a *AppYaml) HealthFor(entrypoint *Entrypoint) *HealthCheck {
+	if !a.Health.Applies(entrypoint) {
+		return nil
+	}
+	h := a.Health
+	return &h
+}
+
+// 这个入口要不要做, daemon 没有端口只能用 cmd
+func (h *HealthCheck) Applies(entrypoint *Entrypoint) bool {
+	switch h.Type {
+	case HEALTH_CMD:
+		return true
+	case HEALTH_HTTP, HEALTH_TCP:
+		return !entrypoint.Daemon
+	}
+	return false
+}
+
+func (h *HealthCheck) GetInterval() time.Duration {
+	if h.Interval <= 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(h.Interval) * time.Second
+}
+
+func (h *HealthCheck) GetTimeout() time.Duration {
+	if h.Timeout <= 0 {
+		return 5 * time.Second
+	}
+	return time.Duration(h.Timeout) * time.Second
+}
+
+func (h *HealthCheck) GetThreshold() int {
+	if h.Threshold <= 0 {
+		return 3
+	}
+	return h.Threshold
+}
+
+func (h *HealthCheck) InStartPeriod(c *Container) bool {
+	return time.Since(c.Created) < time.Duration(h.StartPeriod)*time.Second
+}
+
+// 能进 nginx 的容器, 要删的也不算
+func (c *Container) Healthy() bool {
+	return !c.Stopping && (c.Health == "" || c.Health == HEALTH_HEALTHY)
+}
+
+// 检查了一次, 返回状态是不是变了
+// 成功一次就是 healthy, 连续失败 threshold 次才是 unhealthy
+func (c *Container) CheckedHealth(h *HealthCheck, err error) bool {
+	old := c.Health
+	c.HealthChecked = time.Now()
+	if err == nil {
+		c.Health, c.HealthFailures, c.HealthMessage = HEALTH_HEALTHY, 0, ""
+	} else if !h.InStartPeriod(c) {
+		c.HealthFailures = c.HealthFailures + 1
+		c.HealthMessage = err.Error()
+		if c.HealthFailures >= h.GetThreshold() {
+			c.Health = HEALTH_UNHEALTHY
+		}
+	}
+	db.Update(c, "Health", "HealthFailures", "HealthMessage", "HealthChecked")
+	return old != c.Health
+}
+
+func GetHealthCheckedContainers() []*Container {
+	var cs []*Container
+	db.QueryTable(new(Container)).Exclude("Health", "").OrderBy("ID").All(&cs)
+	return cs
+}
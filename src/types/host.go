@@ -1,12 +1,40 @@
 package types
 
-import "config"
-
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"config"
+)
+
+const (
+	HOST_DRAINING     = "draining"
+	HOST_DRAINED      = "drained"
+	HOST_DRAIN_FAILED = "drain_failed"
+)
+
+// Cores 到 Reported 是 levi 报上来的, Memory 和 Disk 单位是字节
+// Labels 是 levi 报的, UserLabels 是 api 设的, 都是 k=v 逗号分隔, 按 key 排好序
+// Cordoned 的机器不再放新容器
 type Host struct {
-	ID     int    `orm:"column(id);auto;pk" json:"id"`
-	IP     string `orm:"column(ip)" json:"ip"`
-	Name   string `json:"name"`
-	Status int    `json:"status"`
+	ID       int       `orm:"column(id);auto;pk" json:"id"`
+	IP       string    `orm:"column(ip)" json:"ip"`
+	Name     string    `json:"name"`
+	Status   int       `json:"status"`
+	Cores    int       `json:"cores"`
+	Memory   int64     `json:"memory"`
+	Disk     int64     `json:"disk"`
+	Docker   string    `json:"docker"`
+	Kernel   string    `json:"kernel"`
+	Labels   string    `orm:"type(text)" json:"labels"`
+	Reported time.Time `orm:"null;type(datetime)" json:"reported"`
+
+	UserLabels   string `orm:"type(text)" json:"user_labels"`
+	Cordoned     bool   `json:"cordoned"`
+	Drain        string `json:"drain"`
+	DrainMessage string `json:"drain_message"`
 }
 
 type Port struct {
@@ -51,6 +79,18 @@ func GetAllHosts(start, limit int) []*Host {
 	return hosts
 }
 
+func GetOnlineHosts() []*Host {
+	var hosts []*Host
+	db.QueryTable(new(Host)).Filter("Status", 0).OrderBy("ID").All(&hosts)
+	return hosts
+}
+
+func GetDrainingHosts() []*Host {
+	var hosts []*Host
+	db.QueryTable(new(Host)).Filter("Drain", HOST_DRAINING).All(&hosts)
+	return hosts
+}
+
 func (h *Host) Online() {
 	h.Status = 0
 	db.Update(h)
@@ -61,6 +101,81 @@ func (h *Host) Offline() {
 	db.Update(h)
 }
 
+// levi 连上来和之后定时报的机器信息
+func (h *Host) Report(facts *HostFacts) {
+	if facts.Hostname != "" {
+		h.Name = facts.Hostname
+	}
+	h.Cores = facts.Cores
+	h.Memory = facts.Memory
+	h.Disk = facts.Disk
+	h.Docker = facts.Docker
+	h.Kernel = facts.Kernel
+	h.Labels = joinLabels(facts.Labels)
+	h.Reported = time.Now()
+	// 只改报上来的字段, 不要把 status 覆盖了
+	db.Update(h, "Name", "Cores", "Memory", "Disk", "Docker", "Kernel", "Labels", "Reported")
+}
+
+// 同一个 key 以 api 设的为准
+func (h *Host) LabelMap() map[string]string {
+	labels := ParseLabels(h.Labels)
+	for k, v := range ParseLabels(h.UserLabels) {
+		labels[k] = v
+	}
+	return labels
+}
+
+// selector 里的每个 k=v 都要有
+func (h *Host) Match(selector map[string]string) bool {
+	labels := h.LabelMap()
+	for k, v := range selector {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (h *Host) SetLabels(labels map[string]string) {
+	h.UserLabels = joinLabels(labels)
+	db.Update(h, "UserLabels")
+}
+
+// uncordon 的时候顺便把 drain 的状态清掉
+func (h *Host) Cordon(cordoned bool) {
+	h.Cordoned = cordoned
+	if !cordoned {
+		h.Drain, h.DrainMessage = "", ""
+	}
+	db.Update(h, "Cordoned", "Drain", "DrainMessage")
+}
+
+func (h *Host) SetDrain(status, message string) {
+	h.Drain, h.DrainMessage = status, message
+	db.Update(h, "Drain", "DrainMessage")
+}
+
+// "ssd=true,rack=a3"
+func ParseLabels(s string) map[string]string {
+	labels := map[string]string{}
+	for _, kv := range strings.Split(s, ",") {
+		if r := strings.SplitN(strings.TrimSpace(kv), "=", 2); len(r) == 2 && r[0] != "" {
+			labels[r[0]] = r[1]
+		}
+	}
+	return labels
+}
+
+func joinLabels(labels map[string]string) string {
+	kvs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		kvs = append(kvs, fmt.Sprintf("%s=%s", k, v))
+	}
+	sort.Strings(kvs)
+	return strings.Join(kvs, ",")
+}
+
 // 注意里面可能有nil
 func GetHostsByIPs(ips []string) []*Host {
 	hosts := make([]*Host, len(ips))
@@ -93,33 +208,48 @@ func (h *Host) RemovePort(port int) {
 	db.Raw("DELETE FROM port WHERE host_id=? AND port=?", h.ID, port).Exec()
 }
 
-// 获取一个host上的可用的一个端口
-// 如果超出范围就返回0
+// 获取一个host上的可用的 n 个端口
+// 不够就返回 nil
 // 只允许一个访问
-func GetPortFromHost(host *Host) int {
-	lowerBound, upperBound := config.Config.Minport, config.Config.Maxport+1
+func GetPortFromHost(host *Host, n int) []int {
 	portMutex.Lock()
 	defer portMutex.Unlock()
+	newPorts := freePorts(host.Ports(), config.Config.Minport, config.Config.Maxport, n)
+	if newPorts == nil {
+		return nil
+	}
+	for _, port := range newPorts {
+		host.AddPort(port)
+	}
+	return newPorts
+}
+
+// min 到 max 里从小往大挑 n 个 used 里没有的, 不够返回 nil
+func freePorts(used []int, min, max, n int) []int {
+	lowerBound, upperBound := min, max+1
+	if upperBound <= lowerBound {
+		return nil
+	}
 	portList := make([]int, upperBound-lowerBound)
-	newPort := lowerBound
 
-	for _, port := range host.Ports() {
+	for _, port := range used {
 		index := port - lowerBound
 		if index >= len(portList) || index < 0 {
 			continue
 		}
 		portList[index] = port
 	}
+	newPorts := []int{}
 	for index, hold := range portList {
-		if hold == 0 {
-			newPort = lowerBound + index
+		if len(newPorts) == n {
 			break
 		}
+		if hold == 0 {
+			newPorts = append(newPorts, lowerBound+index)
+		}
 	}
-	if newPort >= upperBound {
-		return 0
-	} else {
-		host.AddPort(newPort)
+	if len(newPorts) < n {
+		return nil
 	}
-	return newPort
+	return newPorts
 }
@@ -0,0 +1,33 @@
+package types
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFreePorts(t *testing.T) {
+	cases := []struct {
+		used     []int
+		min, max int
+		n        int
+		want     []int
+	}{
+		{nil, 5000, 5004, 1, []int{5000}},
+		{nil, 5000, 5004, 3, []int{5000, 5001, 5002}},
+		{[]int{5000, 5002}, 5000, 5004, 2, []int{5001, 5003}},
+		{[]int{5001, 4999, 6000}, 5000, 5004, 2, []int{5000, 5002}},
+		{[]int{5000, 5001, 5002}, 5000, 5004, 2, []int{5003, 5004}},
+		{[]int{5000, 5001, 5002}, 5000, 5004, 3, nil},
+		{nil, 5000, 5004, 5, []int{5000, 5001, 5002, 5003, 5004}},
+		{nil, 5000, 5004, 6, nil},
+		{nil, 5000, 5000, 1, []int{5000}},
+		{nil, 5000, 4999, 1, nil},
+		{nil, 5000, 5004, 0, []int{}},
+	}
+	for _, c := range cases {
+		got := freePorts(c.used, c.min, c.max, c.n)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("freePorts(%v, %d, %d, %d) = %v, want %v", c.used, c.min, c.max, c.n, got, c.want)
+		}
+	}
+}
@@ -26,6 +26,7 @@ type Job struct {
 	Succ       int       `json:"succ"`   // 成功/失败
 	Kind       int       `json:"kind"`   // 类型, Add/Remove/Update/Build/Test
 	Result     string    `json:"result"`
+	Ingress    string    `orm:"size(1024)" json:"ingress"` // nginx 配置没更新成功的原因
 	Created    time.Time `orm:"auto_now_add;type(datetime)" json:"created"`
 	Finished   time.Time `orm:"auto_now;type(datetime)" json:"finished"`
 }
@@ -84,3 +85,24 @@ func (j *Job) SetResult(result string) {
 	j.Result = result
 	db.Update(j)
 }
+
+// 某个 app 在 since 之后还有没有没跑完的某些类型的任务
+func HasRunningJobs(name string, kinds []int, since time.Time) bool {
+	n, err := db.QueryTable(new(Job)).Filter("AppName", name).Filter("Status", RUNNING).
+		Filter("Kind__in", kinds).Filter("Created__gte", since).Count()
+	return err == nil && n > 0
+}
+
+// 容器起来了但是 nginx 没更新成功, 任务也算失败
+func FailJobsOnIngress(ids []int, message string) {
+	if len(ids) == 0 {
+		return
+	}
+	if len(message) > 1024 {
+		message = message[:1024]
+	}
+	db.QueryTable(new(Job)).Filter("ID__in", ids).Update(map[string]interface{}{
+		"Succ":    FAIL,
+		"Ingress": message,
+	})
+}
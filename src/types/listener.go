@@ -0,0 +1,139 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"config"
+)
+
+// app.yaml 里的 protocol, 不写就是 http
+// tcp/udp 走 nginx 的 stream, grpc 是 http2 的 server, 都要在 master nginx 上单独占一个端口
+const (
+	PROTOCOL_HTTP = "http"
+	PROTOCOL_TCP  = "tcp"
+	PROTOCOL_UDP  = "udp"
+	PROTOCOL_GRPC = "grpc"
+)
+
+var NoListenPort = errors.New("no listen port left")
+
+// master nginx 上给 app/sub app 在一个环境里分的对外端口
+type Listener struct {
+	ID       int       `orm:"column(id);auto;pk" json:"id"`
+	AppName  string    `json:"app_name"`
+	SubApp   string    `json:"sub_app"`
+	Env      string    `json:"env"`
+	Protocol string    `json:"protocol"`
+	Port     int       `orm:"unique" json:"port"`
+	Created  time.Time `orm:"auto_now_add;type(datetime)" json:"created"`
+}
+
+// 进 nginx 的那个端口的协议
+func (a *AppYaml) GetProtocol() string {
+	if p := a.IngressPort(); p != nil && p.Protocol != "" {
+		return p.Protocol
+	}
+	return PROTOCOL_HTTP
+}
+
+// 发给 levi 的, http 的不写, 老的 levi 看不懂也没关系
+func (a *AppYaml) taskProtocol() string {
+	return taskProtocol(a.GetProtocol())
+}
+
+func taskProtocol(protocol string) string {
+	if protocol == PROTOCOL_HTTP {
+		return ""
+	}
+	return protocol
+}
+
+func checkProtocol(protocol string) error {
+	switch protocol {
+	case "", PROTOCOL_HTTP, PROTOCOL_TCP, PROTOCOL_UDP, PROTOCOL_GRPC:
+		return nil
+	}
+	return fmt.Errorf("unknown protocol %s", protocol)
+}
+
+// udp 的端口 dot 连不上, 进 nginx 的是 udp 的话健康检查只能用 cmd
+func (a *AppYaml) validateProtocol() error {
+	if err := checkProtocol(a.Protocol); err != nil {
+		return err
+	}
+	for _, p := range a.Ports {
+		if err := checkProtocol(p.Protocol); err != nil {
+			return err
+		}
+	}
+	if a.GetProtocol() == PROTOCOL_UDP && (a.Health.Type == HEALTH_HTTP || a.Health.Type == HEALTH_TCP) {
+		return fmt.Errorf("%s health check doesn't work with udp", a.Health.Type)
+	}
+	return nil
+}
+
+// http 的走 80/443, 不用单独的端口
+func NeedsListener(protocol string) bool {
+	return protocol != "" && protocol != PROTOCOL_HTTP
+}
+
+func GetListener(appname, subapp, env string) *Listener {
+	var l Listener
+	err := db.QueryTable(new(Listener)).Filter("AppName", appname).Filter("SubApp", subapp).Filter("Env", env).One(&l)
+	if err != nil {
+		return nil
+	}
+	return &l
+}
+
+func GetListeners(appname string) []*Listener {
+	var ls []*Listener
+	query := db.QueryTable(new(Listener))
+	if appname != "" {
+		query = query.Filter("AppName", appname)
+	}
+	query.OrderBy("Port").All(&ls)
+	return ls
+}
+
+// 已经有了就还用原来的端口, 不然从 nginx.listen_ports 里挑一个最小的没用过的
+func AllocateListener(appname, subapp, env, protocol string) (*Listener, error) {
+	if l := GetListener(appname, subapp, env); l != nil {
+		if l.Protocol != protocol {
+			l.Protocol = protocol
+			db.Update(l, "Protocol")
+		}
+		return l, nil
+	}
+	port, err := freeListenPort(config.Config.Nginx.ListenPorts, GetListeners(""))
+	if err != nil {
+		return nil, err
+	}
+	l := &Listener{AppName: appname, SubApp: subapp, Env: env, Protocol: protocol, Port: port}
+	if _, err := db.Insert(l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func freeListenPort(ports config.PortRange, listeners []*Listener) (int, error) {
+	if ports.Min <= 0 || ports.Max < ports.Min {
+		return 0, errors.New("nginx.listen_ports not configured")
+	}
+	used := map[int]bool{}
+	for _, l := range listeners {
+		used[l.Port] = true
+	}
+	for port := ports.Min; port <= ports.Max; port++ {
+		if !used[port] {
+			return port, nil
+		}
+	}
+	return 0, NoListenPort
+}
+
+func ReleaseListener(appname, subapp, env string) {
+	db.QueryTable(new(Listener)).Filter("AppName", appname).Filter("SubApp", subapp).Filter("Env", env).Delete()
+}
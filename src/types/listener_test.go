@@ -0,0 +1,35 @@
+package types
+
+import (
+	"testing"
+
+	"config"
+)
+
+func TestFreeListenPort(t *testing.T) {
+	cases := []struct {
+		ports     config.PortRange
+		listeners []*Listener
+		want      int
+		err       bool
+	}{
+		{config.PortRange{}, nil, 0, true},
+		{config.PortRange{Min: 0, Max: 10}, nil, 0, true},
+		{config.PortRange{Min: 10, Max: 9}, nil, 0, true},
+		{config.PortRange{Min: 9000, Max: 9002}, nil, 9000, false},
+		{config.PortRange{Min: 9000, Max: 9002}, []*Listener{{Port: 9000}}, 9001, false},
+		{config.PortRange{Min: 9000, Max: 9002}, []*Listener{{Port: 9001}, {Port: 9000}}, 9002, false},
+		{config.PortRange{Min: 9000, Max: 9002}, []*Listener{{Port: 9000}, {Port: 9002}, {Port: 8000}}, 9001, false},
+		{config.PortRange{Min: 9000, Max: 9002}, []*Listener{{Port: 9000}, {Port: 9001}, {Port: 9002}}, 0, true},
+		{config.PortRange{Min: 9000, Max: 9000}, []*Listener{{Port: 9001}}, 9000, false},
+	}
+	for _, c := range cases {
+		got, err := freeListenPort(c.ports, c.listeners)
+		if got != c.want || (err != nil) != c.err {
+			t.Errorf("freeListenPort(%+v, %d listeners) = %d, %v, want %d, error %v", c.ports, len(c.listeners), got, err, c.want, c.err)
+		}
+	}
+	if _, err := freeListenPort(config.PortRange{Min: 9000, Max: 9000}, []*Listener{{Port: 9000}}); err != NoListenPort {
+		t.Errorf("full range: err = %v, want %v", err, NoListenPort)
+	}
+}
@@ -0,0 +1,267 @@
+package types
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/coreos/go-etcd/etcd"
+
+	. "utils"
+)
+
+// 老的 port/protocol 当作一个叫 main 的端口
+const PORT_MAIN = "main"
+
+var portNamePattern = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+
+// app.yaml 里 ports 下面的一项, Port 是容器里的端口
+type PortSpec struct {
+	Name     string `json:"name"`
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+}
+
+// 发给 levi 的, Bind 是机器上分的端口
+type PortBind struct {
+	Name     string `json:"name"`
+	Port     int    `json:"port"`
+	Bind     int    `json:"bind"`
+	Protocol string `json:"protocol,omitempty"`
+}
+
+// 容器的每个端口绑在机器的哪个端口上, 进 nginx 的那个也在 Container.Port 里
+type ContainerPort struct {
+	ID          int    `orm:"column(id);auto;pk" json:"id"`
+	ContainerID string `orm:"column(container_id)" json:"container_id"`
+	Name        string `json:"name"`
+	Port        int    `json:"port"`
+	Bind        int    `json:"bind"`
+	Protocol    string `json:"protocol"`
+}
+
+// 写了 ports 就用 ports, 不然老的 port/protocol 算一个叫 main 的
+func (a *AppYaml) GetPorts() []*PortSpec {
+	if len(a.Ports) > 0 {
+		return a.Ports
+	}
+	if a.Port > 0 {
+		return []*PortSpec{&PortSpec{Name: PORT_MAIN, Port: a.Port, Protocol: a.Protocol}}
+	}
+	return nil
+}
+
+// 进 nginx 的那个, 写了 ingress 就是它, 不然是叫 http 的, 再不然是第一个
+func (a *AppYaml) IngressPort() *PortSpec {
+	ports := a.GetPorts()
+	if len(ports) == 0 {
+		return nil
+	}
+	name := a.Ingress
+	if name == "" {
+		name = PROTOCOL_HTTP
+	}
+	for _, p := range ports {
+		if p.Name == name {
+			return p
+		}
+	}
+	return ports[0]
+}
+
+func (a *AppYaml) validatePorts() error {
+	if a.Port > 0 && len(a.Ports) > 0 {
+		return fmt.Errorf("port and ports can't be both set")
+	}
+	names := map[string]struct{}{}
+	for _, p := range a.Ports {
+		if !portNamePattern.MatchString(p.Name) {
+			return fmt.Errorf("port name %s must be lowercase letters, digits and -", p.Name)
+		}
+		if _, exists := names[p.Name]; exists {
+			return fmt.Errorf("duplicated port %s", p.Name)
+		}
+		names[p.Name] = struct{}{}
+		if p.Port <= 0 || p.Port > 65535 {
+			return fmt.Errorf("invalid port %d of %s", p.Port, p.Name)
+		}
+	}
+	if _, exists := names[a.Ingress]; a.Ingress != "" && !exists {
+		return fmt.Errorf("ingress port %s not in ports", a.Ingress)
+	}
+	return nil
+}
+
+// 每个端口在机器上分一个, 没写端口的也分一个给老的 levi 绑
+// 分不够返回 nil
+func (a *AppYaml) bindPorts(host *Host) []*PortBind {
+	specs := a.GetPorts()
+	if len(specs) == 0 {
+		specs = []*PortSpec{&PortSpec{Name: PORT_MAIN}}
+	}
+	ports := GetPortFromHost(host, len(specs))
+	if ports == nil {
+		return nil
+	}
+	binds := make([]*PortBind, len(specs))
+	for i, spec := range specs {
+		binds[i] = &PortBind{Name: spec.Name, Port: spec.Port, Bind: ports[i], Protocol: taskProtocol(spec.Protocol)}
+	}
+	return binds
+}
+
+// binds 里进 nginx 的那个, task 的 Port/Bind 还是它, 老的 levi 只认这个
+func (a *AppYaml) ingressBind(binds []*PortBind) *PortBind {
+	if p := a.IngressPort(); p != nil {
+		for _, b := range binds {
+			if b.Name == p.Name {
+				return b
+			}
+		}
+	}
+	return binds[0]
+}
+
+func releaseBinds(host *Host, binds []*PortBind) {
+	for _, b := range binds {
+		host.RemovePort(b.Bind)
+	}
+}
+
+// 起容器的任务没发出去, 先占上的端口和核放回去
+func ReleaseTask(host *Host, task *Task) {
+	if task.Type != ADDCONTAINER && task.Type != UPDATECONTAINER {
+		return
+	}
+	binds := task.Ports
+	if len(binds) == 0 && task.Bind != 0 {
+		binds = []*PortBind{{Bind: task.Bind}}
+	}
+	releaseBinds(host, binds)
+	ReleaseJobCores(task.ID)
+}
+
+func (c *Container) Ports() []*ContainerPort {
+	var ps []*ContainerPort
+	db.QueryTable(new(ContainerPort)).Filter("ContainerID", c.ContainerID).OrderBy("Name").All(&ps)
+	return ps
+}
+
+// 老的任务没有 ports, 只有 Container.Port
+func (c *Container) AddPorts(binds []*PortBind) {
+	for _, b := range binds {
+		protocol := b.Protocol
+		if protocol == "" {
+			protocol = PROTOCOL_HTTP
+		}
+		p := &ContainerPort{ContainerID: c.ContainerID, Name: b.Name, Port: b.Port, Bind: b.Bind, Protocol: protocol}
+		if _, err := db.Insert(p); err != nil {
+			Logger.Info("add container port error: ", err)
+		}
+	}
+}
+
+func (c *Container) deletePorts(host *Host) {
+	for _, p := range c.Ports() {
+		if p.Bind != c.Port {
+			host.RemovePort(p.Bind)
+		}
+	}
+	db.QueryTable(new(ContainerPort)).Filter("ContainerID", c.ContainerID).Delete()
+}
+
+// app/sub app 在每个环境里每个端口的地址, 给服务发现用
+// 要删的和不 healthy 的不算, 老的容器只有 main
+func (a *Application) Services() map[string]map[string]map[string][]string {
+	services := map[string]map[string]map[string][]string{}
+	for _, c := range a.Containers() {
+		if c.Port == 0 || !c.Healthy() {
+			continue
+		}
+		host := c.Host()
+		if host == nil {
+			continue
+		}
+		name := c.AppName
+		if c.SubApp != "" {
+			name = c.SubApp
+		}
+		if services[name] == nil {
+			services[name] = map[string]map[string][]string{}
+		}
+		if services[name][c.Env] == nil {
+			services[name][c.Env] = map[string][]string{}
+		}
+		ports := c.Ports()
+		if len(ports) == 0 {
+			ports = []*ContainerPort{&ContainerPort{Name: PORT_MAIN, Bind: c.Port}}
+		}
+		for _, p := range ports {
+			addr := fmt.Sprintf("%s:%d", host.IP, p.Bind)
+			services[name][c.Env][p.Name] = append(services[name][c.Env][p.Name], addr)
+		}
+	}
+	return services
+}
+
+// 写到 etcd 的 /NBE/:app/services/:name/:env/:port, 值是地址的 json 列表
+// 和 etcd 里现在的比, 只写变了的, 没有容器了的删掉, 别人 watch 的时候不会看到整个没了
+func (a *Application) PublishServices() error {
+	root := path.Join(AppPathPrefix, a.Name, "services")
+	want := map[string]string{}
+	for name, envs := range a.Services() {
+		for env, ports := range envs {
+			for port, addrs := range ports {
+				value, err := JSONEncode(addrs)
+				if err != nil {
+					return err
+				}
+				want[path.Join(root, name, env, port)] = value
+			}
+		}
+	}
+
+	leaves, dirs := map[string]string{}, []string{}
+	if r, err := etcdClient.Get(root, false, true); err == nil && r != nil && r.Node != nil {
+		walkNodes(r.Node.Nodes, leaves, &dirs)
+	}
+	for key, value := range want {
+		if old, exists := leaves[key]; exists && old == value {
+			continue
+		}
+		if _, err := etcdClient.Set(key, value, 0); err != nil {
+			return err
+		}
+	}
+	for key := range leaves {
+		if _, exists := want[key]; !exists {
+			etcdClient.Delete(key, false)
+		}
+	}
+	// 下面什么都不剩的目录也删掉
+	for _, dir := range dirs {
+		used := false
+		for key := range want {
+			if strings.HasPrefix(key, dir+"/") {
+				used = true
+				break
+			}
+		}
+		if !used {
+			etcdClient.Delete(dir, true)
+		}
+	}
+	return nil
+}
+
+func walkNodes(nodes etcd.Nodes, leaves map[string]string, dirs *[]string) {
+	for _, n := range nodes {
+		if n.Dir {
+			*dirs = append(*dirs, n.Key)
+			walkNodes(n.Nodes, leaves, dirs)
+		} else {
+			leaves[n.Key] = n.Value
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package types
+
+import (
+	"encoding/json"
+	"strings"
+
+	. "utils"
+)
+
+// dot 和 levi 之间的协议版本
+// 0 是原来的 TaskReply, 全靠 Data 一个字符串; 1 开始是带 kind 的消息
+const (
+	PROTOCOL_LEGACY  = 0
+	PROTOCOL_VERSION = 1
+)
+
+const (
+	MSG_HELLO    = "hello"
+	MSG_FACTS    = "facts"
+	MSG_TASKS    = "tasks"
+	MSG_ACK      = "ack"
+	MSG_PROGRESS = "progress"
+	MSG_LOG      = "log"
+	MSG_RESULT   = "result"
+	MSG_STATUS   = "status"
+	MSG_ERROR    = "error"
+	MSG_HEALTH   = "health"
+	MSG_QUERY    = "query"
+)
+
+// 所有消息都是这个外壳, Body 按 Kind 解
+type Message struct {
+	Version int             `json:"version"`
+	Kind    string          `json:"kind"`
+	Body    json.RawMessage `json:"body"`
+}
+
+// levi 连上来的第一条消息, dot 用同样的结构回, 带上商量好的版本
+type Hello struct {
+	Version      int       `json:"version"`
+	Capabilities []string  `json:"capabilities"`
+	Host         HostFacts `json:"host"`
+}
+
+// hello 里带一份, 之后 levi 定时用 facts 再报
+// Memory 和 Disk 单位是字节
+type HostFacts struct {
+	Hostname string            `json:"hostname"`
+	Kernel   string            `json:"kernel"`
+	Docker   string            `json:"docker"`
+	Cores    int               `json:"cores"`
+	Memory   int64             `json:"memory"`
+	Disk     int64             `json:"disk"`
+	Labels   map[string]string `json:"labels"`
+}
+
+// 指到一组任务里的某一个, Type 是 ADD/REMOVE/BUILD/TEST
+type TaskRef struct {
+	ID    string `json:"id"`
+	Index int    `json:"index"`
+	Type  int    `json:"type"`
+}
+
+// levi 收到一组任务
+type Ack struct {
+	ID string `json:"id"`
+}
+
+// 重连之后 dot 问 levi 发过去没回的那些组收到了没有, levi 用同样的 kind 回
+// dot 发的只有 IDs, levi 回的时候 IDs 原样带回来, Known 是收到了的
+type Query struct {
+	IDs   []string `json:"ids"`
+	Known []string `json:"known,omitempty"`
+}
+
+// 任务还没完, 但是有东西要告诉 dot, 比如测试容器已经起来了
+type Progress struct {
+	TaskRef
+	Container string `json:"container"`
+}
+
+type Log struct {
+	TaskRef
+	Line string `json:"line"`
+}
+
+// 任务跑完了, 用哪个字段看 Type
+// ADD: Container, BUILD: Image, TEST: ExitCode, REMOVE: 只看 OK
+type Result struct {
+	TaskRef
+	OK        bool   `json:"ok"`
+	Container string `json:"container,omitempty"`
+	Image     string `json:"image,omitempty"`
+	ExitCode  int    `json:"exit_code"`
+}
+
+// 容器自己的状态变化, 不关联任务
+type Status struct {
+	Status    string `json:"status"`
+	Name      string `json:"name"`
+	Container string `json:"container"`
+	ExitCode  int    `json:"exit_code"`
+}
+
+// levi 在容器里跑 health 的 cmd 的结果
+type HealthReport struct {
+	Container string `json:"container"`
+	Healthy   bool   `json:"healthy"`
+	Message   string `json:"message"`
+}
+
+// 任务失败了, 没有结果
+type TaskError struct {
+	TaskRef
+	Message string `json:"message"`
+}
+
+func NewMessage(kind string, body interface{}) (*Message, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{Version: PROTOCOL_VERSION, Kind: kind, Body: b}, nil
+}
+
+func (m *Message) Decode(body interface{}) error {
+	return json.Unmarshal(m.Body, body)
+}
+
+// 两边都支持的最高版本
+func NegotiateVersion(version int) int {
+	if version > PROTOCOL_VERSION {
+		return PROTOCOL_VERSION
+	}
+	if version < PROTOCOL_LEGACY {
+		return PROTOCOL_LEGACY
+	}
+	return version
+}
+
+// 兼容老的 levi, 把 TaskReply 翻译成新消息
+// 老格式同一个 Data 在不同 Type 下意思不一样, 所以要看是哪个任务
+func LegacyMessages(reply *TaskReply, task *Task) []*Message {
+	if reply.ID == "__STATUS__" || reply.Type == INFO {
+		m, _ := NewMessage(MSG_STATUS, ParseLegacyStatus(reply.Data))
+		return []*Message{m}
+	}
+	ref := TaskRef{reply.ID, reply.Index, reply.Type}
+	var kind string
+	var body interface{}
+	switch {
+	case !reply.Done && reply.Type == ADD && task != nil && task.IsTest():
+		kind, body = MSG_PROGRESS, &Progress{ref, reply.Data}
+	case !reply.Done:
+		kind, body = MSG_LOG, &Log{ref, reply.Data}
+	case reply.Type == ADD:
+		// 测试任务不会在 ADD 里 done
+		ok := reply.Data != "" && (task == nil || !task.IsTest())
+		kind, body = MSG_RESULT, &Result{TaskRef: ref, OK: ok, Container: reply.Data}
+	case reply.Type == BUILD:
+		kind, body = MSG_RESULT, &Result{TaskRef: ref, OK: reply.Data != "", Image: reply.Data}
+	case reply.Type == TEST:
+		code := legacyExitCode(reply.Data)
+		kind, body = MSG_RESULT, &Result{TaskRef: ref, OK: code == 0, ExitCode: code}
+	case reply.Type == REMOVE:
+		kind, body = MSG_RESULT, &Result{TaskRef: ref, OK: reply.Data == "1"}
+	default:
+		return nil
+	}
+	ack, _ := NewMessage(MSG_ACK, &Ack{reply.ID})
+	m, _ := NewMessage(kind, body)
+	return []*Message{ack, m}
+}
+
+// status|name|containerId[|exitCode]
+func ParseLegacyStatus(data string) *Status {
+	r := strings.Split(data, "|")
+	if len(r) != 3 && len(r) != 4 {
+		return &Status{ExitCode: -1}
+	}
+	s := &Status{Status: r[0], Name: r[1], Container: r[2], ExitCode: -1}
+	if len(r) == 4 {
+		s.ExitCode = legacyExitCode(r[3])
+	}
+	return s
+}
+
+func legacyExitCode(s string) int {
+	return Atoi(strings.TrimSpace(s), -1)
+}
@@ -0,0 +1,119 @@
+package types
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLegacyMessages(t *testing.T) {
+	test := &Task{Test: "abc"}
+	add := &Task{}
+
+	cases := []struct {
+		name  string
+		reply TaskReply
+		task  *Task
+		kind  string
+		body  interface{}
+	}{
+		{"status", TaskReply{ID: "__STATUS__", Data: "die|web_1|abc|137"}, nil,
+			MSG_STATUS, &Status{Status: "die", Name: "web_1", Container: "abc", ExitCode: 137}},
+		{"info", TaskReply{ID: "x", Type: INFO, Data: "start|web_1|abc"}, nil,
+			MSG_STATUS, &Status{Status: "start", Name: "web_1", Container: "abc", ExitCode: -1}},
+		{"test container up", TaskReply{ID: "g1", Index: 2, Type: ADD, Data: "abc"}, test,
+			MSG_PROGRESS, &Progress{TaskRef{"g1", 2, ADD}, "abc"}},
+		{"log", TaskReply{ID: "g1", Index: 2, Type: BUILD, Data: "step 1"}, nil,
+			MSG_LOG, &Log{TaskRef{"g1", 2, BUILD}, "step 1"}},
+		{"add log", TaskReply{ID: "g1", Index: 2, Type: ADD, Data: "pulling"}, add,
+			MSG_LOG, &Log{TaskRef{"g1", 2, ADD}, "pulling"}},
+		{"add ok", TaskReply{ID: "g1", Index: 2, Type: ADD, Done: true, Data: "abc"}, add,
+			MSG_RESULT, &Result{TaskRef: TaskRef{"g1", 2, ADD}, OK: true, Container: "abc"}},
+		{"add unknown task", TaskReply{ID: "g1", Index: 2, Type: ADD, Done: true, Data: "abc"}, nil,
+			MSG_RESULT, &Result{TaskRef: TaskRef{"g1", 2, ADD}, OK: true, Container: "abc"}},
+		{"add failed", TaskReply{ID: "g1", Index: 2, Type: ADD, Done: true}, add,
+			MSG_RESULT, &Result{TaskRef: TaskRef{"g1", 2, ADD}}},
+		{"test done in add", TaskReply{ID: "g1", Index: 2, Type: ADD, Done: true, Data: "abc"}, test,
+			MSG_RESULT, &Result{TaskRef: TaskRef{"g1", 2, ADD}, Container: "abc"}},
+		{"build ok", TaskReply{ID: "g1", Index: 2, Type: BUILD, Done: true, Data: "img:1"}, nil,
+			MSG_RESULT, &Result{TaskRef: TaskRef{"g1", 2, BUILD}, OK: true, Image: "img:1"}},
+		{"build failed", TaskReply{ID: "g1", Index: 2, Type: BUILD, Done: true}, nil,
+			MSG_RESULT, &Result{TaskRef: TaskRef{"g1", 2, BUILD}}},
+		{"test passed", TaskReply{ID: "g1", Index: 2, Type: TEST, Done: true, Data: " 0\n"}, test,
+			MSG_RESULT, &Result{TaskRef: TaskRef{"g1", 2, TEST}, OK: true}},
+		{"test failed", TaskReply{ID: "g1", Index: 2, Type: TEST, Done: true, Data: "2"}, test,
+			MSG_RESULT, &Result{TaskRef: TaskRef{"g1", 2, TEST}, ExitCode: 2}},
+		{"test garbage", TaskReply{ID: "g1", Index: 2, Type: TEST, Done: true, Data: "boom"}, test,
+			MSG_RESULT, &Result{TaskRef: TaskRef{"g1", 2, TEST}, ExitCode: -1}},
+		{"remove ok", TaskReply{ID: "g1", Index: 2, Type: REMOVE, Done: true, Data: "1"}, nil,
+			MSG_RESULT, &Result{TaskRef: TaskRef{"g1", 2, REMOVE}, OK: true}},
+		{"remove failed", TaskReply{ID: "g1", Index: 2, Type: REMOVE, Done: true, Data: "0"}, nil,
+			MSG_RESULT, &Result{TaskRef: TaskRef{"g1", 2, REMOVE}}},
+		{"unknown type", TaskReply{ID: "g1", Index: 2, Type: 42, Done: true}, nil, "", nil},
+	}
+	for _, c := range cases {
+		ms := LegacyMessages(&c.reply, c.task)
+		if c.body == nil {
+			if ms != nil {
+				t.Errorf("%s: got %d messages, want none", c.name, len(ms))
+			}
+			continue
+		}
+		if c.kind != MSG_STATUS {
+			// 任务相关的前面都有一个 ack
+			if len(ms) != 2 || ms[0].Kind != MSG_ACK {
+				t.Errorf("%s: got %d messages, want ack and %s", c.name, len(ms), c.kind)
+				continue
+			}
+			var ack Ack
+			if err := ms[0].Decode(&ack); err != nil || ack.ID != c.reply.ID {
+				t.Errorf("%s: ack = %+v, %v", c.name, ack, err)
+			}
+			ms = ms[1:]
+		}
+		if len(ms) != 1 || ms[0].Kind != c.kind || ms[0].Version != PROTOCOL_VERSION {
+			t.Errorf("%s: got %+v, want one %s", c.name, ms, c.kind)
+			continue
+		}
+		got := reflect.New(reflect.TypeOf(c.body).Elem()).Interface()
+		if err := ms[0].Decode(got); err != nil {
+			t.Errorf("%s: decode %s", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.body) {
+			t.Errorf("%s: body = %+v, want %+v", c.name, got, c.body)
+		}
+	}
+}
+
+func TestParseLegacyStatus(t *testing.T) {
+	cases := []struct {
+		data string
+		want Status
+	}{
+		{"die|web_1|abc|1", Status{"die", "web_1", "abc", 1}},
+		{"die|web_1|abc|x", Status{"die", "web_1", "abc", -1}},
+		{"start|web_1|abc", Status{"start", "web_1", "abc", -1}},
+		{"start|web_1", Status{ExitCode: -1}},
+		{"a|b|c|d|e", Status{ExitCode: -1}},
+		{"", Status{ExitCode: -1}},
+	}
+	for _, c := range cases {
+		if got := ParseLegacyStatus(c.data); *got != c.want {
+			t.Errorf("ParseLegacyStatus(%q) = %+v, want %+v", c.data, *got, c.want)
+		}
+	}
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	cases := []struct{ in, want int }{
+		{-1, PROTOCOL_LEGACY},
+		{PROTOCOL_LEGACY, PROTOCOL_LEGACY},
+		{PROTOCOL_VERSION, PROTOCOL_VERSION},
+		{PROTOCOL_VERSION + 1, PROTOCOL_VERSION},
+	}
+	for _, c := range cases {
+		if got := NegotiateVersion(c.in); got != c.want {
+			t.Errorf("NegotiateVersion(%d) = %d, want %d", c.in, got, c.want)
+		}
+	}
+}
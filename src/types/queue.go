@@ -0,0 +1,262 @@
+package types
+
+import (
+	"time"
+
+	. "utils"
+)
+
+// 持久化任务的状态
+// queued: 已经分发给了 levi, 还在 dot 这边等待发送
+// sent: 已经写到了 websocket 上
+// acked: levi 已经有返回了
+// done: 整组任务完成
+const (
+	TASK_QUEUED = 0
+	TASK_SENT   = 1
+	TASK_ACKED  = 2
+	TASK_DONE   = 3
+)
+
+// 每一个分发出去的 Task 对应一条记录, 用 job id 作为标识
+// update 任务虽然会被切成两个, 但是 job id 是同一个, 所以只有一条
+type QueuedTask struct {
+	ID        int       `orm:"column(id);auto;pk" json:"id"`
+	JobID     int       `orm:"column(job_id)" json:"job_id"`
+	Host      string    `json:"host"`
+	UUID      string    `orm:"column(uuid)" json:"uuid"`
+	Type      int       `json:"type"`
+	Status    int       `json:"status"`
+	Container string    `json:"container"`
+	Content   string    `orm:"type(text)" json:"-"`
+	Created   time.Time `orm:"auto_now_add;type(datetime)" json:"created"`
+	Updated   time.Time `orm:"auto_now;type(datetime)" json:"updated"`
+}
+
+func (qt *QueuedTask) Task() *Task {
+	var task Task
+	if err := JSONDecode(qt.Content, &task); err != nil {
+		Logger.Info("queued task decode error: ", err)
+		return nil
+	}
+	task.Type = qt.Type
+	return &task
+}
+
+// 分发任务之前先记下来, 断线或者 dot 重启之后可以重放
+func EnqueueTask(host string, task *Task) error {
+	content, err := JSONEncode(task)
+	if err != nil {
+		return err
+	}
+	qt := &QueuedTask{
+		JobID:     task.ID,
+		Host:      host,
+		Type:      task.Type,
+		Status:    TASK_QUEUED,
+		Container: task.Container,
+		Content:   content,
+	}
+	_, err = db.Insert(qt)
+	return err
+}
+
+// 某个 host 上还没发出去的任务, 按照分发的顺序返回
+// 发出去了没回的不在这里, levi 可能已经跑过了, 要先问它 (GetUnackedGroups)
+func GetPendingTasks(host string) []*Task {
+	var qts []*QueuedTask
+	db.QueryTable(new(QueuedTask)).Filter("Host", host).Filter("Status", TASK_QUEUED).OrderBy("ID").All(&qts)
+	return queuedTasks(qts)
+}
+
+// 某个 host 上发出去了但是 levi 还没回过的组的 uuid
+func GetUnackedGroups(host string) []string {
+	var qts []*QueuedTask
+	db.QueryTable(new(QueuedTask)).Filter("Host", host).Filter("Status", TASK_SENT).OrderBy("ID").All(&qts, "UUID")
+	seen := map[string]bool{}
+	uuids := []string{}
+	for _, qt := range qts {
+		if qt.UUID != "" && !seen[qt.UUID] {
+			seen[qt.UUID] = true
+			uuids = append(uuids, qt.UUID)
+		}
+	}
+	return uuids
+}
+
+// levi 说没收到的那组, 原样拿出来重新分组再发
+func GetUnackedTasks(uuid string) []*Task {
+	var qts []*QueuedTask
+	db.QueryTable(new(QueuedTask)).Filter("UUID", uuid).Filter("Status", TASK_SENT).OrderBy("ID").All(&qts)
+	return queuedTasks(qts)
+}
+
+// 不会回答 query 的 levi 重连上来, 发出去了没回的不知道跑没跑, 整组当作失败
+func FailUnackedGroup(uuid, message string) {
+	var qts []*QueuedTask
+	db.QueryTable(new(QueuedTask)).Filter("UUID", uuid).Filter("Status", TASK_SENT).All(&qts, "JobID")
+	for _, qt := range qts {
+		if job := GetJob(qt.JobID); job != nil && job.Status != DONE {
+			job.Done(FAIL, message)
+		}
+	}
+	(&LeviGroupedTask{UUID: uuid}).setStatus(TASK_DONE)
+}
+
+// 做完了的记录留一段时间方便查, 之后就删掉
+func PruneQueuedTasks(before time.Time) {
+	_, err := db.QueryTable(new(QueuedTask)).Filter("Status", TASK_DONE).Filter("Updated__lt", before).Delete()
+	if err != nil {
+		Logger.Info("prune queued task error: ", err)
+	}
+}
+
+func queuedTasks(qts []*QueuedTask) []*Task {
+	tasks := []*Task{}
+	for _, qt := range qts {
+		if task := qt.Task(); task != nil {
+			tasks = append(tasks, task)
+		}
+	}
+	return tasks
+}
+
+// 根据 uuid 把发出去的一组任务重新拼出来
+// 顺序和发送时一致, 这样 TaskReply 里的 index 才对得上
+// 整组都完成了的就不要了, 已经回过的任务标成 done
+func GetGroupedTask(uuid string) *LeviGroupedTask {
+	var qts []*QueuedTask
+	db.QueryTable(new(QueuedTask)).Filter("UUID", uuid).Filter("Status__in", TASK_SENT, TASK_ACKED).OrderBy("ID").All(&qts)
+	if len(qts) == 0 {
+		return nil
+	}
+	var lgt *LeviGroupedTask
+	for _, qt := range qts {
+		task := qt.Task()
+		if task == nil {
+			return nil
+		}
+		if lgt == nil {
+			lgt = NewLeviGroupedTask(task.Name, task.Uid, task.Version)
+			lgt.UUID = uuid
+			lgt.acked = qt.Status == TASK_ACKED
+		}
+		lgt.AppendTask(task)
+	}
+	lgt.markFinished()
+	return lgt
+}
+
+// remove 的看容器还在不在, update 拆成的两半是同一个 job, 不能只看 job
+// 别的看 job 是不是已经 done 了
+func (lgt *LeviGroupedTask) markFinished() {
+	for _, task := range lgt.Tasks.Remove {
+		if task.Container == "" || GetContainerByCid(task.Container) == nil {
+			task.Done()
+		}
+	}
+	for _, tasks := range [][]*Task{lgt.Tasks.Build, lgt.Tasks.Add} {
+		for _, task := range tasks {
+			if job := GetJob(task.ID); job != nil && job.Status == DONE {
+				task.Done()
+			}
+		}
+	}
+}
+
+// 还在排队没发出去, 等着从 nginx 摘掉的任务发之前再看一眼, 别的连接可能已经发了
+func IsTaskQueued(jobID, kind int) bool {
+	n, err := db.QueryTable(new(QueuedTask)).Filter("JobID", jobID).Filter("Type", kind).Filter("Status", TASK_QUEUED).Count()
+	return err == nil && n > 0
+}
+
+// update 的新容器起来了, 从队列里把原来的任务拿出来, 拆出删老容器的那一半
+// 用同一个 job, 当作 remove 任务再走一遍 Dispatch
+func UpdateRemoveTask(jobID int) *Task {
+	var qt QueuedTask
+	err := db.QueryTable(new(QueuedTask)).Filter("JobID", jobID).Filter("Type", UPDATECONTAINER).One(&qt)
+	if err != nil {
+		return nil
+	}
+	task := qt.Task()
+	if task == nil || task.Container == "" {
+		return nil
+	}
+	_, remove := SplitUpdateTask(task)
+	remove.Type = REMOVECONTAINER
+	return remove
+}
+
+// 容器是不是正在被 remove/update 任务干掉
+// 这种时候报上来的 die 是自己弄的, 不用管
+func IsContainerRemoving(cid string) bool {
+	n, err := db.QueryTable(new(QueuedTask)).Filter("Container", cid).
+		Filter("Type__in", REMOVECONTAINER, UPDATECONTAINER).Filter("Status__lt", TASK_DONE).Count()
+	return err == nil && n > 0
+}
+
+// 一个 app 还有没发完的 remove/update, update 的 job 在新容器起来的时候就结束了
+// 删老容器的那一半还在等健康检查和 drain, 这种也算没跑完
+func HasQueuedRemoves(name string, since time.Time) bool {
+	var n int
+	err := db.Raw("SELECT COUNT(*) FROM queued_task q JOIN job j ON j.id=q.job_id WHERE j.app_name=? AND q.type IN (?, ?) AND q.status<? AND q.created>=?",
+		name, REMOVECONTAINER, UPDATECONTAINER, TASK_DONE, since).QueryRow(&n)
+	return err == nil && n > 0
+}
+
+// 这组任务对应的 job, task 的 ID 就是 job 的 ID
+func (lgt *LeviGroupedTask) JobIDs() []int {
+	g := map[int]struct{}{}
+	for _, tasks := range [][]*Task{lgt.Tasks.Build, lgt.Tasks.Add, lgt.Tasks.Remove} {
+		for _, task := range tasks {
+			if task != nil {
+				g[task.ID] = struct{}{}
+			}
+		}
+	}
+	r := []int{}
+	for id, _ := range g {
+		r = append(r, id)
+	}
+	return r
+}
+
+// 只往前走, update 的 job 会有两条记录, 不能把做完了的那条改回去
+func (lgt *LeviGroupedTask) setStatus(status int) {
+	_, err := db.QueryTable(new(QueuedTask)).Filter("UUID", lgt.UUID).Filter("Status__lt", status).Update(map[string]interface{}{
+		"Status":  status,
+		"Updated": time.Now(),
+	})
+	if err != nil {
+		Logger.Info("update queued task error: ", err)
+	}
+}
+
+// 发出去的时候才知道是哪一组, 还在排队的记上 uuid
+func (lgt *LeviGroupedTask) MarkSent() {
+	ids := lgt.JobIDs()
+	if len(ids) == 0 {
+		return
+	}
+	_, err := db.QueryTable(new(QueuedTask)).Filter("JobID__in", ids).Filter("Status", TASK_QUEUED).Update(map[string]interface{}{
+		"UUID":    lgt.UUID,
+		"Status":  TASK_SENT,
+		"Updated": time.Now(),
+	})
+	if err != nil {
+		Logger.Info("update queued task error: ", err)
+	}
+}
+
+// 第一次收到返回的时候才写库
+func (lgt *LeviGroupedTask) Ack() {
+	if lgt.acked {
+		return
+	}
+	lgt.acked = true
+	lgt.setStatus(TASK_ACKED)
+}
+
+func (lgt *LeviGroupedTask) Finish() {
+	lgt.setStatus(TASK_DONE)
+}
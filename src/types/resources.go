@@ -0,0 +1,140 @@
+package types
+
+import (
+	"fmt"
+
+	"config"
+)
+
+// 老的 app.yaml 里的入口, 测试用 test
+const (
+	ENTRY_CMD    = "cmd"
+	ENTRY_DAEMON = "daemon"
+	ENTRY_TEST   = "test"
+)
+
+type Ulimit struct {
+	Soft int64 `json:"soft"`
+	Hard int64 `json:"hard"`
+}
+
+// 一个容器要多少资源, 不写的用配置里的 task.memory/task.cpushare/task.cores
+// Memory 和 Disk 单位是字节, CpuSet 是绑几个核, 只有打开 use_cpu_set 才有用
+type Resources struct {
+	Memory    int               `json:"memory,omitempty"`
+	CpuShare  int               `json:"cpushare,omitempty" yaml:"cpushare"`
+	CpuSet    int               `json:"cpuset,omitempty" yaml:"cpuset"`
+	Exclusive *bool             `json:"exclusive,omitempty"`
+	Disk      int64             `json:"disk,omitempty"`
+	Ulimits   map[string]Ulimit `json:"ulimits,omitempty"`
+}
+
+// app.yaml 里的 resources, 外面一层是所有入口共用的, entrypoints 里按入口覆盖
+type ResourceSpec struct {
+	Resources   `yaml:",inline"`
+	Entrypoints map[string]Resources `json:"entrypoints,omitempty"`
+}
+
+func defaultResources() Resources {
+	r := Resources{Memory: config.Config.Task.Memory, CpuShare: config.Config.Task.CpuShare}
+	if config.Config.UseCPUSet {
+		exclusive := config.Config.Task.ExclusiveCores
+		r.CpuSet, r.Exclusive = config.Config.Task.Cores, &exclusive
+	}
+	return r
+}
+
+// o 里写了的覆盖 r 的, ulimits 按名字覆盖
+func (r Resources) merge(o Resources) Resources {
+	if o.Memory != 0 {
+		r.Memory = o.Memory
+	}
+	if o.CpuShare != 0 {
+		r.CpuShare = o.CpuShare
+	}
+	if o.CpuSet != 0 {
+		r.CpuSet = o.CpuSet
+	}
+	if o.Exclusive != nil {
+		r.Exclusive = o.Exclusive
+	}
+	if o.Disk != 0 {
+		r.Disk = o.Disk
+	}
+	if len(o.Ulimits) != 0 {
+		ulimits := map[string]Ulimit{}
+		for name, u := range r.Ulimits {
+			ulimits[name] = u
+		}
+		for name, u := range o.Ulimits {
+			ulimits[name] = u
+		}
+		r.Ulimits = ulimits
+	}
+	return r
+}
+
+// 某个入口最后用的资源
+func (s ResourceSpec) For(entrypoint string) Resources {
+	r := defaultResources().merge(s.Resources)
+	if e, exists := s.Entrypoints[entrypoint]; exists {
+		r = r.merge(e)
+	}
+	return r
+}
+
+func (r Resources) Cores() CoreRequest {
+	if !config.Config.UseCPUSet {
+		return CoreRequest{}
+	}
+	return CoreRequest{r.CpuSet, r.Exclusive != nil && *r.Exclusive}
+}
+
+// 和配置里的上限比, host 不是 nil 的话再和机器的容量比
+func (r Resources) Check(host *Host) error {
+	if r.Memory < 0 || r.CpuShare < 0 || r.CpuSet < 0 || r.Disk < 0 {
+		return fmt.Errorf("resources must not be negative")
+	}
+	max := config.Config.Task
+	switch {
+	case max.MaxMemory > 0 && r.Memory > max.MaxMemory:
+		return fmt.Errorf("memory %d exceeds max %d", r.Memory, max.MaxMemory)
+	case max.MaxCpuShare > 0 && r.CpuShare > max.MaxCpuShare:
+		return fmt.Errorf("cpushare %d exceeds max %d", r.CpuShare, max.MaxCpuShare)
+	case max.MaxCores > 0 && r.CpuSet > max.MaxCores:
+		return fmt.Errorf("cpuset %d exceeds max %d", r.CpuSet, max.MaxCores)
+	case max.MaxDisk > 0 && r.Disk > max.MaxDisk:
+		return fmt.Errorf("disk %d exceeds max %d", r.Disk, max.MaxDisk)
+	}
+	if host == nil {
+		return nil
+	}
+	switch {
+	case host.Memory > 0 && int64(r.Memory) > host.Memory:
+		return fmt.Errorf("memory %d exceeds host %s %d", r.Memory, host.IP, host.Memory)
+	case config.Config.UseCPUSet && r.CpuSet > host.TotalCores():
+		return fmt.Errorf("cpuset %d exceeds host %s %d cores", r.CpuSet, host.IP, host.TotalCores())
+	case host.Disk > 0 && r.Disk > host.Disk:
+		return fmt.Errorf("disk %d exceeds host %s %d", r.Disk, host.IP, host.Disk)
+	}
+	return nil
+}
+
+// 注册的时候检查, names 是 app.yaml 里有的入口
+func (s ResourceSpec) Validate(names []string) error {
+	known := map[string]bool{}
+	for _, name := range names {
+		known[name] = true
+	}
+	for name := range s.Entrypoints {
+		if !known[name] {
+			return fmt.Errorf("unknown entrypoint %s in resources", name)
+		}
+	}
+	for _, name := range names {
+		if err := s.For(name).Check(nil); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	return nil
+}
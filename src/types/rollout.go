@@ -0,0 +1,133 @@
+package types
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+const (
+	ROLLOUT_RUNNING     = "running"
+	ROLLOUT_SUCCEEDED   = "succeeded"
+	ROLLOUT_ROLLINGBACK = "rollingback"
+	ROLLOUT_ROLLEDBACK  = "rolledback"
+	ROLLOUT_FAILED      = "failed"
+)
+
+// 一次滚动升级, 从 From 升到 To
+// 每批升 BatchSize 个, 健康检查过了才升下一批, 失败了就滚回 From
+type Rollout struct {
+	ID          int       `orm:"column(id);auto;pk" json:"id"`
+	AppName     string    `json:"app_name"`
+	FromVersion string    `json:"from_version"`
+	ToVersion   string    `json:"to_version"`
+	Status      string    `json:"status"`
+	BatchSize   int       `json:"batch_size"`
+	Pause       int       `json:"pause"`
+	Health      string    `json:"health"`
+	HealthPath  string    `json:"health_path"`
+	Timeout     int       `json:"timeout"`
+	Total       int       `json:"total"`
+	Upgraded    int       `json:"upgraded"`
+	Batch       int       `json:"batch"`
+	TaskIDs     string    `orm:"column(task_ids);type(text)" json:"task_ids"`
+	Steps       string    `orm:"type(text)" json:"-"`
+	Message     string    `json:"message"`
+	Created     time.Time `orm:"auto_now_add;type(datetime)" json:"created"`
+	Updated     time.Time `orm:"auto_now;type(datetime)" json:"updated"`
+}
+
+// 一个要升的老容器, 升的时候记下发出去的 update 任务, 0 是还没升
+// 老容器删了之后回滚要靠这里记的机器和入口补回来
+type RolloutStep struct {
+	Old    *Container `json:"old"`
+	TaskID int        `json:"task_id"`
+}
+
+func NewRollout(from, to *AppVersion, batchSize, pause int, health, healthPath string, timeout int, cs []*Container) *Rollout {
+	steps := make([]*RolloutStep, len(cs))
+	for i, c := range cs {
+		steps[i] = &RolloutStep{Old: c}
+	}
+	r := &Rollout{
+		AppName:     from.Name,
+		FromVersion: from.Version,
+		ToVersion:   to.Version,
+		Status:      ROLLOUT_RUNNING,
+		BatchSize:   batchSize,
+		Pause:       pause,
+		Health:      health,
+		HealthPath:  healthPath,
+		Timeout:     timeout,
+		Total:       len(cs),
+	}
+	r.setSteps(steps)
+	if _, err := db.Insert(r); err != nil {
+		return nil
+	}
+	return r
+}
+
+func GetRollout(id int) *Rollout {
+	var r Rollout
+	if err := db.QueryTable(new(Rollout)).Filter("ID", id).One(&r); err != nil {
+		return nil
+	}
+	return &r
+}
+
+func GetRollouts(appname string, start, limit int) []*Rollout {
+	var rs []*Rollout
+	db.QueryTable(new(Rollout)).Filter("AppName", appname).OrderBy("-ID").Limit(limit, start).All(&rs)
+	return rs
+}
+
+// dot 重启的时候还没跑完的
+func GetUnfinishedRollouts() []*Rollout {
+	var rs []*Rollout
+	db.QueryTable(new(Rollout)).Filter("Status__in", ROLLOUT_RUNNING, ROLLOUT_ROLLINGBACK).OrderBy("ID").All(&rs)
+	return rs
+}
+
+func (r *Rollout) GetSteps() []*RolloutStep {
+	steps := []*RolloutStep{}
+	json.Unmarshal([]byte(r.Steps), &steps)
+	return steps
+}
+
+func (r *Rollout) setSteps(steps []*RolloutStep) {
+	b, _ := json.Marshal(steps)
+	r.Steps = string(b)
+}
+
+// 第 i 个老容器的 update 任务发出去了
+func (r *Rollout) SetStepTask(i, taskID int) {
+	steps := r.GetSteps()
+	if i < 0 || i >= len(steps) {
+		return
+	}
+	steps[i].TaskID = taskID
+	r.setSteps(steps)
+	r.AddTaskIDs([]int{taskID})
+}
+
+func (r *Rollout) Save() {
+	db.Update(r)
+}
+
+// 记下这次升级发出去的任务, 逗号分隔
+func (r *Rollout) AddTaskIDs(ids []int) {
+	for _, id := range ids {
+		if r.TaskIDs != "" {
+			r.TaskIDs += ","
+		}
+		r.TaskIDs += strconv.Itoa(id)
+	}
+	r.Save()
+}
+
+func (r *Rollout) Finish(status, message string) {
+	r.Status = status
+	r.Message = message
+	r.Save()
+}
@@ -14,6 +14,7 @@ var (
 	db         orm.Ormer
 	etcdClient *etcd.Client
 	portMutex  sync.Mutex
+	coreMutex  sync.Mutex
 )
 
 func LoadStore() {
@@ -21,7 +22,8 @@ func LoadStore() {
 	orm.RegisterDataBase(config.Config.Db.Name, config.Config.Db.Use, config.Config.Db.Url, 30)
 	orm.RegisterDataBase(config.Config.Dbmgr.Name, config.Config.Dbmgr.Use, config.Config.Dbmgr.Url, 30)
 
-	orm.RegisterModel(new(Application), new(AppVersion), new(User), new(Host), new(Container), new(Port), new(Job))
+	orm.RegisterModel(new(Application), new(AppVersion), new(User), new(Host), new(Container), new(Port), new(Job), new(QueuedTask),
+		new(Deployment), new(Event), new(Rollout), new(Canary), new(Audit), new(Core), new(EnvVar), new(Environment), new(Domain), new(Certificate), new(Listener), new(ContainerPort))
 	orm.RunSyncdb(config.Config.Db.Name, false, false)
 	db = orm.NewOrm()
 
@@ -33,4 +35,5 @@ func LoadStore() {
 
 	// Mutex
 	portMutex = sync.Mutex{}
+	coreMutex = sync.Mutex{}
 }
@@ -1,6 +1,8 @@
 package types
 
 import (
+	"errors"
+	"fmt"
 	"strings"
 
 	"code.google.com/p/go-uuid/uuid"
@@ -26,18 +28,37 @@ type Task struct {
 	done    bool   `json:"-"`
 
 	// run options
-	Cmd      []string `json:"cmd,omitempty"`
-	Uid      int      `json:"uid,omitempty"`
-	Bind     int      `json:"bind,omitempty"`
-	Port     int      `json:"port,omitempty"`
-	Memory   int      `json:"memory,omitempty"`
-	CpuShare int      `json:"cpushare,omitempty"`
-	CpuSet   string   `json:"cpuset,omitempty"`
-	Daemon   string   `json:"daemon,omitempty"`
+	Cmd      []string          `json:"cmd,omitempty"`
+	Uid      int               `json:"uid,omitempty"`
+	Bind     int               `json:"bind,omitempty"`
+	Port     int               `json:"port,omitempty"`
+	Memory   int               `json:"memory,omitempty"`
+	CpuShare int               `json:"cpushare,omitempty"`
+	CpuSet   string            `json:"cpuset,omitempty"`
+	Disk     int64             `json:"disk,omitempty"`
+	Ulimits  map[string]Ulimit `json:"ulimits,omitempty"`
+	Daemon   string            `json:"daemon,omitempty"`
+	// 用的 app.yaml 里哪个入口, 容器表里会记下来
+	Entrypoint string `json:"entrypoint,omitempty"`
+	// 挂了重启的时候带上前面重启过几次, 容器表里会记下来
+	Restarts int `json:"restarts,omitempty"`
+	// 发给 levi 之前才填, 队列里存的任务没有
+	Env map[string]string `json:"env,omitempty"`
+	// 跑在哪个环境, 老的任务没有, 看是不是测试
+	Environment string `json:"environment,omitempty"`
+	// app.yaml 里的健康检查, levi 要跑 cmd 的
+	Health *HealthCheck `json:"health,omitempty"`
+	// 端口的协议, http 的不写; udp 的 levi 要绑 udp 端口
+	Protocol string `json:"protocol,omitempty"`
+	// 所有的端口, Port/Bind 是里面进 nginx 的那个, 老的 levi 只绑它
+	Ports []*PortBind `json:"ports,omitempty"`
 
 	// remove options
 	Container string `json:"container,omitempty"`
 	RmImage   bool   `json:"rmimg,omitempty"`
+	// 从 nginx 摘掉之后 dot 等 Drain 秒再发, levi SIGTERM 之后等 Grace 秒再 kill
+	Drain int `json:"drain,omitempty"`
+	Grace int `json:"grace,omitempty"`
 
 	// test options
 	Test string `json:"test,omitempty"`
@@ -62,6 +83,7 @@ type LeviGroupedTask struct {
 	Uid     int        `json:"uid"`
 	Version string     `json:"version"`
 	Tasks   *LeviTasks `json:"tasks"`
+	acked   bool       `json:"-"`
 }
 
 // sent back from Levi
@@ -117,9 +139,9 @@ func (lgt *LeviGroupedTask) AppendTask(task *Task) {
 	case REMOVECONTAINER:
 		lgt.Tasks.Remove = append(lgt.Tasks.Remove, task)
 	case UPDATECONTAINER:
-		add, remove := SplitUpdateTask(task)
+		// 先只起新容器, 起来了再单独发删老容器的, 见 UpdateRemoveTask
+		add, _ := SplitUpdateTask(task)
 		lgt.Tasks.Add = append(lgt.Tasks.Add, add)
-		lgt.Tasks.Remove = append(lgt.Tasks.Remove, remove)
 	case BUILDIMAGE:
 		lgt.Tasks.Build = append(lgt.Tasks.Build, task)
 	}
@@ -173,68 +195,104 @@ func (t *Task) IsTest() bool {
 	return t.Test != ""
 }
 
+func (t *Task) GetEnvironment() string {
+	switch {
+	case t.Environment != "":
+		return t.Environment
+	case t.IsTest():
+		return ENV_TEST
+	}
+	return ENV_PROD
+}
+
+// 新容器一开始的健康状态
+func (t *Task) InitialHealth() string {
+	if t.Health == nil {
+		return ""
+	}
+	return HEALTH_STARTING
+}
+
 func (t *Task) Done() {
 	t.done = true
 }
 
-func AddContainerTask(av *AppVersion, host *Host, appYaml *AppYaml, daemon bool, cores []string) *Task {
-	if len(appYaml.Daemon) == 0 && daemon {
-		Logger.Info("no daemon defined in app.yaml")
-		return nil
-	}
-	if len(appYaml.Cmd) == 0 && !daemon {
-		Logger.Info("no cmd defined in app.yaml")
-		return nil
+// entrypoint 用 appYaml.GetEntrypoint 拿, env 是环境的名字
+// 出错的时候占了的端口和核都放回去
+func AddContainerTask(av *AppVersion, host *Host, appYaml *AppYaml, entrypoint *Entrypoint, env string) (*Task, error) {
+	cmd, err := entrypoint.Argv()
+	if err != nil {
+		return nil, fmt.Errorf("entrypoint %s: %s", entrypoint.Name, err)
 	}
 
-	bind := 0
+	// daemon 不绑端口
+	var binds []*PortBind
+	bind := &PortBind{Port: appYaml.Port}
 	daemonID := ""
-	cmd := []string{}
 	subapp := ""
 
 	if appYaml.Appname != av.Name {
 		subapp = appYaml.Appname
 	}
 
-	if daemon {
-		bind = 0
+	res := appYaml.Resources.For(entrypoint.Name)
+	if err := res.Check(host); err != nil {
+		return nil, err
+	}
+	if !IsEnvironment(env) {
+		return nil, fmt.Errorf("%s: %s", NoSuchEnvironment, env)
+	}
+	if _, err := ResolveEnv(av.Name, env); err != nil {
+		return nil, err
+	}
+
+	if entrypoint.Daemon {
 		daemonID = RandomString(7)
-		cmd = strings.Split(appYaml.Daemon[0], " ")
 	} else {
-		bind = GetPortFromHost(host)
-		if bind == 0 {
-			return nil
+		binds = appYaml.bindPorts(host)
+		if binds == nil {
+			return nil, fmt.Errorf("no free port on %s", host.IP)
 		}
+		bind = appYaml.ingressBind(binds)
 		daemonID = ""
-		cmd = strings.Split(appYaml.Cmd[0], " ")
 	}
 
 	job := NewJob(av, ADDCONTAINER)
 	if job == nil {
-		Logger.Info("task not inserted")
-		return nil
+		releaseBinds(host, binds)
+		return nil, errors.New("task not inserted")
 	}
 
-	cpuset := ""
-	if config.Config.UseCPUSet && len(cores) != 0 {
-		cpuset = strings.Join(cores, ",")
+	cpuset, err := AllocateCores(host, job.ID, res.Cores())
+	if err != nil {
+		job.Done(FAIL, err.Error())
+		releaseBinds(host, binds)
+		return nil, fmt.Errorf("allocate cores on %s: %s", host.IP, err)
 	}
 
 	return &Task{
 		ID:       job.ID,
 		Name:     strings.ToLower(av.Name),
 		Version:  av.Version,
-		Port:     appYaml.Port,
+		Port:     bind.Port,
+		Protocol: appYaml.taskProtocol(),
+		Ports:    binds,
 		Cmd:      cmd,
 		Type:     ADDCONTAINER,
 		Uid:      av.UserUID(),
-		Bind:     bind,
-		Memory:   config.Config.Task.Memory,
-		CpuShare: config.Config.Task.CpuShare,
+		Bind:     bind.Bind,
+		Memory:   res.Memory,
+		CpuShare: res.CpuShare,
 		CpuSet:   cpuset,
+		Disk:     res.Disk,
+		Ulimits:  res.Ulimits,
 		Daemon:   daemonID,
 		SubApp:   subapp,
-	}
+
+		Entrypoint:  entrypoint.Name,
+		Environment: env,
+		Health:      appYaml.HealthFor(entrypoint),
+	}, nil
 }
 
 func RemoveContainerTask(container *Container) *Task {
@@ -255,6 +313,7 @@ func RemoveContainerTask(container *Container) *Task {
 		return nil
 	}
 
+	stop := container.StopPolicy()
 	return &Task{
 		ID:        job.ID,
 		Name:      strings.ToLower(av.Name),
@@ -264,10 +323,12 @@ func RemoveContainerTask(container *Container) *Task {
 		Container: container.ContainerID,
 		RmImage:   rmImg,
 		SubApp:    container.SubApp,
+		Drain:     stop.GetDrain(),
+		Grace:     stop.GetGrace(),
 	}
 }
 
-func UpdateContainerTask(container *Container, av *AppVersion, cores string) *Task {
+func UpdateContainerTask(container *Container, av *AppVersion) *Task {
 	host := container.Host()
 	oav := container.AppVersion()
 	if host == nil || oav == nil {
@@ -277,54 +338,92 @@ func UpdateContainerTask(container *Container, av *AppVersion, cores string) *Ta
 	if err != nil {
 		return nil
 	}
+	// 老容器按老版本的来停
+	stop := container.StopPolicy()
 	rmImg := false
 	if cs := GetContainerByHostAndAppVersion(host, oav); len(cs) == 1 {
 		rmImg = true
 	}
 
-	bind := 0
+	// daemon 不绑端口
+	var binds []*PortBind
+	bind := &PortBind{Port: appYaml.Port}
 	daemonID := ""
-	cmd := []string{}
 
-	if container.IdentID != "" {
-		bind = 0
+	// 新版本里要有同名的入口
+	entrypoint, err := container.GetEntrypoint(appYaml)
+	if err != nil {
+		Logger.Info("entrypoint error: ", err)
+		return nil
+	}
+	cmd, err := entrypoint.Argv()
+	if err != nil {
+		Logger.Info("entrypoint error: ", err)
+		return nil
+	}
+	res := appYaml.Resources.For(entrypoint.Name)
+	if err := res.Check(host); err != nil {
+		Logger.Info("resources error: ", err)
+		return nil
+	}
+	if _, err := ResolveEnv(av.Name, container.Env); err != nil {
+		Logger.Info("env error: ", err)
+		return nil
+	}
+
+	if entrypoint.Daemon {
 		daemonID = RandomString(7)
-		cmd = strings.Split(appYaml.Daemon[0], " ")
 	} else {
-		bind = GetPortFromHost(host)
-		if bind == 0 {
+		binds = appYaml.bindPorts(host)
+		if binds == nil {
 			return nil
 		}
+		bind = appYaml.ingressBind(binds)
 		daemonID = ""
-		cmd = strings.Split(appYaml.Cmd[0], " ")
 	}
 
 	job := NewJob(av, UPDATECONTAINER)
 	if job == nil {
 		Logger.Info("task not inserted")
+		releaseBinds(host, binds)
 		return nil
 	}
 
-	if !config.Config.UseCPUSet {
-		cores = ""
+	// 新老容器会同时在一会儿, 所以新容器另外分
+	cores, err := AllocateCores(host, job.ID, res.Cores())
+	if err != nil {
+		Logger.Info("allocate cores error: ", err)
+		job.Done(FAIL, err.Error())
+		releaseBinds(host, binds)
+		return nil
 	}
 
 	return &Task{
 		ID:        job.ID,
 		Name:      strings.ToLower(av.Name),
 		Version:   av.Version,
-		Port:      appYaml.Port,
+		Port:      bind.Port,
+		Protocol:  appYaml.taskProtocol(),
+		Ports:     binds,
 		Cmd:       cmd,
 		Type:      UPDATECONTAINER,
 		Uid:       av.UserUID(),
-		Bind:      bind,
-		Memory:    config.Config.Task.Memory,
-		CpuShare:  config.Config.Task.CpuShare,
+		Bind:      bind.Bind,
+		Memory:    res.Memory,
+		CpuShare:  res.CpuShare,
 		CpuSet:    cores,
+		Disk:      res.Disk,
+		Ulimits:   res.Ulimits,
 		Daemon:    daemonID,
 		Container: container.ContainerID,
 		SubApp:    container.SubApp,
 		RmImage:   rmImg,
+		Drain:     stop.GetDrain(),
+		Grace:     stop.GetGrace(),
+
+		Entrypoint:  entrypoint.Name,
+		Environment: container.Env,
+		Health:      appYaml.HealthFor(entrypoint),
 	}
 }
 
@@ -336,6 +435,8 @@ func SplitUpdateTask(task *Task) (*Task, *Task) {
 		Name:     task.Name,
 		Version:  task.Version,
 		Port:     task.Port,
+		Protocol: task.Protocol,
+		Ports:    task.Ports,
 		Cmd:      task.Cmd,
 		Type:     UPDATECONTAINER,
 		Uid:      task.Uid,
@@ -343,8 +444,14 @@ func SplitUpdateTask(task *Task) (*Task, *Task) {
 		Memory:   task.Memory,
 		CpuShare: task.CpuShare,
 		CpuSet:   task.CpuSet,
+		Disk:     task.Disk,
+		Ulimits:  task.Ulimits,
 		Daemon:   task.Daemon,
 		SubApp:   task.SubApp,
+
+		Entrypoint:  task.Entrypoint,
+		Environment: task.Environment,
+		Health:      task.Health,
 	}
 	removeTask := &Task{
 		ID:        task.ID,
@@ -355,6 +462,8 @@ func SplitUpdateTask(task *Task) (*Task, *Task) {
 		Container: task.Container,
 		RmImage:   task.RmImage,
 		SubApp:    task.SubApp,
+		Drain:     task.Drain,
+		Grace:     task.Grace,
 	}
 	return addTask, removeTask
 }
@@ -393,7 +502,7 @@ func BuildImageTask(av *AppVersion, base string) *Task {
 		Version: av.Version,
 		Group:   app.Namespace,
 		Base:    base,
-		Build:   appYaml.Build[0],
+		Build:   appYaml.BuildCmd(),
 		Static:  appYaml.Static,
 		Schema:  "", // 先来个空的吧
 		done:    false,
@@ -406,30 +515,60 @@ func TestApplicationTask(av *AppVersion, host *Host) *Task {
 		Logger.Debug("app.yaml error: ", err)
 		return nil
 	}
-	if len(appYaml.Test) == 0 {
-		Logger.Debug("test task error: need test in app.yaml")
+	testCmd, err := appYaml.TestArgv()
+	if err != nil {
+		Logger.Debug("test task error: ", err)
+		return nil
+	}
+	res := appYaml.Resources.For(ENTRY_TEST)
+	if err := res.Check(host); err != nil {
+		Logger.Info("resources error: ", err)
+		return nil
+	}
+	if _, err := ResolveEnv(av.Name, ENV_TEST); err != nil {
+		Logger.Info("env error: ", err)
 		return nil
 	}
-	testCmd := strings.Split(appYaml.Test[0], " ")
 
 	job := NewJob(av, TESTAPPLICATION)
 	if job == nil {
 		Logger.Info("task not inserted")
 		return nil
 	}
+
+	// 没要绑核就用配置里固定的
+	cpuset := config.Config.Task.CpuSet
+	if cores := res.Cores(); cores.Count > 0 {
+		var err error
+		if cpuset, err = AllocateCores(host, job.ID, cores); err != nil {
+			Logger.Info("allocate cores error: ", err)
+			job.Done(FAIL, err.Error())
+			return nil
+		}
+	}
+	port := 0
+	if p := appYaml.IngressPort(); p != nil {
+		port = p.Port
+	}
 	return &Task{
 		ID:       job.ID,
 		Name:     strings.ToLower(av.Name),
 		Version:  av.Version,
-		Port:     appYaml.Port,
+		Port:     port,
+		Protocol: appYaml.taskProtocol(),
 		Cmd:      testCmd,
 		Type:     TESTAPPLICATION,
 		Uid:      av.UserUID(),
 		Bind:     0,
-		Memory:   config.Config.Task.Memory,
-		CpuShare: config.Config.Task.CpuShare,
-		CpuSet:   config.Config.Task.CpuSet,
+		Memory:   res.Memory,
+		CpuShare: res.CpuShare,
+		CpuSet:   cpuset,
+		Disk:     res.Disk,
+		Ulimits:  res.Ulimits,
 		SubApp:   "",
 		Test:     RandomString(7),
+
+		Entrypoint:  ENTRY_TEST,
+		Environment: ENV_TEST,
 	}
 }
@@ -1,6 +1,9 @@
 package types
 
-import . "utils"
+import (
+	"config"
+	. "utils"
+)
 
 type User struct {
 	ID   int `orm:"column(id);auto;pk"`
@@ -17,3 +20,16 @@ func NewUser(username string) *User {
 	user.ID = int(id)
 	return &user
 }
+
+// 打开 auth 之后 auth.admins 里的用户什么都能改
+func IsAdmin(user string) bool {
+	if !config.Config.Auth.Enable {
+		return false
+	}
+	for _, admin := range config.Config.Auth.Admins {
+		if admin == user {
+			return true
+		}
+	}
+	return false
+}
@@ -1,6 +1,12 @@
 package utils
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"io"
@@ -44,6 +50,11 @@ func EnsureFileAbsent(path string) error {
 	return os.Remove(path)
 }
 
+func FileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
 func RandomString(length int) string {
 	r, _ := randutil.AlphaString(length)
 	return r
@@ -95,6 +106,103 @@ func CopyFiles(dst, src string, uid, gid int) error {
 	})
 }
 
+// hmac-sha256(secret, "a|b|c")
+func HMACSign(secret string, parts ...string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join(parts, "|")))
+	return mac.Sum(nil)
+}
+
+// aes-gcm, key 是 base64 的 16/24/32 字节
+// 返回 base64(nonce + 密文)
+func Encrypt(key, plaintext string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(plaintext), nil)), nil
+}
+
+func Decrypt(key, ciphertext string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	data, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < gcm.NonceSize() {
+		return "", errors.New("ciphertext too short")
+	}
+	plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+func newGCM(key string) (cipher.AEAD, error) {
+	k, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// 按 shell 的规则把命令切成 argv
+// 支持单引号, 双引号和反斜杠转义, 不做变量展开
+func SplitArgs(s string) ([]string, error) {
+	args := []string{}
+	var arg []rune
+	inArg, escaped := false, false
+	var quote rune
+	for _, r := range s {
+		switch {
+		case escaped:
+			// 双引号里只有这几个字符的反斜杠是转义
+			if quote == '"' && r != '"' && r != '\\' && r != '$' && r != '`' {
+				arg = append(arg, '\\')
+			}
+			arg = append(arg, r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inArg = true, true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			arg = append(arg, r)
+		case r == '\'' || r == '"':
+			quote, inArg = r, true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, string(arg))
+				arg, inArg = nil, false
+			}
+		default:
+			arg, inArg = append(arg, r), true
+		}
+	}
+	if escaped {
+		return nil, errors.New("trailing backslash in " + s)
+	}
+	if quote != 0 {
+		return nil, errors.New("unterminated quote in " + s)
+	}
+	if inArg {
+		args = append(args, string(arg))
+	}
+	return args, nil
+}
+
 func Atoi(s string, def int) int {
 	if r, err := strconv.Atoi(s); err != nil {
 		return def
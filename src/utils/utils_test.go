@@ -0,0 +1,118 @@
+package utils
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	cases := []struct {
+		in   string
+		want []string
+		err  bool
+	}{
+		{"", []string{}, false},
+		{"   ", []string{}, false},
+		{"python app.py", []string{"python", "app.py"}, false},
+		{"  a \t b\nc  ", []string{"a", "b", "c"}, false},
+		{`echo 'a b' "c d"`, []string{"echo", "a b", "c d"}, false},
+		{`echo ''`, []string{"echo", ""}, false},
+		{`echo a""b`, []string{"echo", "ab"}, false},
+		{`echo a\ b`, []string{"echo", "a b"}, false},
+		{`echo '\n $HOME'`, []string{"echo", `\n $HOME`}, false},
+		{`echo "\$HOME \"x\" \\ \n"`, []string{"echo", `$HOME "x" \ \n`}, false},
+		{`sh -c "gunicorn -w 4 'app:create()'"`, []string{"sh", "-c", "gunicorn -w 4 'app:create()'"}, false},
+		{`echo 'abc`, nil, true},
+		{`echo "abc`, nil, true},
+		{`echo abc\`, nil, true},
+	}
+	for _, c := range cases {
+		got, err := SplitArgs(c.in)
+		if c.err {
+			if err == nil {
+				t.Errorf("SplitArgs(%q) = %q, want error", c.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("SplitArgs(%q) error: %s", c.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("SplitArgs(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+	other := base64.StdEncoding.EncodeToString([]byte("fedcba9876543210"))
+	for _, plain := range []string{"", "secret", "多字节 密码 \x00"} {
+		enc, err := Encrypt(key, plain)
+		if err != nil {
+			t.Fatalf("Encrypt(%q) error: %s", plain, err)
+		}
+		if enc2, _ := Encrypt(key, plain); enc2 == enc {
+			t.Errorf("Encrypt(%q) reused nonce", plain)
+		}
+		dec, err := Decrypt(key, enc)
+		if err != nil || dec != plain {
+			t.Errorf("Decrypt(Encrypt(%q)) = %q, %v", plain, dec, err)
+		}
+		if _, err := Decrypt(other, enc); err == nil {
+			t.Errorf("Decrypt(%q) with wrong key succeeded", plain)
+		}
+	}
+
+	enc, _ := Encrypt(key, "secret")
+	raw, _ := base64.StdEncoding.DecodeString(enc)
+	raw[len(raw)-1] ^= 1
+	tampered := base64.StdEncoding.EncodeToString(raw)
+
+	bad := []struct {
+		key, ciphertext string
+	}{
+		{"not base64!", enc},
+		{base64.StdEncoding.EncodeToString([]byte("short")), enc},
+		{key, "not base64!"},
+		{key, base64.StdEncoding.EncodeToString([]byte("abc"))},
+		{key, tampered},
+	}
+	for _, c := range bad {
+		if _, err := Decrypt(c.key, c.ciphertext); err == nil {
+			t.Errorf("Decrypt(%q, %q) want error", c.key, c.ciphertext)
+		}
+	}
+	if _, err := Encrypt("not base64!", "x"); err == nil {
+		t.Error("Encrypt with bad key want error")
+	}
+}
+
+func TestHMACSign(t *testing.T) {
+	cases := []struct {
+		secret string
+		parts  []string
+		want   string
+	}{
+		{"key", []string{"The quick brown fox jumps over the lazy dog"}, "f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8"},
+		{"", nil, "b613679a0814d9ec772f95d778c35fc5ff1697c493715653c6c712144292c5ad"},
+	}
+	for _, c := range cases {
+		if got := hex.EncodeToString(HMACSign(c.secret, c.parts...)); got != c.want {
+			t.Errorf("HMACSign(%q, %q) = %s, want %s", c.secret, c.parts, got, c.want)
+		}
+	}
+
+	// 各部分用 | 连起来签
+	sig := hex.EncodeToString(HMACSign("s", "alice", "1500000000"))
+	if joined := hex.EncodeToString(HMACSign("s", "alice|1500000000")); joined != sig {
+		t.Errorf("parts not joined with |: %s != %s", sig, joined)
+	}
+	for _, other := range [][]string{{"t", "alice", "1500000000"}, {"s", "bob", "1500000000"}, {"s", "alice", "1500000001"}} {
+		if hex.EncodeToString(HMACSign(other[0], other[1:]...)) == sig {
+			t.Errorf("HMACSign(%q) collides", other)
+		}
+	}
+}